@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+)
+
+const sessionIDParam = "session_id"
+
+// sessionResource shows a session the user is signed in to. Its ID is not
+// the one in the cookie, which must stay secret.
+type sessionResource struct {
+	ID        string    `json:"id"`
+	Current   bool      `json:"current"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// publicSessionID is the ID a session is shown with
+func publicSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// browserNames and systemNames are what browsers and systems are called, in
+// the order they must be looked for in a user agent: Edge claims to be
+// Chrome, Chrome to be Safari, and Android to be Linux.
+var (
+	browserNames = [][2]string{{"Edg", "Edge"}, {"OPR", "Opera"}, {"Firefox", "Firefox"}, {"Chrome", "Chrome"}, {"Safari", "Safari"}}
+	systemNames  = [][2]string{{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iOS"}, {"CrOS", "Chrome OS"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"}}
+)
+
+// describeDevice names the browser and system of a user agent, such as
+// "Chrome on Windows"
+func describeDevice(userAgent string) string {
+	find := func(names [][2]string) string {
+		for _, n := range names {
+			if strings.Contains(userAgent, n[0]) {
+				return n[1]
+			}
+		}
+		return ""
+	}
+	browser, system := find(browserNames), find(systemNames)
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+// endSession deletes session and clears its cookie
+func endSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	session.Options.MaxAge = -1
+	return store.Save(r, w, session)
+}
+
+// logout signs the user out of this browser. A form posts the CSRF token as
+// csrf_token and is sent back home, a script sends it in the X-CSRF-Token
+// header and gets a 204.
+func logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := store.Get(r, sessionKey)
+	if err == nil && session.Values[userIDKey] != nil {
+		token, _ := session.Values[csrfTokenKey].(string)
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue("csrf_token")
+		}
+		if !validToken(token, sent) {
+			http.Error(w, "Signing out needs the CSRF token of the session", http.StatusForbidden)
+			return
+		}
+	}
+
+	err = endSession(w, r, session)
+	if err != nil {
+		log.Printf("failed to end session => {%s}", err)
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get(csrfHeader) != "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// currentSession returns the session r was made with, which requireSession
+// already loaded
+func currentSession(r *http.Request) *sessions.Session {
+	session, _ := store.Get(r, sessionKey)
+	return session
+}
+
+// listSessions lists the sessions the user is signed in to, most recently
+// seen first
+func listSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	current := currentSession(r)
+	userID, _ := current.Values[userIDKey].(string)
+
+	list, err := requestStores(r).Sessions.ListByUser(userID)
+	if err != nil {
+		internalError(w, r, "Failed to list sessions", err)
+		return
+	}
+
+	res := []sessionResource{}
+	for _, ss := range list {
+		res = append(res, sessionResource{
+			ID:        publicSessionID(ss.ID),
+			Current:   ss.ID == current.ID,
+			Device:    describeDevice(ss.UserAgent),
+			UserAgent: ss.UserAgent,
+			IP:        ss.IP,
+			CreatedAt: ss.CreatedAt,
+			LastSeen:  ss.LastSeen,
+			ExpiresAt: ss.ExpiresAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// revokeSession signs the user out of one of their sessions, which may be
+// the current one
+func revokeSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	current := currentSession(r)
+	userID, _ := current.Values[userIDKey].(string)
+	publicID := p.ByName(sessionIDParam)
+	st := requestStores(r)
+
+	list, err := st.Sessions.ListByUser(userID)
+	if err != nil {
+		internalError(w, r, "Failed to list sessions", err)
+		return
+	}
+	for _, ss := range list {
+		if publicSessionID(ss.ID) != publicID {
+			continue
+		}
+		if ss.ID == current.ID {
+			err = endSession(w, r, current)
+		} else {
+			err = st.Sessions.Delete(ss.ID)
+		}
+		if err != nil && err != mgo.ErrNotFound {
+			internalError(w, r, "Failed to revoke session", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeError(w, r, http.StatusNotFound, codeNotFound, "No session %s", publicID)
+}
+
+// disconnectGoogle revokes the access the user granted to their Gmail,
+// forgets their token and signs them out everywhere. Their shared drafts
+// stop being synced with Gmail until they sign in again.
+func disconnectGoogle(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	current := currentSession(r)
+	userID, _ := current.Values[userIDKey].(string)
+	st := requestStores(r)
+
+	stored, err := st.loadToken(userID)
+	if err == nil {
+		err = revokeToken(stored.Token)
+		if err != nil {
+			gmailError(w, r, "Failed to revoke access to Gmail", err)
+			return
+		}
+	} else if err != mgo.ErrNotFound {
+		internalError(w, r, "Failed to load token", err)
+		return
+	}
+
+	err = st.Tokens.Delete(userID)
+	if err != nil && err != mgo.ErrNotFound {
+		internalError(w, r, "Failed to delete token", err)
+		return
+	}
+
+	err = st.disableSync(userID)
+	if err != nil {
+		internalError(w, r, "Failed to stop syncing drafts", err)
+		return
+	}
+
+	err = st.Sessions.DeleteByUser(userID)
+	if err != nil {
+		internalError(w, r, "Failed to end sessions", err)
+		return
+	}
+	err = endSession(w, r, current)
+	if err != nil {
+		internalError(w, r, "Failed to end session", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disableSync stops syncing the drafts in a user's mailbox, which can no
+// longer be reached
+func (st *Stores) disableSync(userID string) error {
+	drafts, err := st.Drafts.List(DraftQuery{
+		MailboxID:         userID,
+		ExcludeSyncStates: inactiveSyncStates,
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range drafts {
+		_, err = updateDraft(st.Drafts, d.DraftID, func(mail *Email) error {
+			if containsString(inactiveSyncStates, mail.Sync.State) {
+				return errSyncInactive
+			}
+			mail.Sync.State = syncDisabled
+			return nil
+		})
+		if err == errSyncInactive {
+			continue
+		} else if err != nil {
+			return err
+		}
+		publishDraftEvent(draftEvent{
+			Type:    eventDisabled,
+			DraftID: d.DraftID,
+			User:    d.Owner,
+		})
+	}
+	return nil
+}
+
+// resuming counts the resumeSync runs under way, which are waited for before
+// disconnecting from Mongo
+var resuming sync.WaitGroup
+
+// resumeSync syncs the drafts of a user's mailbox again after they signed
+// back in. Changes made in Gmail meanwhile are read before the drafts are
+// pushed, so neither side's changes are lost.
+func (st *Stores) resumeSync(userID string) {
+	drafts, err := st.Drafts.List(DraftQuery{
+		MailboxID:  userID,
+		SyncStates: []string{syncDisabled},
+	})
+	if err != nil {
+		log.Printf("resumeSync: failed to load drafts of %s => {%s}", userID, err)
+		return
+	}
+	if len(drafts) == 0 {
+		return
+	}
+
+	for _, d := range drafts {
+		_, err = updateDraft(st.Drafts, d.DraftID, func(mail *Email) error {
+			mail.Sync.State = syncPending
+			mail.Sync.Attempts = 0
+			return nil
+		})
+		if err != nil {
+			log.Printf("resumeSync: failed to enable sync of %s => {%s}", d.DraftID, err)
+		}
+	}
+
+	st.checkMailbox(userID)
+	for _, d := range drafts {
+		st.queueSync(d.DraftID)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// apiPrefix is where version 1 of the JSON API is served. Breaking
+	// changes go under a new version.
+	apiPrefix = "/api/v1"
+
+	requestIDHeader = "X-Request-Id"
+)
+
+// Error codes of the API. Clients should act on these rather than on the
+// messages, which are for people and may change.
+const (
+	codeBadRequest      = "bad_request"
+	codeInvalidJSON     = "invalid_json"
+	codeUnauthenticated = "unauthenticated"
+	codeForbidden       = "forbidden"
+	codeBadCSRFToken    = "bad_csrf_token"
+	codeNotFound        = "not_found"
+	codeAlreadyExists   = "already_exists"
+	codeConflict        = "conflict"
+	codeExpired         = "expired"
+	codeReadOnly        = "read_only"
+	codeStaleRevision   = "stale_revision"
+	codeNeedsApproval   = "needs_approval"
+	codeDraftOrphaned   = "draft_orphaned"
+	codeSyncDisabled    = "sync_disabled"
+	codeSendUnconfirmed = "send_unconfirmed"
+	codeTooLarge        = "too_large"
+	codeRateLimited     = "rate_limited"
+	codeGmail           = "gmail_error"
+	codeInternal        = "internal_error"
+)
+
+// requestIDPattern is what a request ID handed in by a client may look like.
+// Anything else is replaced so it can be logged safely.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// errorEnvelope is the body of every error response of the API.
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// withRequestID gives every request an ID, taken from the X-Request-Id
+// header when the client sent a usable one. It is echoed in the response
+// headers, error bodies and logs so a failure can be traced.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = bson.NewObjectId().Hex()
+		}
+		context.Set(r, requestIDContextKey, id)
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the ID given to r by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := context.Get(r, requestIDContextKey).(string)
+	return id
+}
+
+// withStores hands st to every request, for the handlers to keep their data
+// in
+func withStores(st *Stores, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, storesContextKey, st)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestStores returns the stores given to r by withStores
+func requestStores(r *http.Request) *Stores {
+	return context.Get(r, storesContextKey).(*Stores)
+}
+
+// writeJSON writes v as the response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(v)
+	if err != nil {
+		log.Printf("Failed write data to conn => {%s}", err)
+	}
+}
+
+// writeError writes an error envelope with status, a code from the list
+// above and a message
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, format string, args ...interface{}) {
+	writeJSON(w, status, &errorEnvelope{Error: errorBody{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		RequestID: requestID(r),
+	}})
+}
+
+// internalError logs err with the request ID and writes a 500 that doesn't
+// leak it
+func internalError(w http.ResponseWriter, r *http.Request, what string, err error) {
+	log.Printf("[%s] %s => {%s}", requestID(r), what, err)
+	writeError(w, r, http.StatusInternalServerError, codeInternal, "%s, see request %s", what, requestID(r))
+}
+
+// gmailError logs err with the request ID and writes a 502 for a Gmail call
+// that failed
+func gmailError(w http.ResponseWriter, r *http.Request, what string, err error) {
+	log.Printf("[%s] %s => {%s}", requestID(r), what, err)
+	writeError(w, r, http.StatusBadGateway, codeGmail, "%s => {%s}", what, err)
+}
+
+// readJSON decodes the request body into v, writing an invalid_json error if
+// it can't
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	err := decoder.Decode(v)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidJSON, "Failed to decode JSON request => {%s}", err)
+		return false
+	}
+	return true
+}
+
+// notFound answers requests no route matched, with an error envelope for
+// the API
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No such endpoint %s %s", r.Method, r.URL.Path)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// serveOpenAPI serves the OpenAPI document describing the API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, openAPIDocument)
+}
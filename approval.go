@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	eventApproved = "approved"
+	eventSent     = "sent"
+
+	// sendConfirmDelay is how long after a send Gmail didn't confirm it is
+	// looked up, growing with each attempt
+	sendConfirmDelay       = 30 * time.Second
+	maxSendConfirmAttempts = 5
+
+	// staleSendClaim is how long a send may stay claimed before it is taken
+	// to be abandoned, by a server that stopped say, and is looked up by the
+	// claim sweep. It is well past the confirmation attempts.
+	staleSendClaim = 15 * time.Minute
+)
+
+// ApprovalStatus is the sign-off a draft needs before it can be sent.
+// Approvals are cleared by every Edit, so they always refer to the draft as
+// it is now.
+type ApprovalStatus struct {
+	Required  []string   `bson:"required" json:"required"`
+	Approvals []Approval `bson:"approvals" json:"approvals"`
+}
+
+// Approval is one collaborator's sign-off on a draft.
+type Approval struct {
+	User       string    `bson:"user" json:"user"`
+	Revision   int       `bson:"revision" json:"revision"`
+	ApprovedAt time.Time `bson:"approved_at" json:"approved_at"`
+}
+
+// SentInfo records who sent a draft and the Gmail message it became. A
+// draft with SentInfo is read-only. Sending is set while Gmail hasn't
+// confirmed the send, since ClaimedAt; MessageID is then the message it goes
+// out as.
+type SentInfo struct {
+	SentBy    string    `bson:"sent_by" json:"sent_by"`
+	SentAt    time.Time `bson:"sent_at" json:"sent_at"`
+	MessageID string    `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	ThreadID  string    `bson:"thread_id,omitempty" json:"thread_id,omitempty"`
+	Sending   bool      `bson:"sending,omitempty" json:"sending,omitempty"`
+	ClaimedAt time.Time `bson:"claimed_at,omitempty" json:"-"`
+}
+
+var (
+	errDraftOrphaned   = errors.New("draft was deleted from Gmail")
+	errSyncDisabled    = errors.New("draft owner disconnected their Google account")
+	errNeedsApproval   = errors.New("draft still needs approval")
+	errSendConflict    = errors.New("draft changed or was already sent")
+	errSendUnconfirmed = errors.New("Gmail didn't confirm the send")
+	errDraftChanged    = errors.New("draft changed since it was read")
+)
+
+type approversRequest struct {
+	Approvers []string `json:"approvers"`
+}
+
+type approvalResponse struct {
+	ApprovalStatus
+	Pending []string `json:"pending"`
+}
+
+// pendingApprovers lists the required approvers of mail who haven't signed
+// off yet
+func pendingApprovers(mail *Email) []string {
+	pending := []string{}
+	for _, user := range mail.Approval.Required {
+		approved := false
+		for _, a := range mail.Approval.Approvals {
+			if a.User == user {
+				approved = true
+				break
+			}
+		}
+		if !approved {
+			pending = append(pending, user)
+		}
+	}
+	return pending
+}
+
+// sameRevisions reports whether none of the fields of mail changed in
+// latest
+func sameRevisions(mail, latest *Email) bool {
+	revisions := syncedRevisions(latest)
+	for field, revision := range syncedRevisions(mail) {
+		if revisions[field] != revision {
+			return false
+		}
+	}
+	return true
+}
+
+// newApprovalResponse shows who has to approve mail and who already has
+func newApprovalResponse(mail *Email) approvalResponse {
+	status := mail.Approval
+	if status.Required == nil {
+		status.Required = []string{}
+	}
+	if status.Approvals == nil {
+		status.Approvals = []Approval{}
+	}
+	return approvalResponse{ApprovalStatus: status, Pending: pendingApprovers(mail)}
+}
+
+// draftApproval returns who has to approve a draft and who already has
+func draftApproval(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, newApprovalResponse(requestDraft(r)))
+}
+
+// setApprovers sets the collaborators who must approve a draft before it can
+// be sent. An empty list lets the owner send without sign-off.
+func setApprovers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	var req approversRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	required := []string{}
+	for _, user := range req.Approvers {
+		user = strings.ToLower(strings.TrimSpace(user))
+		if roleOf(mail, user) == "" {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "%s is not a collaborator on draft %s", user, mail.DraftID)
+			return
+		}
+		required = append(required, user)
+	}
+
+	mail, err := updateDraft(requestStores(r).Drafts, mail.DraftID, func(mail *Email) error {
+		mail.Approval.Required = required
+		return nil
+	})
+	if err != nil {
+		internalError(w, r, "Failed to set approvers", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newApprovalResponse(mail))
+}
+
+// approveDraft signs off on a draft as it is now for the current user, who
+// must be one of its required approvers
+func approveDraft(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	user := requestUser(r)
+
+	required := false
+	for _, u := range mail.Approval.Required {
+		if u == user {
+			required = true
+			break
+		}
+	}
+	if !required {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "%s is not an approver of draft %s", user, mail.DraftID)
+		return
+	}
+
+	if mail.Sent != nil {
+		writeError(w, r, http.StatusConflict, codeReadOnly, "Draft %s was already sent", mail.DraftID)
+		return
+	}
+
+	approval := Approval{User: user, Revision: mail.Revision, ApprovedAt: time.Now()}
+	approved := false
+	latest, err := updateDraft(requestStores(r).Drafts, mail.DraftID, func(latest *Email) error {
+		if latest.Sent != nil || !sameRevisions(mail, latest) {
+			return errDraftChanged
+		}
+		for _, a := range latest.Approval.Approvals {
+			if a.User == user {
+				approved = true
+				return nil
+			}
+		}
+		latest.Approval.Approvals = append(latest.Approval.Approvals, approval)
+		return nil
+	})
+	if err == errDraftChanged {
+		writeError(w, r, http.StatusConflict, codeStaleRevision, "Draft %s changed, review it again before approving", mail.DraftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to approve draft", err)
+		return
+	}
+	if !approved {
+		publishDraftEvent(draftEvent{
+			Type:    eventApproved,
+			DraftID: mail.DraftID,
+			User:    user,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, newApprovalResponse(latest))
+}
+
+// sendDraft sends the owner's Gmail draft once every required approver has
+// signed off, then keeps the draft here read-only with the sent message ID.
+func sendDraft(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	sent, err := requestStores(r).sendEmail(mail, requestUser(r))
+	switch err {
+	case nil:
+	case errDraftOrphaned:
+		writeError(w, r, http.StatusConflict, codeDraftOrphaned, "Draft %s was deleted from Gmail", mail.DraftID)
+		return
+	case errSyncDisabled:
+		writeError(w, r, http.StatusConflict, codeSyncDisabled, "The owner of draft %s has to sign in again before it can be sent", mail.DraftID)
+		return
+	case errNeedsApproval:
+		writeError(w, r, http.StatusConflict, codeNeedsApproval, "Draft %s still needs approval from %s", mail.DraftID, strings.Join(pendingApprovers(mail), ", "))
+		return
+	case errSendConflict:
+		writeError(w, r, http.StatusConflict, codeConflict, "Draft %s changed or was already sent", mail.DraftID)
+		return
+	case errSendUnconfirmed:
+		writeError(w, r, http.StatusBadGateway, codeSendUnconfirmed, "Gmail didn't confirm sending draft %s, it's being checked", mail.DraftID)
+		return
+	default:
+		gmailError(w, r, "Failed to send draft", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sent)
+}
+
+// sendEmail sends mail as it was loaded on behalf of user, refusing if it
+// has been changed since or still needs approval
+func (st *Stores) sendEmail(mail *Email, user string) (*SentInfo, error) {
+	if mail.Sync.State == syncOrphaned {
+		return nil, errDraftOrphaned
+	}
+	if mail.Sync.State == syncDisabled {
+		return nil, errSyncDisabled
+	}
+	if len(pendingApprovers(mail)) > 0 {
+		return nil, errNeedsApproval
+	}
+
+	// claim the send, so the draft can't be edited or sent twice meanwhile.
+	// It stays claimed until Gmail confirms whether it went out, which the
+	// claim sweep finds out if this server doesn't.
+	_, err := updateDraft(st.Drafts, mail.DraftID, func(latest *Email) error {
+		if latest.Sent != nil && latest.Sent.Sending {
+			return errSendUnconfirmed
+		}
+		if latest.Sent != nil || !sameRevisions(mail, latest) {
+			return errSendConflict
+		}
+		if len(pendingApprovers(latest)) > 0 {
+			return errNeedsApproval
+		}
+		now := time.Now()
+		latest.Sent = &SentInfo{SentBy: user, SentAt: now, Sending: true, ClaimedAt: now}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gm, messageID, err := st.prepareSend(mail)
+	if err == nil {
+		// recorded so a send Gmail doesn't confirm can be looked up
+		_, err = updateDraft(st.Drafts, mail.DraftID, func(latest *Email) error {
+			if latest.Sent == nil {
+				return errSendConflict
+			}
+			latest.Sent.MessageID = messageID
+			return nil
+		})
+	}
+	if err != nil {
+		st.releaseSend(mail.DraftID)
+		return nil, err
+	}
+
+	msg, err := gm.SendDraft(mail.DraftID)
+	if err != nil {
+		if mayHaveSent(err) {
+			log.Printf("failed to confirm send of %s => {%s}", mail.DraftID, err)
+			st.confirmSendLater(mail.DraftID, 1)
+			return nil, errSendUnconfirmed
+		}
+		st.releaseSend(mail.DraftID)
+		if err == errGmailNotFound {
+			return nil, errDraftOrphaned
+		}
+		return nil, err
+	}
+	return st.recordSend(mail.DraftID, user, msg), nil
+}
+
+// prepareSend pushes any Edits Gmail hasn't seen yet and returns the mailbox
+// holding the draft and the ID of the message it holds, which is the one it
+// is sent as
+func (st *Stores) prepareSend(mail *Email) (Gmail, string, error) {
+	messageID := mail.Sync.MessageID
+	if mail.Sync.State != syncSynced || messageID == "" {
+		var err error
+		messageID, err = st.pushDraft(mail)
+		if err == errGmailNotFound {
+			return nil, "", errDraftOrphaned
+		} else if err != nil {
+			return nil, "", err
+		}
+	}
+
+	gm, err := st.gmailForUser(mail.MailboxID)
+	if err != nil {
+		return nil, "", err
+	}
+	return gm, messageID, nil
+}
+
+// mayHaveSent tells whether Gmail may have sent a draft although sending it
+// failed: the connection broke, or Gmail failed, while the send was under
+// way. Gmail refusing the send, rate limiting included, means it didn't.
+func mayHaveSent(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code >= 500
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// releaseSend gives up the claim on a send that didn't go out, so the draft
+// can be edited and sent again
+func (st *Stores) releaseSend(draftID string) {
+	_, err := updateDraft(st.Drafts, draftID, func(latest *Email) error {
+		latest.Sent = nil
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to release send of %s => {%s}", draftID, err)
+	}
+}
+
+// recordSend records that a draft went out as msg
+func (st *Stores) recordSend(draftID, user string, msg *GmailMessage) *SentInfo {
+	sent := SentInfo{SentBy: user, SentAt: time.Now(), MessageID: msg.ID, ThreadID: msg.ThreadID}
+	_, err := updateDraft(st.Drafts, draftID, func(latest *Email) error {
+		latest.Sent = &sent
+		latest.Sync.State = syncSent
+		return nil
+	})
+	if err != nil {
+		// Gmail has sent it, so report success regardless
+		log.Printf("failed to record send of %s as %s => {%s}", draftID, msg.ID, err)
+	}
+
+	publishDraftEvent(draftEvent{
+		Type:    eventSent,
+		DraftID: draftID,
+		User:    user,
+	})
+	return &sent
+}
+
+// confirmSendLater looks up a send Gmail didn't confirm after a while
+func (st *Stores) confirmSendLater(draftID string, attempt int) {
+	time.AfterFunc(sendConfirmDelay*time.Duration(attempt), func() {
+		st.confirmSend(draftID, attempt)
+	})
+}
+
+// confirmSend finds out whether a send Gmail didn't confirm went out, and
+// records it as sent or releases it. Until that is known the draft stays
+// claimed, so it can't be sent twice, and once attempts run out the claim
+// sweep keeps looking.
+func (st *Stores) confirmSend(draftID string, attempt int) {
+	mail, err := st.Drafts.Get(draftID)
+	if err != nil {
+		log.Printf("confirmSend: failed to load %s => {%s}", draftID, err)
+		return
+	}
+	if mail.Sent == nil || !mail.Sent.Sending {
+		return
+	}
+
+	msg, err := st.findSentMessage(mail)
+	switch {
+	case err == nil && msg != nil:
+		st.recordSend(draftID, mail.Sent.SentBy, msg)
+	case err == nil:
+		st.releaseSend(draftID)
+	case attempt < maxSendConfirmAttempts:
+		log.Printf("confirmSend: failed to look up send of %s, trying again => {%s}", draftID, err)
+		st.confirmSendLater(draftID, attempt+1)
+	default:
+		log.Printf("confirmSend: failed to look up send of %s, leaving it to the claim sweep => {%s}", draftID, err)
+	}
+}
+
+// sweepSendClaims looks up every send claimed for longer than
+// staleSendClaim, whose server would have confirmed it by then unless it
+// stopped, and records it as sent or releases it
+func (st *Stores) sweepSendClaims() {
+	drafts, err := st.Drafts.List(DraftQuery{SendClaimedBefore: time.Now().Add(-staleSendClaim)})
+	if err != nil {
+		log.Printf("sweepSendClaims: failed to query claimed sends => {%s}", err)
+		return
+	}
+	for _, d := range drafts {
+		st.confirmSend(d.DraftID, maxSendConfirmAttempts)
+	}
+}
+
+// findSentMessage looks in Gmail for the message a claimed send went out as.
+// Gmail deletes a draft when it sends it, so one still there wasn't sent, and
+// one gone without its message was deleted instead. A nil message means the
+// draft didn't go out.
+func (st *Stores) findSentMessage(mail *Email) (*GmailMessage, error) {
+	if mail.Sent.MessageID == "" {
+		// the send never got to Gmail
+		return nil, nil
+	}
+	gm, err := st.gmailForUser(mail.MailboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gm.DraftMessageID(mail.DraftID)
+	if err == nil {
+		return nil, nil
+	} else if err != errGmailNotFound {
+		return nil, err
+	}
+
+	msg, err := gm.GetMessage(mail.Sent.MessageID)
+	if err == errGmailNotFound {
+		return nil, nil
+	}
+	return msg, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// shareDraft shares a new Gmail draft of the test mailbox and syncs it
+func (c *testClient) shareDraft() string {
+	draftID := c.ts.fake.AddDraft([]byte(testDraft))
+	if status := c.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, nil); status != http.StatusCreated {
+		c.ts.t.Fatalf("create = %d", status)
+	}
+	c.ts.syncQueued()
+	return draftID
+}
+
+func TestUnconfirmedSendIsNotRepeated(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	ts.fake.FailNextSend(true)
+	var apiErr errorEnvelope
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, &apiErr); status != http.StatusBadGateway || apiErr.Error.Code != codeSendUnconfirmed {
+		t.Fatalf("send Gmail failed = %d %s", status, apiErr.Error.Code)
+	}
+
+	// the claim stays, so the draft can't be sent again meanwhile
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, nil); status != http.StatusConflict {
+		t.Fatalf("sending again while unconfirmed = %d, want 409", status)
+	}
+	if mail, _ := ts.stores.Drafts.Get(draftID); mail.Sent == nil || !mail.Sent.Sending {
+		t.Fatalf("draft isn't claimed as sending: %+v", mail.Sent)
+	}
+
+	ts.stores.confirmSend(draftID, maxSendConfirmAttempts)
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	if mail.Sent == nil || mail.Sent.Sending || mail.Sent.MessageID == "" || mail.Sync.State != syncSent {
+		t.Fatalf("send wasn't confirmed: %+v", mail.Sent)
+	}
+	if len(ts.fake.Sent()) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(ts.fake.Sent()))
+	}
+}
+
+func TestUnconfirmedSendThatFailedIsReleased(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	ts.fake.FailNextSend(false)
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, nil); status != http.StatusBadGateway {
+		t.Fatalf("send Gmail failed = %d", status)
+	}
+
+	// Gmail still has the draft, so it didn't go out
+	ts.stores.confirmSend(draftID, maxSendConfirmAttempts)
+	if mail, _ := ts.stores.Drafts.Get(draftID); mail.Sent != nil {
+		t.Fatalf("send wasn't released: %+v", mail.Sent)
+	}
+
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, nil); status != http.StatusOK {
+		t.Fatalf("send after release = %d", status)
+	}
+	if len(ts.fake.Sent()) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(ts.fake.Sent()))
+	}
+}
+
+func TestStaleSendClaimIsSwept(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	ts.fake.FailNextSend(true)
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, nil); status != http.StatusBadGateway {
+		t.Fatalf("send Gmail failed = %d", status)
+	}
+
+	// a fresh claim is left to the server that made it
+	ts.stores.sweepSendClaims()
+	if mail, _ := ts.stores.Drafts.Get(draftID); mail.Sent == nil || !mail.Sent.Sending {
+		t.Fatalf("fresh claim was swept: %+v", mail.Sent)
+	}
+
+	// one its server never confirmed, as if it stopped, is looked up
+	updateDraft(ts.stores.Drafts, draftID, func(mail *Email) error {
+		mail.Sent.ClaimedAt = mail.Sent.ClaimedAt.Add(-2 * staleSendClaim)
+		return nil
+	})
+	ts.stores.sweepSendClaims()
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	if mail.Sent == nil || mail.Sent.Sending || mail.Sync.State != syncSent {
+		t.Fatalf("stale claim wasn't confirmed: %+v", mail.Sent)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	attachmentIDParam = "attachment_id_param"
+
+	// attachmentPrefix is the GridFS prefix of the Mongo blob store, so
+	// files live in attachments.files and attachments.chunks
+	attachmentPrefix = "attachments"
+
+	eventAttachmentAdded   = "attachment_added"
+	eventAttachmentRemoved = "attachment_removed"
+)
+
+var (
+	// maxAttachmentSize limits a single uploaded file and
+	// maxDraftAttachmentSize all the files on one draft. Gmail refuses
+	// messages over 25MB, encoding included.
+	maxAttachmentSize      int64 = 10 << 20
+	maxDraftAttachmentSize int64 = 18 << 20
+)
+
+var errAttachmentsTooLarge = errors.New("attachments are too large")
+
+// Attachment is a file on a shared draft. The data is kept in the BlobStore
+// under ID rather than in the draft, which would soon outgrow a Mongo
+// document.
+type Attachment struct {
+	ID          string    `bson:"id" json:"id"`
+	Filename    string    `bson:"filename" json:"filename"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	ContentID   string    `bson:"content_id,omitempty" json:"content_id,omitempty"`
+	Inline      bool      `bson:"inline,omitempty" json:"inline,omitempty"`
+	Size        int64     `bson:"size" json:"size"`
+	UploadedBy  string    `bson:"uploaded_by" json:"uploaded_by"`
+	UploadedAt  time.Time `bson:"uploaded_at" json:"uploaded_at"`
+}
+
+// storeAttachment keeps the data of a and describes the result
+func (st *Stores) storeAttachment(draftID, uploadedBy string, a MIMEAttachment) (*Attachment, error) {
+	id, err := st.Blobs.Put(draftID, a.Filename, a.ContentType, a.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attachment{
+		ID:          id,
+		Filename:    a.Filename,
+		ContentType: a.ContentType,
+		ContentID:   a.ContentID,
+		Inline:      a.Inline,
+		Size:        int64(len(a.Data)),
+		UploadedBy:  uploadedBy,
+		UploadedAt:  time.Now(),
+	}, nil
+}
+
+// importAttachments moves the attachments of a new draft's message into
+// the blob store, attributing them to the owner
+func (st *Stores) importAttachments(mail *Email) error {
+	for _, a := range mail.Message.Attachments {
+		stored, err := st.storeAttachment(mail.DraftID, mail.Owner, a)
+		if err != nil {
+			st.removeAttachmentFiles(mail.Attachments)
+			mail.Attachments = nil
+			return err
+		}
+		mail.Attachments = append(mail.Attachments, *stored)
+	}
+	mail.Message.Attachments = nil
+	return nil
+}
+
+// loadAttachments reads the attachments of mail back from the blob store so
+// they can be rebuilt into its message
+func (st *Stores) loadAttachments(mail *Email) ([]MIMEAttachment, error) {
+	if len(mail.Attachments) == 0 {
+		return nil, nil
+	}
+	out := make([]MIMEAttachment, 0, len(mail.Attachments))
+	for _, a := range mail.Attachments {
+		file, err := st.Blobs.Open(a.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open attachment %s => {%s}", a.ID, err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read attachment %s => {%s}", a.ID, err)
+		}
+		out = append(out, MIMEAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Inline:      a.Inline,
+			Data:        data,
+		})
+	}
+	return out, nil
+}
+
+// removeAttachmentFiles deletes the data of attachments, logging rather
+// than failing since the draft no longer refers to them
+func (st *Stores) removeAttachmentFiles(attachments []Attachment) {
+	for _, a := range attachments {
+		err := st.Blobs.Remove(a.ID)
+		if err != nil && err != mgo.ErrNotFound {
+			log.Printf("failed to remove attachment %s => {%s}", a.ID, err)
+		}
+	}
+}
+
+func attachmentsSize(mail *Email) int64 {
+	var total int64
+	for _, a := range mail.Attachments {
+		total += a.Size
+	}
+	return total
+}
+
+// findAttachment returns the attachment of mail with the given ID
+func findAttachment(mail *Email, id string) *Attachment {
+	for i := range mail.Attachments {
+		if mail.Attachments[i].ID == id {
+			return &mail.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// listAttachments returns the attachments of a draft and who added them
+func listAttachments(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	attachments := mail.Attachments
+	if attachments == nil {
+		attachments = []Attachment{}
+	}
+	writeJSON(w, http.StatusOK, attachments)
+}
+
+// downloadAttachment streams the data of one attachment
+func downloadAttachment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+	a := findAttachment(mail, p.ByName(attachmentIDParam))
+	if a == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Draft %s has no attachment %s", mail.DraftID, p.ByName(attachmentIDParam))
+		return
+	}
+
+	file, err := requestStores(r).Blobs.Open(a.ID)
+	if err != nil {
+		internalError(w, r, "Failed to open attachment "+a.ID, err)
+		return
+	}
+	defer file.Close()
+
+	// the data comes from anyone on the draft, so browsers must neither
+	// render it in place nor guess it is something other than its type
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size(), 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = io.Copy(w, file)
+	if err != nil {
+		log.Printf("Failed write data to conn => {%s}", err)
+	}
+}
+
+// uploadAttachment adds the file in the multipart form field "file" to a
+// draft. The optional content_id and inline fields mark it as an inline
+// image for the HTML body.
+func uploadAttachment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	// leave room for the rest of the form around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Failed to read file from form => {%s}", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Failed to read file => {%s}", err)
+		return
+	}
+	if int64(len(data)) > maxAttachmentSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeTooLarge, "Attachments can be at most %d bytes", maxAttachmentSize)
+		return
+	}
+	if attachmentsSize(mail)+int64(len(data)) > maxDraftAttachmentSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeTooLarge, "Attachments on a draft can be at most %d bytes in total", maxDraftAttachmentSize)
+		return
+	}
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" || contentType == "application/octet-stream" {
+		if t := mime.TypeByExtension(filepath.Ext(header.Filename)); t != "" {
+			contentType = t
+		} else {
+			contentType = http.DetectContentType(data)
+		}
+	}
+	inline, _ := strconv.ParseBool(r.FormValue("inline"))
+
+	st := requestStores(r)
+	a, err := st.storeAttachment(mail.DraftID, requestUser(r), MIMEAttachment{
+		Filename:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		ContentID:   r.FormValue("content_id"),
+		Inline:      inline,
+		Data:        data,
+	})
+	if err != nil {
+		internalError(w, r, "Failed to store attachment", err)
+		return
+	}
+
+	// check the total again, in case another upload got in meanwhile
+	_, err = updateDraft(st.Drafts, mail.DraftID, func(mail *Email) error {
+		if attachmentsSize(mail)+a.Size > maxDraftAttachmentSize {
+			return errAttachmentsTooLarge
+		}
+		mail.Attachments = append(mail.Attachments, *a)
+		mail.Approval.Approvals = []Approval{}
+		return nil
+	})
+	if err != nil {
+		st.removeAttachmentFiles([]Attachment{*a})
+		if err == errAttachmentsTooLarge {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeTooLarge, "Attachments on a draft can be at most %d bytes in total", maxDraftAttachmentSize)
+			return
+		}
+		internalError(w, r, "Failed to add attachment", err)
+		return
+	}
+
+	st.queueSync(mail.DraftID)
+	publishDraftEvent(draftEvent{
+		Type:       eventAttachmentAdded,
+		DraftID:    mail.DraftID,
+		User:       a.UploadedBy,
+		Attachment: a,
+	})
+
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// removeAttachment takes an attachment off a draft and deletes its data
+func removeAttachment(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+	a := findAttachment(mail, p.ByName(attachmentIDParam))
+	if a == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Draft %s has no attachment %s", mail.DraftID, p.ByName(attachmentIDParam))
+		return
+	}
+
+	st := requestStores(r)
+	_, err := updateDraft(st.Drafts, mail.DraftID, func(mail *Email) error {
+		kept := mail.Attachments[:0]
+		for _, other := range mail.Attachments {
+			if other.ID != a.ID {
+				kept = append(kept, other)
+			}
+		}
+		mail.Attachments = kept
+		mail.Approval.Approvals = []Approval{}
+		return nil
+	})
+	if err != nil {
+		internalError(w, r, "Failed to remove attachment "+a.ID, err)
+		return
+	}
+	st.removeAttachmentFiles([]Attachment{*a})
+
+	st.queueSync(mail.DraftID)
+	publishDraftEvent(draftEvent{
+		Type:       eventAttachmentRemoved,
+		DraftID:    mail.DraftID,
+		User:       requestUser(r),
+		Attachment: a,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
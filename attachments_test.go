@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// upload adds a file to a draft, decoding the response into out if given,
+// and returns the status
+func (c *testClient) upload(draftID, filename string, data []byte, out interface{}) int {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req, err := http.NewRequest("POST", c.ts.server.URL+apiPrefix+"/draft/id/"+draftID+"/attachments", &body)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(csrfHeader, c.csrf)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+// download fetches the data of an attachment
+func (c *testClient) download(draftID, id string) (*http.Response, []byte) {
+	resp, err := c.http.Get(c.ts.server.URL + apiPrefix + "/draft/id/" + draftID + "/attachments/" + id)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestAttachmentUploadDownloadRemove(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	var a Attachment
+	if status := owner.upload(draftID, "notes.txt", []byte("bring snacks"), &a); status != http.StatusCreated {
+		t.Fatalf("upload = %d", status)
+	}
+	if a.Size != int64(len("bring snacks")) || a.UploadedBy != "owner@example.com" {
+		t.Fatalf("attachment = %+v", a)
+	}
+
+	resp, data := owner.download(draftID, a.ID)
+	if resp.StatusCode != http.StatusOK || string(data) != "bring snacks" {
+		t.Fatalf("download = %d %q", resp.StatusCode, data)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment") {
+		t.Fatalf("download disposition = %q", disposition)
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("download headers = %v", resp.Header)
+	}
+
+	// the synced Gmail draft carries it
+	ts.syncQueued()
+	raw, _ := ts.fake.Draft(draftID)
+	if !bytes.Contains(raw, []byte("notes.txt")) {
+		t.Fatalf("Gmail draft without the attachment:\n%s", raw)
+	}
+
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/attachments/"+a.ID+"/remove", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("remove = %d", status)
+	}
+	if resp, _ := owner.download(draftID, a.ID); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("download after removing = %d, want 404", resp.StatusCode)
+	}
+	if _, err := ts.stores.Blobs.Open(a.ID); err == nil {
+		t.Fatal("data of a removed attachment is still kept")
+	}
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	defer func(file, draft int64) { maxAttachmentSize, maxDraftAttachmentSize = file, draft }(maxAttachmentSize, maxDraftAttachmentSize)
+	maxAttachmentSize, maxDraftAttachmentSize = 10, 16
+
+	// the uploads go one after the other onto the same draft
+	for _, c := range []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{"at the file limit", 10, http.StatusCreated},
+		{"over the file limit", 11, http.StatusRequestEntityTooLarge},
+		{"up to the draft limit", 6, http.StatusCreated},
+		{"over the draft limit", 1, http.StatusRequestEntityTooLarge},
+		{"empty", 0, http.StatusCreated},
+	} {
+		var e errorEnvelope
+		status := owner.upload(draftID, c.name+".txt", bytes.Repeat([]byte("x"), c.size), &e)
+		if status != c.status {
+			t.Errorf("%s: upload = %d, want %d", c.name, status, c.status)
+		}
+		if status == http.StatusRequestEntityTooLarge && e.Error.Code != codeTooLarge {
+			t.Errorf("%s: error = %+v", c.name, e)
+		}
+	}
+
+	var attachments []Attachment
+	if status := owner.do("GET", apiPrefix+"/draft/id/"+draftID+"/attachments", nil, &attachments); status != http.StatusOK {
+		t.Fatalf("list = %d", status)
+	}
+	if len(attachments) != 3 || attachmentsSize(&Email{Attachments: attachments}) != 16 {
+		t.Fatalf("attachments = %+v", attachments)
+	}
+}
+
+func TestAttachmentDownload(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	if err := ts.stores.setMemberRole(draftID, "bob@example.com", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	bob := ts.clientFor("u2", "bob@example.com")
+	carol := ts.clientFor("u3", "carol@example.com")
+
+	png := []byte("\x89PNG\r\n\x1a\n")
+	var image, notes Attachment
+	if status := owner.upload(draftID, "photo.png", png, &image); status != http.StatusCreated {
+		t.Fatalf("upload = %d", status)
+	}
+	if status := owner.upload(draftID, "notes", []byte("<html>bring snacks"), &notes); status != http.StatusCreated {
+		t.Fatalf("upload = %d", status)
+	}
+	if status := bob.upload(draftID, "bob.txt", []byte("hi"), nil); status != http.StatusForbidden {
+		t.Fatalf("upload by a viewer = %d, want 403", status)
+	}
+
+	for _, c := range []struct {
+		name        string
+		client      *testClient
+		id          string
+		status      int
+		contentType string
+		data        []byte
+	}{
+		{"typed by extension", owner, image.ID, http.StatusOK, "image/png", png},
+		{"typed by content", bob, notes.ID, http.StatusOK, "text/html; charset=utf-8", []byte("<html>bring snacks")},
+		{"not on the draft", carol, image.ID, http.StatusForbidden, "", nil},
+		{"missing", owner, "5a0000000000000000000000", http.StatusNotFound, "", nil},
+	} {
+		resp, data := c.client.download(draftID, c.id)
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: download = %d, want %d", c.name, resp.StatusCode, c.status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		if resp.Header.Get("Content-Type") != c.contentType || !bytes.Equal(data, c.data) {
+			t.Errorf("%s: download = %q %q", c.name, resp.Header.Get("Content-Type"), data)
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment;") {
+			t.Errorf("%s: download headers = %v", c.name, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BlobStore keeps the data of attachments, which would soon outgrow a draft
+// document. Missing data is reported as mgo.ErrNotFound by every
+// implementation.
+type BlobStore interface {
+	// Put stores data for a draft and returns the ID it is kept under
+	Put(draftID, filename, contentType string, data []byte) (string, error)
+
+	// Open returns the data kept under id, to be closed once read
+	Open(id string) (Blob, error)
+
+	Remove(id string) error
+}
+
+// Blob is stored data being read.
+type Blob interface {
+	Read(p []byte) (int, error)
+	Close() error
+	Size() int64
+}
+
+// mongoBlobStore keeps data in GridFS, under attachmentPrefix.
+type mongoBlobStore struct {
+	gfs *mgo.GridFS
+}
+
+func newMongoBlobStore(db *mgo.Database) *mongoBlobStore {
+	return &mongoBlobStore{gfs: db.GridFS(attachmentPrefix)}
+}
+
+func (s *mongoBlobStore) ensureIndexes() error {
+	// GridFS reads chunks in order by file, which is a collection scan
+	// without this
+	return s.gfs.Chunks.EnsureIndex(mgo.Index{
+		Key:    []string{"files_id", "n"},
+		Unique: true,
+	})
+}
+
+func (s *mongoBlobStore) Put(draftID, filename, contentType string, data []byte) (string, error) {
+	file, err := s.gfs.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	id := bson.NewObjectId()
+	file.SetId(id)
+	file.SetContentType(contentType)
+	file.SetMeta(bson.M{"draft_id": draftID})
+	_, err = file.Write(data)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return "", err
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+	return id.Hex(), nil
+}
+
+func (s *mongoBlobStore) Open(id string) (Blob, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
+	file, err := s.gfs.OpenId(bson.ObjectIdHex(id))
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *mongoBlobStore) Remove(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+	return s.gfs.RemoveId(bson.ObjectIdHex(id))
+}
+
+// memoryBlobStore keeps data in this process, for tests.
+type memoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memoryBlobStore) Put(draftID, filename, contentType string, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := bson.NewObjectId().Hex()
+	s.blobs[id] = append([]byte(nil), data...)
+	return id, nil
+}
+
+func (s *memoryBlobStore) Open(id string) (Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[id]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return memoryBlob{bytes.NewReader(data)}, nil
+}
+
+func (s *memoryBlobStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[id]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(s.blobs, id)
+	return nil
+}
+
+// memoryBlob reads data kept by memoryBlobStore, whose Size is that of the
+// whole data.
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (memoryBlob) Close() error { return nil }
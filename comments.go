@@ -0,0 +1,322 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	commentCollection = "comments"
+	commentIDParam    = "comment_id_param"
+
+	suggestionPending  = "pending"
+	suggestionAccepted = "accepted"
+	suggestionRejected = "rejected"
+)
+
+// Anchor is a range of characters in a draft as it was at Revision.
+type Anchor struct {
+	Revision int `bson:"revision" json:"revision"`
+	Start    int `bson:"start" json:"start"`
+	End      int `bson:"end" json:"end"`
+}
+
+// Comment is a thread of feedback anchored to a range of a draft. A comment
+// with a Suggestion proposes replacing the range with that text.
+type Comment struct {
+	ID         bson.ObjectId `bson:"_id" json:"id"`
+	DraftID    string        `bson:"draft_id" json:"draft_id"`
+	Author     string        `bson:"author" json:"author"`
+	Body       string        `bson:"body" json:"body"`
+	Anchor     Anchor        `bson:"anchor" json:"anchor"`
+	Quote      string        `bson:"quote" json:"quote"`
+	Replies    []Reply       `bson:"replies" json:"replies"`
+	Resolved   bool          `bson:"resolved" json:"resolved"`
+	ResolvedBy string        `bson:"resolved_by,omitempty" json:"resolved_by,omitempty"`
+	CreatedAt  time.Time     `bson:"created_at" json:"created_at"`
+
+	Suggestion       *string `bson:"suggestion,omitempty" json:"suggestion,omitempty"`
+	SuggestionStatus string  `bson:"suggestion_status,omitempty" json:"suggestion_status,omitempty"`
+	AcceptedRevision int     `bson:"accepted_revision,omitempty" json:"accepted_revision,omitempty"`
+}
+
+// Reply is an answer in a comment thread.
+type Reply struct {
+	Author    string    `bson:"author" json:"author"`
+	Body      string    `bson:"body" json:"body"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+type commentRequest struct {
+	Anchor     Anchor  `json:"anchor"`
+	Body       string  `json:"body"`
+	Suggestion *string `json:"suggestion,omitempty"`
+}
+
+type replyRequest struct {
+	Body string `json:"body"`
+}
+
+// currentAnchor maps an anchor through every Edit made since it was placed,
+// so it keeps pointing at the same text in the current revision.
+func currentAnchor(mail *Email, a Anchor) Anchor {
+	for _, e := range mail.Edits {
+		if e.Revision > a.Revision {
+			a.Start = transformPos(a.Start, e.Ops, false)
+			a.End = transformPos(a.End, e.Ops, true)
+			if a.End < a.Start {
+				a.End = a.Start
+			}
+		}
+	}
+	a.Revision = mail.Revision
+	return a
+}
+
+// requireComment wraps a comment handler, loading the comment named by the
+// route after requireRole has checked access to its draft.
+func requireComment(role string, h func(http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
+	return requireRole(role, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		mail := requestDraft(r)
+		id := p.ByName(commentIDParam)
+		if !bson.IsObjectIdHex(id) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "No comment with id %s", id)
+			return
+		}
+
+		comment, err := requestStores(r).Comments.Get(mail.DraftID, bson.ObjectIdHex(id))
+		if err == mgo.ErrNotFound {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "No comment with id %s", id)
+			return
+		} else if err != nil {
+			internalError(w, r, "Failed to load comment", err)
+			return
+		}
+
+		comment.Anchor = currentAnchor(mail, comment.Anchor)
+		context.Set(r, commentContextKey, comment)
+		h(w, r, p)
+	})
+}
+
+// requestComment returns the comment loaded by requireComment
+func requestComment(r *http.Request) *Comment {
+	return context.Get(r, commentContextKey).(*Comment)
+}
+
+// writeComment sends a comment back to the client
+func writeComment(w http.ResponseWriter, status int, comment *Comment) {
+	writeJSON(w, status, comment)
+}
+
+// listComments returns the comments of a draft with their anchors mapped to
+// the current revision
+func listComments(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	comments, err := requestStores(r).Comments.List(mail.DraftID)
+	if err != nil {
+		internalError(w, r, "Failed to list comments", err)
+		return
+	}
+	for i := range comments {
+		comments[i].Anchor = currentAnchor(mail, comments[i].Anchor)
+	}
+
+	writeJSON(w, http.StatusOK, comments)
+}
+
+// newComment anchors a comment, or a suggested edit, to a range of a draft
+func newComment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	var req commentRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" && req.Suggestion == nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "A comment needs a body or a suggestion")
+		return
+	}
+
+	// anchor against the revision the client saw, then bring it up to date
+	if req.Anchor.Revision == 0 {
+		req.Anchor.Revision = mail.Revision
+	}
+	body, _ := mail.textField(fieldBody)
+	at, err := findRevision(body, req.Anchor.Revision)
+	if err != nil {
+		internalError(w, r, "Failed to rebuild draft revision", err)
+		return
+	} else if at == nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Draft %s has no revision %d", mail.DraftID, req.Anchor.Revision)
+		return
+	}
+	text := []rune(at.Content)
+	if req.Anchor.Start < 0 || req.Anchor.Start > req.Anchor.End || req.Anchor.End > len(text) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Anchor %d-%d is outside of revision %d", req.Anchor.Start, req.Anchor.End, at.Revision)
+		return
+	}
+
+	comment := Comment{
+		ID:        bson.NewObjectId(),
+		DraftID:   mail.DraftID,
+		Author:    requestUser(r),
+		Body:      req.Body,
+		Anchor:    currentAnchor(mail, req.Anchor),
+		Quote:     string(text[req.Anchor.Start:req.Anchor.End]),
+		Replies:   []Reply{},
+		CreatedAt: time.Now(),
+	}
+	if req.Suggestion != nil {
+		comment.Suggestion = req.Suggestion
+		comment.SuggestionStatus = suggestionPending
+	}
+
+	err = requestStores(r).Comments.Insert(&comment)
+	if err != nil {
+		internalError(w, r, "Failed to store comment", err)
+		return
+	}
+	writeComment(w, http.StatusCreated, &comment)
+}
+
+// replyToComment adds a reply to a comment thread
+func replyToComment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	comment := requestComment(r)
+
+	var req replyRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "A reply needs a body")
+		return
+	}
+
+	reply := Reply{Author: requestUser(r), Body: req.Body, CreatedAt: time.Now()}
+	err := requestStores(r).Comments.AddReply(comment.ID, reply)
+	if err != nil {
+		internalError(w, r, "Failed to store reply", err)
+		return
+	}
+
+	comment.Replies = append(comment.Replies, reply)
+	writeComment(w, http.StatusOK, comment)
+}
+
+// resolveComment marks a comment thread as resolved
+func resolveComment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	setResolved(w, r, true)
+}
+
+// unresolveComment reopens a resolved comment thread
+func unresolveComment(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	setResolved(w, r, false)
+}
+
+func setResolved(w http.ResponseWriter, r *http.Request, resolved bool) {
+	comment := requestComment(r)
+	user := requestUser(r)
+
+	resolvedBy := user
+	if !resolved {
+		resolvedBy = ""
+	}
+	err := requestStores(r).Comments.SetResolved(comment.ID, resolved, resolvedBy)
+	if err != nil {
+		internalError(w, r, "Failed to update comment", err)
+		return
+	}
+
+	comment.Resolved = resolved
+	comment.ResolvedBy = resolvedBy
+	writeComment(w, http.StatusOK, comment)
+}
+
+// acceptSuggestion applies a suggested edit to the draft as a new Edit by the
+// suggestion's author and resolves the comment
+func acceptSuggestion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	comment := requestComment(r)
+	if !claimSuggestion(w, r, comment, suggestionAccepted) {
+		return
+	}
+
+	a := comment.Anchor
+	var ops []Op
+	if a.End > a.Start {
+		ops = append(ops, Op{Type: opDelete, Pos: a.Start, Count: a.End - a.Start})
+	}
+	if *comment.Suggestion != "" {
+		ops = append(ops, Op{Type: opInsert, Pos: a.Start, Text: *comment.Suggestion})
+	}
+
+	st := requestStores(r)
+	edit, err := st.acceptEdit(mail.DraftID, fieldBody, Edit{
+		Editor:       comment.Author,
+		BaseRevision: a.Revision,
+		Ops:          ops,
+	})
+	if err != nil {
+		// give the suggestion back so it can be tried again
+		uerr := st.Comments.SetSuggestionStatus(comment.ID, suggestionAccepted, suggestionPending)
+		if uerr != nil {
+			log.Printf("failed to reopen suggestion %s => {%s}", comment.ID.Hex(), uerr)
+		}
+		writeError(w, r, http.StatusConflict, codeConflict, "Failed to apply suggestion => {%s}", err)
+		return
+	}
+
+	finishSuggestion(w, r, comment, suggestionAccepted, edit.Revision)
+}
+
+// rejectSuggestion turns down a suggested edit and resolves the comment
+func rejectSuggestion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	comment := requestComment(r)
+	if !claimSuggestion(w, r, comment, suggestionRejected) {
+		return
+	}
+	finishSuggestion(w, r, comment, suggestionRejected, 0)
+}
+
+// claimSuggestion moves a pending suggestion to status, making sure only one
+// request gets to answer it
+func claimSuggestion(w http.ResponseWriter, r *http.Request, comment *Comment, status string) bool {
+	if comment.Suggestion == nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Comment %s is not a suggestion", comment.ID.Hex())
+		return false
+	}
+
+	err := requestStores(r).Comments.SetSuggestionStatus(comment.ID, suggestionPending, status)
+	if err == mgo.ErrNotFound {
+		writeError(w, r, http.StatusConflict, codeConflict, "Suggestion was already answered")
+		return false
+	} else if err != nil {
+		internalError(w, r, "Failed to update comment", err)
+		return false
+	}
+	return true
+}
+
+func finishSuggestion(w http.ResponseWriter, r *http.Request, comment *Comment, status string, revision int) {
+	user := requestUser(r)
+	err := requestStores(r).Comments.FinishSuggestion(comment.ID, status, revision, user)
+	if err != nil {
+		internalError(w, r, "Failed to update comment", err)
+		return
+	}
+
+	comment.SuggestionStatus = status
+	comment.AcceptedRevision = revision
+	comment.Resolved = true
+	comment.ResolvedBy = user
+	writeComment(w, http.StatusOK, comment)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// getDraft fetches a draft as the client sees it
+func (c *testClient) getDraft(draftID string) draftResource {
+	var draft draftResource
+	if status := c.do("GET", apiPrefix+"/draft/id/"+draftID, nil, &draft); status != http.StatusOK {
+		c.ts.t.Fatalf("get %s = %d", draftID, status)
+	}
+	return draft
+}
+
+func TestCommentThread(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID + "/comments"
+
+	var comment Comment
+	req := commentRequest{Anchor: Anchor{Start: 4, End: 7}, Body: "Which day?"}
+	if status := owner.do("POST", path, req, &comment); status != http.StatusCreated {
+		t.Fatalf("comment = %d", status)
+	}
+	if comment.Quote != "you" {
+		t.Fatalf("quote = %q, want %q", comment.Quote, "you")
+	}
+	if status := owner.do("POST", path+"/"+comment.ID.Hex()+"/reply", replyRequest{Body: "Friday"}, nil); status != http.StatusOK {
+		t.Fatalf("reply = %d", status)
+	}
+	if status := owner.do("POST", path+"/"+comment.ID.Hex()+"/resolve", nil, nil); status != http.StatusOK {
+		t.Fatalf("resolve = %d", status)
+	}
+
+	var comments []Comment
+	if status := owner.do("GET", path, nil, &comments); status != http.StatusOK {
+		t.Fatalf("list = %d", status)
+	}
+	if len(comments) != 1 || len(comments[0].Replies) != 1 || !comments[0].Resolved || comments[0].ResolvedBy != "owner@example.com" {
+		t.Fatalf("comments = %+v", comments)
+	}
+
+	// deleting the draft takes its comments along
+	if status := owner.do("DELETE", apiPrefix+"/draft/id/"+draftID, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete = %d", status)
+	}
+	if left, _ := ts.stores.Comments.List(draftID); len(left) != 0 {
+		t.Fatalf("comments left after delete = %d", len(left))
+	}
+}
+
+func TestAcceptSuggestion(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID + "/comments"
+
+	suggestion := "1pm"
+	var comment Comment
+	req := commentRequest{Anchor: Anchor{Start: 11, End: 15}, Suggestion: &suggestion}
+	if status := owner.do("POST", path, req, &comment); status != http.StatusCreated {
+		t.Fatalf("suggest = %d", status)
+	}
+	if status := owner.do("POST", path+"/"+comment.ID.Hex()+"/accept", nil, &comment); status != http.StatusOK {
+		t.Fatalf("accept = %d", status)
+	}
+	if comment.SuggestionStatus != suggestionAccepted || !comment.Resolved {
+		t.Fatalf("accepted suggestion = %+v", comment)
+	}
+	if body := owner.getDraft(draftID).Body.Content; body != "See you at 1pm" {
+		t.Fatalf("body after accepting = %q", body)
+	}
+
+	if status := owner.do("POST", path+"/"+comment.ID.Hex()+"/reject", nil, nil); status != http.StatusConflict {
+		t.Fatalf("rejecting an accepted suggestion = %d, want 409", status)
+	}
+}
+
+func TestCurrentAnchor(t *testing.T) {
+	// "See you at noon", then "Hi! " put in front, then "you " taken out
+	mail := &Email{
+		Revision: 3,
+		Edits: []Edit{
+			{Revision: 1},
+			{Revision: 2, Ops: []Op{ins(0, "Hi! ")}},
+			{Revision: 3, Ops: []Op{del(8, 4)}},
+		},
+	}
+	for _, c := range []struct {
+		name   string
+		anchor Anchor
+		want   Anchor
+	}{
+		{"before the edits", Anchor{Revision: 1, Start: 11, End: 15}, Anchor{Revision: 3, Start: 11, End: 15}},
+		{"insert at the start", Anchor{Revision: 1, Start: 0, End: 3}, Anchor{Revision: 3, Start: 4, End: 7}},
+		{"range deleted", Anchor{Revision: 1, Start: 4, End: 7}, Anchor{Revision: 3, Start: 8, End: 8}},
+		{"range cut short", Anchor{Revision: 2, Start: 10, End: 19}, Anchor{Revision: 3, Start: 8, End: 15}},
+		{"empty range", Anchor{Revision: 2, Start: 4, End: 4}, Anchor{Revision: 3, Start: 4, End: 4}},
+		{"already current", Anchor{Revision: 3, Start: 2, End: 5}, Anchor{Revision: 3, Start: 2, End: 5}},
+	} {
+		if got := currentAnchor(mail, c.anchor); got != c.want {
+			t.Errorf("%s: %+v moved to %+v, want %+v", c.name, c.anchor, got, c.want)
+		}
+	}
+}
+
+func TestAnswerSuggestion(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// edit is made to "See you at noon" after suggesting "1pm" for
+		// "noon"
+		edit       []Op
+		answer     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"accepted", nil, "accept", http.StatusOK, "See you at 1pm"},
+		{"accepted after the text moved", []Op{ins(0, "Hi! ")}, "accept", http.StatusOK, "Hi! See you at 1pm"},
+		{"accepted after the range was deleted", []Op{del(10, 5)}, "accept", http.StatusOK, "See you at1pm"},
+		{"rejected", []Op{ins(0, "Hi! ")}, "reject", http.StatusOK, "Hi! See you at noon"},
+	} {
+		ts := newTestServer(t)
+		owner := ts.signIn()
+		draftID := owner.shareDraft()
+		path := apiPrefix + "/draft/id/" + draftID
+
+		suggestion := "1pm"
+		var comment Comment
+		req := commentRequest{Anchor: Anchor{Start: 11, End: 15}, Suggestion: &suggestion}
+		if status := owner.do("POST", path+"/comments", req, &comment); status != http.StatusCreated {
+			t.Fatalf("%s: suggest = %d", c.name, status)
+		}
+		if c.edit != nil {
+			if status := owner.do("POST", path, editRequest{BaseRevision: 1, Ops: c.edit}, nil); status != http.StatusOK {
+				t.Fatalf("%s: edit = %d", c.name, status)
+			}
+		}
+
+		answer := path + "/comments/" + comment.ID.Hex() + "/" + c.answer
+		var answered Comment
+		if status := owner.do("POST", answer, nil, &answered); status != c.wantStatus {
+			t.Errorf("%s: %s = %d, want %d", c.name, c.answer, status, c.wantStatus)
+		}
+		if want := c.answer + "ed"; answered.SuggestionStatus != want || !answered.Resolved {
+			t.Errorf("%s: answered suggestion = %+v", c.name, answered)
+		}
+		if body := owner.getDraft(draftID).Body.Content; body != c.wantBody {
+			t.Errorf("%s: body = %q, want %q", c.name, body, c.wantBody)
+		}
+
+		// a suggestion is answered once
+		for _, again := range []string{"accept", "reject"} {
+			if status := owner.do("POST", path+"/comments/"+comment.ID.Hex()+"/"+again, nil, nil); status != http.StatusConflict {
+				t.Errorf("%s: %s after %s = %d, want 409", c.name, again, c.answer, status)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestAnswerPlainComment(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID + "/comments"
+
+	var comment Comment
+	if status := owner.do("POST", path, commentRequest{Anchor: Anchor{Start: 4, End: 7}, Body: "Which day?"}, &comment); status != http.StatusCreated {
+		t.Fatalf("comment = %d", status)
+	}
+	for _, answer := range []string{"accept", "reject"} {
+		if status := owner.do("POST", path+"/"+comment.ID.Hex()+"/"+answer, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("%s of a plain comment = %d, want 400", answer, status)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CommentStore keeps the comment threads of drafts. Missing comments are
+// reported as mgo.ErrNotFound by every implementation.
+type CommentStore interface {
+	// Get returns a comment on a draft
+	Get(draftID string, id bson.ObjectId) (*Comment, error)
+
+	// List returns the comments on a draft, oldest first
+	List(draftID string) ([]Comment, error)
+
+	Insert(c *Comment) error
+	AddReply(id bson.ObjectId, reply Reply) error
+
+	// SetResolved resolves or reopens a comment, by is who resolved it
+	SetResolved(id bson.ObjectId, resolved bool, by string) error
+
+	// SetSuggestionStatus moves the suggestion of a comment from one status
+	// to another. It reports mgo.ErrNotFound if the suggestion isn't at from
+	// anymore, so only one request gets to answer it.
+	SetSuggestionStatus(id bson.ObjectId, from, to string) error
+
+	// FinishSuggestion records the answer to a suggestion and resolves its
+	// comment
+	FinishSuggestion(id bson.ObjectId, status string, revision int, by string) error
+
+	// DraftsMatching returns the drafts with comments containing one of
+	// terms, and Search those comments on the drafts in draftIDs
+	DraftsMatching(terms []string) ([]string, error)
+	Search(terms, draftIDs []string) ([]Comment, error)
+
+	DeleteByDraft(draftID string) error
+}
+
+// mongoCommentStore keeps comments in the comments collection.
+type mongoCommentStore struct {
+	c *mgo.Collection
+}
+
+func newMongoCommentStore(db *mgo.Database) *mongoCommentStore {
+	return &mongoCommentStore{c: db.C(commentCollection)}
+}
+
+// ensureIndexes indexes comments by draft and by the text they are searched
+// by
+func (s *mongoCommentStore) ensureIndexes() error {
+	err := s.c.EnsureIndexKey("draft_id", "created_at")
+	if err != nil {
+		return err
+	}
+	return s.c.EnsureIndex(mgo.Index{
+		Key:  []string{"$text:body", "$text:suggestion", "$text:replies.body"},
+		Name: "comment_text",
+	})
+}
+
+func (s *mongoCommentStore) Get(draftID string, id bson.ObjectId) (*Comment, error) {
+	var c Comment
+	err := s.c.Find(bson.M{"_id": id, "draft_id": draftID}).One(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *mongoCommentStore) List(draftID string) ([]Comment, error) {
+	comments := []Comment{}
+	err := s.c.Find(bson.M{"draft_id": draftID}).Sort("created_at").All(&comments)
+	return comments, err
+}
+
+func (s *mongoCommentStore) Insert(c *Comment) error {
+	return s.c.Insert(c)
+}
+
+func (s *mongoCommentStore) AddReply(id bson.ObjectId, reply Reply) error {
+	return s.c.UpdateId(id, bson.M{"$push": bson.M{"replies": &reply}})
+}
+
+func (s *mongoCommentStore) SetResolved(id bson.ObjectId, resolved bool, by string) error {
+	return s.c.UpdateId(id, bson.M{"$set": bson.M{"resolved": resolved, "resolved_by": by}})
+}
+
+func (s *mongoCommentStore) SetSuggestionStatus(id bson.ObjectId, from, to string) error {
+	return s.c.Update(
+		bson.M{"_id": id, "suggestion_status": from},
+		bson.M{"$set": bson.M{"suggestion_status": to}})
+}
+
+func (s *mongoCommentStore) FinishSuggestion(id bson.ObjectId, status string, revision int, by string) error {
+	return s.c.UpdateId(id, bson.M{"$set": bson.M{
+		"suggestion_status": status,
+		"accepted_revision": revision,
+		"resolved":          true,
+		"resolved_by":       by,
+	}})
+}
+
+func (s *mongoCommentStore) DraftsMatching(terms []string) ([]string, error) {
+	var draftIDs []string
+	err := s.c.Find(bson.M{"$text": textSearch(terms)}).Distinct("draft_id", &draftIDs)
+	return draftIDs, err
+}
+
+func (s *mongoCommentStore) Search(terms, draftIDs []string) ([]Comment, error) {
+	var comments []Comment
+	err := s.c.Find(bson.M{
+		"$text":    textSearch(terms),
+		"draft_id": bson.M{"$in": draftIDs},
+	}).All(&comments)
+	return comments, err
+}
+
+func (s *mongoCommentStore) DeleteByDraft(draftID string) error {
+	_, err := s.c.RemoveAll(bson.M{"draft_id": draftID})
+	return err
+}
+
+// textSearch is the $text operator searching for terms
+func textSearch(terms []string) bson.M {
+	return bson.M{"$search": strings.Join(terms, " ")}
+}
+
+// memoryCommentStore keeps comments in this process, for tests. They are
+// kept bson encoded, like memoryDraftStore does, so callers never share one.
+type memoryCommentStore struct {
+	mu       sync.Mutex
+	comments map[bson.ObjectId][]byte
+}
+
+func newMemoryCommentStore() *memoryCommentStore {
+	return &memoryCommentStore{comments: make(map[bson.ObjectId][]byte)}
+}
+
+func (s *memoryCommentStore) load(id bson.ObjectId) (*Comment, error) {
+	data, ok := s.comments[id]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	var c Comment
+	err := bson.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *memoryCommentStore) store(c *Comment) error {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return err
+	}
+	s.comments[c.ID] = data
+	return nil
+}
+
+// update loads a comment, lets change modify it and stores it
+func (s *memoryCommentStore) update(id bson.ObjectId, change func(c *Comment) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(id)
+	if err != nil {
+		return err
+	}
+	err = change(c)
+	if err != nil {
+		return err
+	}
+	return s.store(c)
+}
+
+// all returns the comments keep returns true for, oldest first
+func (s *memoryCommentStore) all(keep func(c *Comment) bool) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	comments := []Comment{}
+	for id := range s.comments {
+		c, err := s.load(id)
+		if err != nil {
+			return nil, err
+		}
+		if keep(c) {
+			comments = append(comments, *c)
+		}
+	}
+	sort.Sort(byCreation(comments))
+	return comments, nil
+}
+
+func (s *memoryCommentStore) Get(draftID string, id bson.ObjectId) (*Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.DraftID != draftID {
+		return nil, mgo.ErrNotFound
+	}
+	return c, nil
+}
+
+func (s *memoryCommentStore) List(draftID string) ([]Comment, error) {
+	return s.all(func(c *Comment) bool { return c.DraftID == draftID })
+}
+
+func (s *memoryCommentStore) Insert(c *Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(c)
+}
+
+func (s *memoryCommentStore) AddReply(id bson.ObjectId, reply Reply) error {
+	return s.update(id, func(c *Comment) error {
+		c.Replies = append(c.Replies, reply)
+		return nil
+	})
+}
+
+func (s *memoryCommentStore) SetResolved(id bson.ObjectId, resolved bool, by string) error {
+	return s.update(id, func(c *Comment) error {
+		c.Resolved, c.ResolvedBy = resolved, by
+		return nil
+	})
+}
+
+func (s *memoryCommentStore) SetSuggestionStatus(id bson.ObjectId, from, to string) error {
+	return s.update(id, func(c *Comment) error {
+		if c.SuggestionStatus != from {
+			return mgo.ErrNotFound
+		}
+		c.SuggestionStatus = to
+		return nil
+	})
+}
+
+func (s *memoryCommentStore) FinishSuggestion(id bson.ObjectId, status string, revision int, by string) error {
+	return s.update(id, func(c *Comment) error {
+		c.SuggestionStatus = status
+		c.AcceptedRevision = revision
+		c.Resolved, c.ResolvedBy = true, by
+		return nil
+	})
+}
+
+// matchesTerms tells whether the text of c has a word starting with one of
+// terms, standing in for Mongo's text search
+func matchesTerms(c *Comment, terms []string) bool {
+	for _, t := range commentTexts(c) {
+		if len(matchWords([]rune(t.text), terms)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryCommentStore) DraftsMatching(terms []string) ([]string, error) {
+	comments, err := s.all(func(c *Comment) bool { return matchesTerms(c, terms) })
+	if err != nil {
+		return nil, err
+	}
+	draftIDs := []string{}
+	for _, c := range comments {
+		if !containsString(draftIDs, c.DraftID) {
+			draftIDs = append(draftIDs, c.DraftID)
+		}
+	}
+	return draftIDs, nil
+}
+
+func (s *memoryCommentStore) Search(terms, draftIDs []string) ([]Comment, error) {
+	return s.all(func(c *Comment) bool {
+		return containsString(draftIDs, c.DraftID) && matchesTerms(c, terms)
+	})
+}
+
+func (s *memoryCommentStore) DeleteByDraft(draftID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.comments {
+		c, err := s.load(id)
+		if err != nil {
+			return err
+		}
+		if c.DraftID == draftID {
+			delete(s.comments, id)
+		}
+	}
+	return nil
+}
+
+// byCreation sorts comments oldest first.
+type byCreation []Comment
+
+func (s byCreation) Len() int           { return len(s) }
+func (s byCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreation) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
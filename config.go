@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minSessionKeyLength is the shortest session key accepted, so keys can't be
+// guessed
+const minSessionKeyLength = 32
+
+// Config is everything the server can be configured with. It is read by
+// loadConfig from an optional JSON file and the environment, the environment
+// winning, and handed to newServer.
+type Config struct {
+	Port    string
+	BaseURL string
+
+	// SessionKeys sign and encrypt the session cookies. The first one is
+	// used for new cookies and the others are still accepted, so keys can be
+	// rotated by putting a new one in front.
+	SessionKeys []string
+
+	GoogleClientID     string
+	GoogleClientSecret string
+
+	MongoURI      string
+	MongoDatabase string
+	MongoTimeout  time.Duration
+
+	// AllowedOrigins may call the API from a browser, such as
+	// https://mail.google.com or chrome-extension://<id>
+	AllowedOrigins []string
+
+	GmailPushToken string
+	GmailBasePath  string
+
+	AttachmentMaxSize      int64
+	DraftAttachmentMaxSize int64
+
+	// ReadTimeout and WriteTimeout limit how long reading a request and
+	// writing its response may take. WriteTimeout is off by default since
+	// draft streams stay open.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// LegacyCookieCutoff is when the last cookies from before sessions were
+	// kept server side expire. None is accepted after it.
+	LegacyCookieCutoff time.Time
+}
+
+// configError lists everything wrong with a configuration at once.
+type configError []string
+
+func (e configError) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// setting is one configuration value, named as in the environment. In a
+// config file the same names are used in lower case.
+type setting struct {
+	name  string
+	parse func(v string) error
+}
+
+// defaultConfig is the configuration before any file or environment is read
+func defaultConfig() *Config {
+	return &Config{
+		MongoURI:               "localhost:27017",
+		MongoDatabase:          "blendr",
+		MongoTimeout:           10 * time.Second,
+		AllowedOrigins:         []string{"https://mail.google.com"},
+		AttachmentMaxSize:      maxAttachmentSize,
+		DraftAttachmentMaxSize: maxDraftAttachmentSize,
+		ReadTimeout:            30 * time.Second,
+		// sessionTTL after sessions moved server side
+		LegacyCookieCutoff: time.Date(2026, time.November, 17, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// settings lists what can be configured and how each value is read into cfg
+func (cfg *Config) settings() []setting {
+	str := func(name string, dst *string) setting {
+		return setting{name, func(v string) error { *dst = v; return nil }}
+	}
+	list := func(name string, dst *[]string) setting {
+		return setting{name, func(v string) error {
+			*dst = nil
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					*dst = append(*dst, s)
+				}
+			}
+			return nil
+		}}
+	}
+	size := func(name string, dst *int64) setting {
+		return setting{name, func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("must be a positive number of bytes, got %q", v)
+			}
+			*dst = n
+			return nil
+		}}
+	}
+	duration := func(name string, dst *time.Duration) setting {
+		return setting{name, func(v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("must be a duration such as 30s, got %q", v)
+			}
+			*dst = d
+			return nil
+		}}
+	}
+	instant := func(name string, dst *time.Time) setting {
+		return setting{name, func(v string) error {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("must be a time such as 2026-11-17T00:00:00Z, got %q", v)
+			}
+			*dst = t
+			return nil
+		}}
+	}
+
+	return []setting{
+		str("PORT", &cfg.Port),
+		str("BASE_URL", &cfg.BaseURL),
+		list("SESSION_KEYS", &cfg.SessionKeys),
+		str("GOOGLE_CLIENT_ID", &cfg.GoogleClientID),
+		str("GOOGLE_CLIENT_SECRET", &cfg.GoogleClientSecret),
+		// MONGOLAB_URI is what the Heroku add-on sets
+		str("MONGOLAB_URI", &cfg.MongoURI),
+		str("MONGO_URI", &cfg.MongoURI),
+		str("MONGO_DATABASE", &cfg.MongoDatabase),
+		duration("MONGO_TIMEOUT", &cfg.MongoTimeout),
+		list("ALLOWED_ORIGINS", &cfg.AllowedOrigins),
+		str("GMAIL_PUSH_TOKEN", &cfg.GmailPushToken),
+		str("GMAIL_BASE_PATH", &cfg.GmailBasePath),
+		size("ATTACHMENT_MAX_SIZE", &cfg.AttachmentMaxSize),
+		size("DRAFT_ATTACHMENT_MAX_SIZE", &cfg.DraftAttachmentMaxSize),
+		duration("READ_TIMEOUT", &cfg.ReadTimeout),
+		duration("WRITE_TIMEOUT", &cfg.WriteTimeout),
+		instant("LEGACY_COOKIE_CUTOFF", &cfg.LegacyCookieCutoff),
+	}
+}
+
+// loadConfig reads the configuration from the JSON file at path, if any, and
+// then from the environment, and validates it. All the problems found are
+// reported together.
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	cfg := defaultConfig()
+	var problems configError
+
+	file := map[string]interface{}{}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, configError{fmt.Sprintf("config file: %s", err)}
+		}
+		err = json.NewDecoder(f).Decode(&file)
+		f.Close()
+		if err != nil {
+			return nil, configError{fmt.Sprintf("config file %s: %s", path, err)}
+		}
+	}
+
+	// the whole file is read before the environment, so any variable set
+	// overrides the file, even one naming the same value differently
+	known := map[string]bool{}
+	for _, s := range cfg.settings() {
+		key := strings.ToLower(s.name)
+		known[key] = true
+
+		if v, ok := file[key]; ok {
+			str, err := fileValue(v)
+			if err == nil {
+				err = s.parse(str)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s in %s %s", key, path, err))
+			}
+		}
+	}
+	for _, s := range cfg.settings() {
+		if v := getenv(s.name); v != "" {
+			err := s.parse(v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s", s.name, err))
+			}
+		}
+	}
+	for key := range file {
+		if !known[key] {
+			problems = append(problems, fmt.Sprintf("%s in %s is not a setting", key, path))
+		}
+	}
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return cfg, nil
+}
+
+// fileValue turns a value from the config file into the string the
+// environment would hold
+func fileValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("must be a list of strings")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, a number or a list of strings")
+}
+
+// validate returns what is wrong with cfg
+func (cfg *Config) validate() []string {
+	var problems []string
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT must be a port number, got %q", cfg.Port))
+	}
+
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if u, err := url.Parse(cfg.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("BASE_URL must be the http(s) URL the server is reached at, got %q", cfg.BaseURL))
+	}
+
+	if len(cfg.SessionKeys) == 0 {
+		problems = append(problems, "SESSION_KEYS must hold at least one key")
+	}
+	for i, key := range cfg.SessionKeys {
+		if len(key) < minSessionKeyLength {
+			problems = append(problems, fmt.Sprintf("SESSION_KEYS key %d is %d characters long, keys need at least %d", i+1, len(key), minSessionKeyLength))
+		}
+	}
+
+	if cfg.GoogleClientID == "" {
+		problems = append(problems, "GOOGLE_CLIENT_ID is required")
+	}
+	if cfg.GoogleClientSecret == "" {
+		problems = append(problems, "GOOGLE_CLIENT_SECRET is required")
+	}
+	if cfg.MongoDatabase == "" {
+		problems = append(problems, "MONGO_DATABASE can't be empty")
+	}
+	if cfg.MongoTimeout == 0 {
+		problems = append(problems, "MONGO_TIMEOUT can't be 0")
+	}
+
+	for i, origin := range cfg.AllowedOrigins {
+		// browsers send origins without a trailing slash
+		origin = strings.TrimRight(origin, "/")
+		cfg.AllowedOrigins[i] = origin
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			problems = append(problems, fmt.Sprintf("ALLOWED_ORIGINS must hold origins such as https://mail.google.com or chrome-extension://<id>, got %q", origin))
+		}
+	}
+
+	if cfg.GmailBasePath != "" {
+		if u, err := url.Parse(cfg.GmailBasePath); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("GMAIL_BASE_PATH must be a URL, got %q", cfg.GmailBasePath))
+		}
+	}
+	if cfg.AttachmentMaxSize > cfg.DraftAttachmentMaxSize {
+		problems = append(problems, "ATTACHMENT_MAX_SIZE can't be more than DRAFT_ATTACHMENT_MAX_SIZE")
+	}
+	return problems
+}
+
+// sessionKeyPairs derives the hash and encryption key pairs the session store
+// takes from the session keys, newest first
+func (cfg *Config) sessionKeyPairs() [][]byte {
+	var pairs [][]byte
+	for _, key := range cfg.SessionKeys {
+		pairs = append(pairs, deriveKey(key, "session hash"), deriveKey(key, "session block"))
+	}
+	return pairs
+}
+
+// deriveKey derives a 32 byte key for purpose from secret
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
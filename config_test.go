@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEnvironmentOverridesConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "blendr-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"mongo_uri": "mongodb://file", "mongo_database": "from-file"}`)
+	f.Close()
+
+	getenv := func(key string) string {
+		if key == "MONGOLAB_URI" {
+			return "mongodb://heroku"
+		}
+		return testEnv(key)
+	}
+	cfg, err := loadConfig(f.Name(), getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MongoURI != "mongodb://heroku" {
+		t.Fatalf("MongoURI = %q, want the one from MONGOLAB_URI", cfg.MongoURI)
+	}
+	if cfg.MongoDatabase != "from-file" {
+		t.Fatalf("MongoDatabase = %q, want the one from the file", cfg.MongoDatabase)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight
+const corsMaxAge = 600
+
+var (
+	// corsMethods are the methods the API is called with
+	corsMethods = []string{"GET", "POST", "DELETE"}
+
+	// corsRequestHeaders may be sent from another origin, besides those
+	// browsers always allow
+	corsRequestHeaders = []string{"Content-Type", csrfHeader, requestIDHeader}
+
+	// corsExposedHeaders may be read by a page from another origin, besides
+	// those browsers always expose
+	corsExposedHeaders = []string{requestIDHeader, "Content-Disposition"}
+)
+
+// withCORS lets the pages of allowedOrigins, such as Gmail or the extension,
+// call the server with the user's cookies, and answers their preflight
+// requests. Other origins get no CORS headers, so browsers keep their pages
+// from reading responses.
+func withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// responses differ by origin, so caches must keep them apart
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" || !allowedOrigin(origin) {
+			if preflight {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "Origin %q may not call this server", origin)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsRequestHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowedOrigin tells if pages from origin may call the server. Origins are
+// compared without regard to case, as browsers send them lower case.
+func allowedOrigin(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
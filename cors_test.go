@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	for _, c := range []struct {
+		name      string
+		method    string
+		origin    string
+		preflight bool
+		status    int
+		allowed   bool
+	}{
+		{"preflight from Gmail", "OPTIONS", "https://mail.google.com", true, http.StatusNoContent, true},
+		{"preflight in another case", "OPTIONS", "https://MAIL.google.com", true, http.StatusNoContent, true},
+		{"preflight from elsewhere", "OPTIONS", "https://evil.example.com", true, http.StatusForbidden, false},
+		{"preflight without origin", "OPTIONS", "", true, http.StatusForbidden, false},
+		{"call from Gmail", "GET", "https://mail.google.com", false, http.StatusUnauthorized, true},
+		{"call from elsewhere", "GET", "https://evil.example.com", false, http.StatusUnauthorized, false},
+		{"call from a subdomain", "GET", "https://mail.google.com.evil.example.com", false, http.StatusUnauthorized, false},
+	} {
+		req, err := http.NewRequest(c.method, ts.server.URL+apiPrefix+"/session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.preflight {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", csrfHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status = %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+		want := ""
+		if c.allowed {
+			want = c.origin
+		}
+		if allowOrigin := resp.Header.Get("Access-Control-Allow-Origin"); allowOrigin != want {
+			t.Errorf("%s: allowed origin = %q, want %q", c.name, allowOrigin, want)
+		}
+		if c.allowed && resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s: credentials not allowed", c.name)
+		}
+		if c.allowed && c.preflight && (resp.Header.Get("Access-Control-Allow-Methods") == "" || resp.Header.Get("Access-Control-Allow-Headers") == "") {
+			t.Errorf("%s: preflight headers = %v", c.name, resp.Header)
+		}
+		if c.allowed && !c.preflight && resp.Header.Get("Access-Control-Expose-Headers") == "" {
+			t.Errorf("%s: exposed headers missing", c.name)
+		}
+		if vary := resp.Header["Vary"]; len(vary) == 0 || vary[0] != "Origin" {
+			t.Errorf("%s: vary = %v", c.name, vary)
+		}
+	}
+}
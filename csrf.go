@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// csrfHeader carries the CSRF token of the session on every request that
+	// changes something. Another site can make a browser send the session
+	// cookie but can't read the token nor, without CORS allowing it, set the
+	// header.
+	csrfHeader = "X-CSRF-Token"
+
+	csrfTokenKey = "csrf-token"
+)
+
+// sessionInfo is what a client learns about its session.
+type sessionInfo struct {
+	Email     string `json:"email"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+// safeMethod tells if requests with method only read
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// checkCSRF tells if r may act on behalf of session: reads always may,
+// anything else must carry the CSRF token of the session
+func checkCSRF(r *http.Request, session *sessions.Session) bool {
+	if safeMethod(r.Method) {
+		return true
+	}
+	token, _ := session.Values[csrfTokenKey].(string)
+	return validToken(token, r.Header.Get(csrfHeader))
+}
+
+// validToken tells, in constant time, if sent is token, which must be set
+func validToken(token, sent string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sent)) == 1
+}
+
+// getSession returns who is signed in and the CSRF token to send along with
+// requests that change something. Sessions from before CSRF tokens get one
+// here.
+func getSession(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	session, err := store.Get(r, sessionKey)
+	if err != nil {
+		internalError(w, r, "Failed to read the session", err)
+		return
+	}
+	token, _ := session.Values[csrfTokenKey].(string)
+	if token == "" {
+		token = randomToken()
+		session.Values[csrfTokenKey] = token
+		err = store.Save(r, w, session)
+		if err != nil {
+			internalError(w, r, "Failed to save the session", err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, sessionInfo{Email: requestUser(r), CSRFToken: token})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	diffEqual  = "equal"
+	diffInsert = "insert"
+	diffDelete = "delete"
+
+	// diffContext is the number of unchanged lines around each unified hunk
+	diffContext = 3
+)
+
+var wordPattern = regexp.MustCompile(`\s+|[^\s]+`)
+
+// diffSegment is a run of text that is unchanged, inserted or deleted
+// between two revisions.
+type diffSegment struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// splitWords splits s into words and the whitespace between them
+func splitWords(s string) []string {
+	return wordPattern.FindAllString(s, -1)
+}
+
+// splitLines splits s into lines, keeping the line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffTokens computes the shortest edit script turning a into b with the
+// Myers algorithm, one segment per token.
+func diffTokens(a, b []string) []diffSegment {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+search:
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// walk back through the trace to recover the script
+	var rev []diffSegment
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			rev = append(rev, diffSegment{Op: diffEqual, Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = append(rev, diffSegment{Op: diffInsert, Text: b[y-1]})
+			} else {
+				rev = append(rev, diffSegment{Op: diffDelete, Text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	segs := make([]diffSegment, len(rev))
+	for i := range rev {
+		segs[i] = rev[len(rev)-1-i]
+	}
+	return segs
+}
+
+// mergeSegments joins neighbouring segments with the same op
+func mergeSegments(segs []diffSegment) []diffSegment {
+	var out []diffSegment
+	for _, s := range segs {
+		if len(out) > 0 && out[len(out)-1].Op == s.Op {
+			out[len(out)-1].Text += s.Text
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// wordDiff diffs two documents word by word
+func wordDiff(a, b string) []diffSegment {
+	return mergeSegments(diffTokens(splitWords(a), splitWords(b)))
+}
+
+// unifiedDiff renders a line diff of two documents in unified format
+func unifiedDiff(fromName, toName, a, b string) string {
+	lines := diffTokens(splitLines(a), splitLines(b))
+
+	// line numbers in a and b before each segment
+	aLine := make([]int, len(lines)+1)
+	bLine := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if l.Op != diffInsert {
+			aLine[i+1]++
+		}
+		if l.Op != diffDelete {
+			bLine[i+1]++
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	for i := 0; i < len(lines); {
+		if lines[i].Op == diffEqual {
+			i++
+			continue
+		}
+
+		// grow the hunk while changes are close enough to share context
+		start := maxInt(0, i-diffContext)
+		end := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].Op != diffEqual {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end = minInt(len(lines), end+diffContext)
+
+		aCount, bCount := aLine[end]-aLine[start], bLine[end]-bLine[start]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine[start], aCount), hunkRange(bLine[start], bCount))
+		for _, l := range lines[start:end] {
+			prefix := " "
+			switch l.Op {
+			case diffInsert:
+				prefix = "+"
+			case diffDelete:
+				prefix = "-"
+			}
+			out.WriteString(prefix + l.Text)
+			if !strings.HasSuffix(l.Text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -1,177 +1,391 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/mgo.v2"
 )
 
 const (
 	emailCollection = "emails"
+
+	eventDeleted = "deleted"
 )
 
 type Email struct {
-	DraftID       string   `bson:"draft_id"`
-	Owner         string   `bson:"owner"`
-	Collaborators []string `bson:"collaborators"`
-	Edits         []Edit   `bson:"edits"`
+	DraftID       string         `bson:"draft_id"`
+	Owner         string         `bson:"owner"`
+	MailboxID     string         `bson:"mailbox_id"`
+	MailboxEmail  string         `bson:"mailbox_email,omitempty"`
+	Collaborators []string       `bson:"collaborators"`
+	Roles         []Member       `bson:"roles"`
+	Message       MIMEMessage    `bson:"message"`
+	Content       string         `bson:"content"`
+	Revision      int            `bson:"revision"`
+	Edits         []Edit         `bson:"edits"`
+	Subject       TextField      `bson:"subject"`
+	To            RecipientField `bson:"to"`
+	Cc            RecipientField `bson:"cc"`
+	Bcc           RecipientField `bson:"bcc"`
+	Attachments   []Attachment   `bson:"attachments"`
+	Approval      ApprovalStatus `bson:"approval"`
+	Sent          *SentInfo      `bson:"sent,omitempty"`
+
+	// ArchivedBy are the collaborators who put the draft away
+	ArchivedBy []string `bson:"archived_by,omitempty"`
+
+	// UpdatedAt and LastEditor are when and by whom the draft last changed,
+	// and PendingApprovers who still has to approve it. They are worked out
+	// from the rest of the draft whenever it is written, see refreshActivity,
+	// so drafts can be listed by them.
+	UpdatedAt        time.Time `bson:"updated_at"`
+	LastEditor       string    `bson:"last_editor"`
+	PendingApprovers []string  `bson:"pending_approvers"`
+
+	// Version goes up on every save, see DraftStore
+	Version int        `bson:"version"`
+	Sync    SyncStatus `bson:"sync"`
 }
 
+// Edit is one accepted change to a draft. Ops are stored as they were
+// applied, after being rebased onto the previous revision, and Content is
+// the document they produced, which is only stored with snapshots. Revisions
+// start at 1 and go up by one per Edit.
 type Edit struct {
-	Editor  string `bson:"editor"`
-	Content string `bson:"content"`
+	Editor       string    `bson:"editor" json:"editor"`
+	Revision     int       `bson:"revision" json:"revision"`
+	BaseRevision int       `bson:"base_revision" json:"base_revision"`
+	Ops          []Op      `bson:"ops" json:"ops"`
+	Content      string    `bson:"content,omitempty" json:"content"`
+	CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+	RestoredFrom int       `bson:"restored_from,omitempty" json:"restored_from,omitempty"`
+
+	// External is set on Edits made to the draft in Gmail rather than here
+	External bool `bson:"external,omitempty" json:"external,omitempty"`
+}
+
+// editRequest is the body of draftUpdate: ops made against the document as
+// it was at BaseRevision.
+type editRequest struct {
+	BaseRevision int  `json:"base_revision"`
+	Ops          []Op `json:"ops"`
 }
 
 type newEmailRequest struct {
 	DraftID string `json:"draft_id"`
 }
 
+// draftResource is how the API shows a draft. Edit histories are left out,
+// they are served by the history endpoint.
+type draftResource struct {
+	DraftID     string           `json:"draft_id"`
+	Owner       string           `json:"owner"`
+	Members     []Member         `json:"members"`
+	Subject     textResource     `json:"subject"`
+	Body        textResource     `json:"body"`
+	To          recipientsState  `json:"to"`
+	Cc          recipientsState  `json:"cc"`
+	Bcc         recipientsState  `json:"bcc"`
+	Attachments []Attachment     `json:"attachments"`
+	Approval    approvalResponse `json:"approval"`
+	Sent        *SentInfo        `json:"sent,omitempty"`
+	Sync        syncResource     `json:"sync"`
+	Archived    bool             `json:"archived"`
+	Version     int              `json:"version"`
+}
+
+type textResource struct {
+	Content  string `json:"content"`
+	Revision int    `json:"revision"`
+}
+
+type recipientsState struct {
+	Addresses []string `json:"addresses"`
+	Revision  int      `json:"revision"`
+}
+
+type syncResource struct {
+	State     string    `json:"state"`
+	LastError string    `json:"last_error,omitempty"`
+	SyncedAt  time.Time `json:"synced_at"`
+}
+
+// newDraftResource shows mail as the API does to user
+func newDraftResource(mail *Email, user string) *draftResource {
+	res := &draftResource{
+		DraftID:     mail.DraftID,
+		Owner:       mail.Owner,
+		Members:     members(mail),
+		Attachments: mail.Attachments,
+		Approval:    newApprovalResponse(mail),
+		Sent:        mail.Sent,
+		Sync: syncResource{
+			State:     mail.Sync.State,
+			LastError: mail.Sync.LastError,
+			SyncedAt:  mail.Sync.SyncedAt,
+		},
+		Archived: containsString(mail.ArchivedBy, user),
+		Version:  mail.Version,
+	}
+	subject, _ := mail.textField(fieldSubject)
+	body, _ := mail.textField(fieldBody)
+	res.Subject = textResource{Content: subject.Content, Revision: subject.Revision}
+	res.Body = textResource{Content: body.Content, Revision: body.Revision}
+	for field, state := range map[string]*recipientsState{fieldTo: &res.To, fieldCc: &res.Cc, fieldBcc: &res.Bcc} {
+		list := mail.recipientField(field)
+		state.Addresses = list.Addresses
+		if state.Addresses == nil {
+			state.Addresses = []string{}
+		}
+		state.Revision = list.Revision
+	}
+	if res.Attachments == nil {
+		res.Attachments = []Attachment{}
+	}
+	return res
+}
+
 // newEmail is an API endpoint to create a new Draft object
 func newEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var newDraft newEmailRequest
-	buf, err := ioutil.ReadAll(r.Body) // TODO: fix
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Failed to read in request body => {%s}", err)
+	if !readJSON(w, r, &newDraft) {
 		return
 	}
-	defer r.Body.Close()
-
-	// decode the request
-	err = json.Unmarshal(buf, &newDraft)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Failed to decode JSON request => {%s}, data => {%s}", err, string(buf))
+	if newDraft.DraftID == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "draft_id is required")
 		return
 	}
 
 	log.Printf("Draft recieved => %#v", newDraft)
 
 	// see if the draft alread exists
-	n, err := mgoConn.C(emailCollection).Find(bson.M{"draft_id": newDraft.DraftID}).Count()
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Failed to check database for existance => {%s}", err)
+	st := requestStores(r)
+	_, err := st.Drafts.Get(newDraft.DraftID)
+	if err != nil && err != mgo.ErrNotFound {
+		internalError(w, r, "Failed to check database for existance", err)
 		return
-	} else if n != 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("tried to recreate object")
+	} else if err == nil {
+		writeError(w, r, http.StatusConflict, codeAlreadyExists, "Draft %s is already shared", newDraft.DraftID)
 		return
 	}
 
 	// grab session reference
 	s, err := store.Get(r, sessionKey)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Failed to access the session => {%s}", err)
+		internalError(w, r, "Failed to access the session", err)
 		return
 	}
 
 	// get actual Gmail draft
-	body, err := getDraft(r, newDraft.DraftID)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Failed to access the gmail draft => {%s}", err)
+	mailboxID := s.Values[userIDKey].(string)
+	msg, messageID, err := st.getDraft(mailboxID, newDraft.DraftID)
+	if err == errGmailNotFound {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No Gmail draft with id %s", newDraft.DraftID)
+		return
+	} else if err != nil {
+		gmailError(w, r, "Failed to access the gmail draft", err)
 		return
 	}
 
-	// insert the new draft
-	owner := s.Values[userEmailKey].(string)
+	// insert the new draft, collaborating on its plain text body
+	body := msg.Text
+	owner := requestUser(r)
 	mail := Email{
 		DraftID:       newDraft.DraftID,
 		Owner:         owner,
+		MailboxID:     mailboxID,
+		MailboxEmail:  owner,
 		Collaborators: []string{owner},
+		Message:       *msg,
+		Content:       body,
+		Revision:      1,
 		Edits: []Edit{
 			Edit{
-				Editor:  owner,
-				Content: body,
+				Editor:    owner,
+				Revision:  1,
+				Ops:       []Op{{Type: opInsert, Pos: 0, Text: body}},
+				Content:   body,
+				CreatedAt: time.Now(),
 			},
 		},
+		Sync: SyncStatus{State: syncSynced, MessageID: messageID},
+	}
+	initialFields(&mail, owner)
+	mail.Sync.Revisions = syncedRevisions(&mail)
+	err = st.importAttachments(&mail)
+	if err != nil {
+		internalError(w, r, "Failed to store attachments", err)
+		return
 	}
-	err = mgoConn.C(emailCollection).Insert(&mail)
+	mail.Sync.Attachments = attachmentIDs(&mail)
+	mail.refreshActivity()
+	err = st.Drafts.Insert(&mail)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("failed to insert new draft to %s=> {%s}", emailCollection, err)
+		st.removeAttachmentFiles(mail.Attachments)
+		internalError(w, r, "Failed to insert new draft", err)
 		return
 	}
+
+	writeJSON(w, http.StatusCreated, newDraftResource(&mail, owner))
 }
 
-// draftUpdate
-func draftUpdate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	draftID := p.ByName(draftIDParam)
-	var change Edit
+// draftGet returns a draft as it is now
+func draftGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, newDraftResource(requestDraft(r), requestUser(r)))
+}
 
-	// decode the request into an Edit
-	decoder := json.NewDecoder(r.Body)
-	defer r.Body.Close()
-	err := decoder.Decode(&change)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to decode JSON request => {%s}", err)
+// draftDelete stops sharing a draft, throwing away its history, comments,
+// invitations and attachments. With ?gmail=true the Gmail draft is deleted
+// as well, otherwise it stays in the owner's mailbox as it was last synced.
+func draftDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	st := requestStores(r)
+
+	if r.FormValue("gmail") == "true" {
+		gm, err := st.gmailForUser(mail.MailboxID)
+		if err == nil {
+			err = gm.DeleteDraft(mail.DraftID)
+		}
+		if err != nil && err != errGmailNotFound {
+			gmailError(w, r, "Failed to delete the gmail draft", err)
+			return
+		}
 	}
 
-	// add the author to the change
-	s, err := store.Get(r, sessionKey)
-	if err != nil {
-		fmt.Fprintf(w, "Failed to access the session => {%s}", err)
+	err := st.Drafts.Delete(mail.DraftID)
+	if err == mgo.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No draft with id %s", mail.DraftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to delete draft", err)
 		return
 	}
-	change.Editor = s.Values[userEmailKey].(string)
+	st.removeDraftData(mail)
+
+	publishDraftEvent(draftEvent{
+		Type:    eventDeleted,
+		DraftID: mail.DraftID,
+		User:    requestUser(r),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeDraftData cleans up what is kept about a draft outside of it once it
+// is deleted. Failures are only logged, the draft is gone regardless.
+func (st *Stores) removeDraftData(mail *Email) {
+	st.removeAttachmentFiles(mail.Attachments)
 
-	err = mgoConn.C(emailCollection).Update(
-		bson.M{"draftID": draftID},
-		bson.M{"$push": bson.M{"Edits": &change}})
+	err := st.Comments.DeleteByDraft(mail.DraftID)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "failed to insert new draft => {%s}", err)
-		log.Printf("failed to insert new draft => {%s}", err)
+		log.Printf("failed to remove comments of %s => {%s}", mail.DraftID, err)
+	}
+	err = st.Invites.DeleteByDraft(mail.DraftID)
+	if err != nil {
+		log.Printf("failed to remove invitations of %s => {%s}", mail.DraftID, err)
+	}
+	err = st.Schedules.CancelByDraft(mail.DraftID, time.Now())
+	if err != nil {
+		log.Printf("failed to cancel scheduled sends of %s => {%s}", mail.DraftID, err)
 	}
-
-	// TODO: push update to Gmail
 }
 
-var listProjection bson.M = bson.M{
-	"DraftID": 1,
-	"Owner":   1,
+// archiveDraft hides a draft from the signed in user's list
+func archiveDraft(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	setArchived(w, r, true)
 }
 
-type listSummary struct {
-	DraftID string `json:"draft_id"`
-	Owner   string `json:""`
+// unarchiveDraft puts an archived draft back in the signed in user's list
+func unarchiveDraft(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	setArchived(w, r, false)
 }
 
-// listAvailable returns a list of all available drafts
-func listAvailable(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// get the requester from the session
-	s, err := store.Get(r, sessionKey)
+// setArchived archives a draft for the signed in user alone, the other
+// collaborators keep seeing it
+func setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	user := requestUser(r)
+	mail, err := updateDraft(requestStores(r).Drafts, requestDraft(r).DraftID, func(mail *Email) error {
+		mail.ArchivedBy = withoutString(mail.ArchivedBy, user)
+		if archived {
+			mail.ArchivedBy = append(mail.ArchivedBy, user)
+		}
+		return nil
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to access the session => {%s}", err)
+		internalError(w, r, "Failed to archive draft", err)
 		return
 	}
-	currentUser := s.Values[userEmailKey].(string)
 
-	// find all drafts the user has access to
-	drafts := []listSummary{}
-	err = mgoConn.C(emailCollection).Find(
-		bson.M{"Collaborators": currentUser},
-	).Select(listProjection).All(&drafts)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed run mongo query => {%s}", err)
+	writeJSON(w, http.StatusOK, newDraftResource(mail, user))
+}
+
+// draftUpdate rebases a set of ops onto the current revision of a draft,
+// stores them as a new Edit and queues the result to be synced back to Gmail
+func draftUpdate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	draftID := p.ByName(draftIDParam)
+	var change editRequest
+
+	// decode the request into ops
+	if !readJSON(w, r, &change) {
 		return
 	}
 
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(drafts)
+	// add the author to the change
+	commitEdit(w, r, draftID, fieldBody, Edit{
+		Editor:       requestUser(r),
+		BaseRevision: change.BaseRevision,
+		Ops:          change.Ops,
+	})
+}
+
+// acceptEdit applies change to a text field of a draft, queues the result
+// for Gmail and broadcasts it to the draft's viewers.
+func (st *Stores) acceptEdit(draftID, field string, change Edit) (*Edit, error) {
+	edit, err := st.applyEdit(draftID, field, change)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed write data to conn => {%s}", err)
+		return nil, err
+	}
+
+	// push the update to the owner's Gmail draft in the background
+	st.queueSync(draftID)
+
+	// let everyone else viewing the draft know
+	publishDraftEvent(draftEvent{
+		Type:    eventEdit,
+		DraftID: draftID,
+		User:    edit.Editor,
+		Field:   field,
+		Edit:    edit,
+	})
+	return edit, nil
+}
+
+// commitEdit accepts change on a text field of a draft and writes the
+// resulting Edit, or the reason it was refused, as the response.
+func commitEdit(w http.ResponseWriter, r *http.Request, draftID, field string, change Edit) {
+	edit, err := requestStores(r).acceptEdit(draftID, field, change)
+	switch err {
+	case nil:
+	case mgo.ErrNotFound:
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No draft with id %s", draftID)
+		return
+	case errStaleRevision, errUnknownRevision:
+		writeError(w, r, http.StatusConflict, codeStaleRevision, "Failed to apply edit => {%s}", err)
+		return
+	case errEditContention:
+		writeError(w, r, http.StatusConflict, codeConflict, "Failed to apply edit => {%s}", err)
+		return
+	default:
+		if _, ok := err.(invalidEditError); ok {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "Failed to apply edit => {%s}", err)
+			return
+		}
+		internalError(w, r, "Failed to apply edit", err)
 		return
 	}
+
+	// hand back the rebased edit so the client can catch up
+	writeJSON(w, http.StatusOK, edit)
 }
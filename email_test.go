@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateMissingDraft(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+
+	var apiErr errorEnvelope
+	if status := owner.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: "r-missing"}, &apiErr); status != http.StatusNotFound || apiErr.Error.Code != codeNotFound {
+		t.Fatalf("create of a draft Gmail doesn't have = %d %s, want 404 %s", status, apiErr.Error.Code, codeNotFound)
+	}
+}
+
+func TestDraftEndpointsByRole(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	clients := map[string]*testClient{
+		"owner@example.com": owner,
+		"bob@example.com":   ts.clientFor("u2", "bob@example.com"),
+		"carol@example.com": ts.clientFor("u3", "carol@example.com"),
+		"dave@example.com":  ts.clientFor("u4", "dave@example.com"),
+	}
+
+	shared := func(draftID string) bool {
+		_, err := ts.stores.Drafts.Get(draftID)
+		return err == nil
+	}
+	inGmail := func(draftID string) bool {
+		_, ok := ts.fake.Draft(draftID)
+		return ok
+	}
+	archivedBy := func(user string) func(string) bool {
+		return func(draftID string) bool {
+			mail, _ := ts.stores.Drafts.Get(draftID)
+			return containsString(mail.ArchivedBy, user)
+		}
+	}
+	memberOf := func(user string) func(string) bool {
+		return func(draftID string) bool {
+			mail, _ := ts.stores.Drafts.Get(draftID)
+			return hasMember(members(mail), user)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		status int
+		// check is true of the draft afterwards
+		check func(draftID string) bool
+	}{
+		{"get as viewer", "carol@example.com", "GET", "", http.StatusOK, nil},
+		{"get as stranger", "dave@example.com", "GET", "", http.StatusForbidden, nil},
+		{"delete", "owner@example.com", "DELETE", "", http.StatusNoContent, func(id string) bool { return !shared(id) && inGmail(id) }},
+		{"delete from Gmail too", "owner@example.com", "DELETE", "?gmail=true", http.StatusNoContent, func(id string) bool { return !shared(id) && !inGmail(id) }},
+		{"delete as editor", "bob@example.com", "DELETE", "", http.StatusForbidden, shared},
+		{"archive as viewer", "carol@example.com", "POST", "/archive", http.StatusOK, archivedBy("carol@example.com")},
+		{"archive as stranger", "dave@example.com", "POST", "/archive", http.StatusForbidden, nil},
+		{"leave as editor", "bob@example.com", "POST", "/leave", http.StatusNoContent, func(id string) bool { return !memberOf("bob@example.com")(id) }},
+		{"leave as owner", "owner@example.com", "POST", "/leave", http.StatusBadRequest, memberOf("owner@example.com")},
+		{"leave as stranger", "dave@example.com", "POST", "/leave", http.StatusForbidden, nil},
+	} {
+		draftID := owner.shareDraft()
+		if err := ts.stores.setMemberRole(draftID, "bob@example.com", roleEditor); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.stores.setMemberRole(draftID, "carol@example.com", roleViewer); err != nil {
+			t.Fatal(err)
+		}
+
+		var draft draftResource
+		var out interface{}
+		if c.method == "GET" {
+			out = &draft
+		}
+		if status := clients[c.user].do(c.method, apiPrefix+"/draft/id/"+draftID+c.path, nil, out); status != c.status {
+			t.Errorf("%s: %s = %d, want %d", c.name, c.method, status, c.status)
+			continue
+		}
+		if out != nil && c.status == http.StatusOK && (draft.DraftID != draftID || len(draft.Members) != 3) {
+			t.Errorf("%s: draft = %+v", c.name, draft)
+		}
+		if c.check != nil && !c.check(draftID) {
+			t.Errorf("%s: draft afterwards isn't as expected", c.name)
+		}
+	}
+}
+
+func TestArchiveIsPerUser(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	if err := ts.stores.setMemberRole(draftID, "bob@example.com", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+	bob := ts.clientFor("u2", "bob@example.com")
+	path := apiPrefix + "/draft/id/" + draftID
+
+	for _, step := range []struct {
+		client       *testClient
+		action       string
+		owner, other bool
+	}{
+		{owner, "/archive", true, false},
+		{owner, "/archive", true, false},
+		{bob, "/archive", true, true},
+		{owner, "/unarchive", false, true},
+	} {
+		if status := step.client.do("POST", path+step.action, nil, nil); status != http.StatusOK {
+			t.Fatalf("%s = %d", step.action, status)
+		}
+		byOwner, byBob := owner.getDraft(draftID).Archived, bob.getDraft(draftID).Archived
+		if byOwner != step.owner || byBob != step.other {
+			t.Fatalf("after %s archived for the owner = %v, for bob = %v", step.action, byOwner, byBob)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	mailboxCollection = "mailboxes"
+
+	// historyPollPeriod is how often every mailbox holding a shared draft is
+	// checked for changes made in Gmail. Push notifications, when set up,
+	// only make changes show up sooner.
+	historyPollPeriod = 2 * time.Minute
+
+	draftLabel = "DRAFT"
+)
+
+// gmailPushToken must be given as the token query parameter by the Pub/Sub
+// push subscription. The push endpoint is disabled without it.
+var gmailPushToken string
+
+// mailboxQueue holds the users whose mailbox should be checked right away.
+var mailboxQueue = make(chan string, 100)
+
+// mailbox is how far the history of a user's mailbox has been read.
+type mailbox struct {
+	UserID    string    `bson:"user_id"`
+	HistoryID int64     `bson:"history_id"`
+	CheckedAt time.Time `bson:"checked_at"`
+}
+
+// pushNotification is the body Pub/Sub posts to a push endpoint.
+type pushNotification struct {
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gmailNotification is the data of a Gmail push notification.
+type gmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// MailboxStore keeps how far mailboxes have been read. Missing mailboxes are
+// reported as mgo.ErrNotFound by every implementation.
+type MailboxStore interface {
+	Load(userID string) (*mailbox, error)
+	Save(box *mailbox) error
+}
+
+// mongoMailboxStore keeps mailboxes in the mailboxes collection.
+type mongoMailboxStore struct {
+	c *mgo.Collection
+}
+
+func newMongoMailboxStore(db *mgo.Database) *mongoMailboxStore {
+	return &mongoMailboxStore{c: db.C(mailboxCollection)}
+}
+
+// ensureIndexes makes user_id unique in the mailboxes collection
+func (s *mongoMailboxStore) ensureIndexes() error {
+	return s.c.EnsureIndex(mgo.Index{
+		Key:    []string{"user_id"},
+		Unique: true,
+	})
+}
+
+func (s *mongoMailboxStore) Load(userID string) (*mailbox, error) {
+	var box mailbox
+	err := s.c.Find(bson.M{"user_id": userID}).One(&box)
+	if err != nil {
+		return nil, err
+	}
+	return &box, nil
+}
+
+func (s *mongoMailboxStore) Save(box *mailbox) error {
+	_, err := s.c.Upsert(
+		bson.M{"user_id": box.UserID},
+		bson.M{"$set": bson.M{"history_id": box.HistoryID, "checked_at": box.CheckedAt}})
+	return err
+}
+
+// memoryMailboxStore keeps mailboxes in this process, for tests.
+type memoryMailboxStore struct {
+	mu    sync.Mutex
+	boxes map[string]mailbox
+}
+
+func newMemoryMailboxStore() *memoryMailboxStore {
+	return &memoryMailboxStore{boxes: make(map[string]mailbox)}
+}
+
+func (s *memoryMailboxStore) Load(userID string) (*mailbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box, ok := s.boxes[userID]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return &box, nil
+}
+
+func (s *memoryMailboxStore) Save(box *mailbox) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.boxes[box.UserID] = *box
+	return nil
+}
+
+// runHistoryPoller checks mailboxes for changes to shared drafts, all of them
+// periodically and single ones as notifications arrive.
+func (st *Stores) runHistoryPoller() {
+	poll := time.NewTicker(historyPollPeriod)
+	defer poll.Stop()
+
+	for {
+		select {
+		case userID := <-mailboxQueue:
+			st.checkMailbox(userID)
+		case <-poll.C:
+			userIDs, err := st.Drafts.MailboxIDs(DraftQuery{ExcludeSyncStates: inactiveSyncStates})
+			if err != nil {
+				log.Printf("runHistoryPoller: failed to list mailboxes => {%s}", err)
+				continue
+			}
+			for _, userID := range userIDs {
+				st.checkMailbox(userID)
+			}
+		}
+	}
+}
+
+// checkMailbox reads the history of a mailbox since it was last checked and
+// looks at its shared drafts if any draft changed. The first time, or when
+// Gmail no longer has history that old, the drafts are always looked at.
+func (st *Stores) checkMailbox(userID string) {
+	gm, err := st.gmailForUser(userID)
+	if err != nil {
+		log.Printf("checkMailbox: no mailbox for %s => {%s}", userID, err)
+		return
+	}
+
+	box, err := st.Mailboxes.Load(userID)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("checkMailbox: failed to load mailbox %s => {%s}", userID, err)
+		return
+	}
+
+	changed, next := true, uint64(0)
+	if err == nil {
+		changed, next, err = gm.DraftsChangedSince(uint64(box.HistoryID))
+		if err == errGmailNotFound {
+			changed, next, err = true, 0, nil
+		} else if err != nil {
+			log.Printf("checkMailbox: failed to list history of %s => {%s}", userID, err)
+			return
+		}
+	}
+	if next == 0 {
+		// start from now, after looking at every draft below
+		next, err = gm.HistoryID()
+		if err != nil {
+			log.Printf("checkMailbox: failed to get profile of %s => {%s}", userID, err)
+			return
+		}
+	}
+
+	if changed {
+		drafts, err := st.Drafts.List(DraftQuery{
+			MailboxID:         userID,
+			ExcludeSyncStates: inactiveSyncStates,
+		})
+		if err != nil {
+			log.Printf("checkMailbox: failed to load drafts of %s => {%s}", userID, err)
+			return
+		}
+		for i := range drafts {
+			err = st.checkDraft(gm, &drafts[i])
+			if err != nil {
+				log.Printf("checkMailbox: failed to check draft %s => {%s}", drafts[i].DraftID, err)
+			}
+		}
+	}
+
+	err = st.Mailboxes.Save(&mailbox{UserID: userID, HistoryID: int64(next), CheckedAt: time.Now()})
+	if err != nil {
+		log.Printf("checkMailbox: failed to save history of %s => {%s}", userID, err)
+	}
+}
+
+// checkDraft compares the Gmail copy of a shared draft with what was last
+// pushed to it. Changes are recorded as Edits from the owner, and a draft
+// that is gone is marked orphaned.
+func (st *Stores) checkDraft(gm Gmail, mail *Email) error {
+	messageID, err := gm.DraftMessageID(mail.DraftID)
+	if err == errGmailNotFound {
+		return st.orphanDraft(mail)
+	} else if err != nil {
+		return err
+	}
+	if messageID == "" || messageID == mail.Sync.MessageID {
+		return nil
+	}
+
+	draft, err := gm.GetDraft(mail.DraftID)
+	if err == errGmailNotFound {
+		return st.orphanDraft(mail)
+	} else if err != nil {
+		return err
+	}
+	msg, err := parseMessage(draft.Raw)
+	if err != nil {
+		return err
+	}
+
+	// a push recorded since the draft was listed isn't a change made in Gmail
+	mail, err = st.Drafts.Get(mail.DraftID)
+	if err != nil {
+		return err
+	}
+	if draft.ID == mail.Sync.MessageID || containsString(inactiveSyncStates, mail.Sync.State) {
+		return nil
+	}
+
+	err = st.applyExternalChange(mail, msg)
+	if err != nil {
+		return err
+	}
+	added, removed, inGmail, err := st.externalAttachments(mail, msg.Attachments)
+	if err != nil {
+		return err
+	}
+
+	// keep the rest of the message as it is in Gmail, such as its HTML body
+	// and other headers. Its attachments live in the blob store.
+	msg.Attachments = nil
+	_, err = updateDraft(st.Drafts, mail.DraftID, func(mail *Email) error {
+		mail.Message = *msg
+		mail.Sync.MessageID = draft.ID
+		mail.Sync.Attachments = inGmail
+		if len(added) > 0 || len(removed) > 0 {
+			var gone []string
+			for _, a := range removed {
+				gone = append(gone, a.ID)
+			}
+			kept := []Attachment{}
+			for _, a := range mail.Attachments {
+				if !containsString(gone, a.ID) {
+					kept = append(kept, a)
+				}
+			}
+			mail.Attachments = append(kept, added...)
+			mail.Approval.Approvals = []Approval{}
+		}
+		return nil
+	})
+	if err != nil {
+		st.removeAttachmentFiles(added)
+		return err
+	}
+	st.removeAttachmentFiles(removed)
+
+	holder := mail.mailboxHolder()
+	for i := range added {
+		publishDraftEvent(draftEvent{Type: eventAttachmentAdded, DraftID: mail.DraftID, User: holder, Attachment: &added[i]})
+	}
+	for i := range removed {
+		publishDraftEvent(draftEvent{Type: eventAttachmentRemoved, DraftID: mail.DraftID, User: holder, Attachment: &removed[i]})
+	}
+	return nil
+}
+
+// externalAttachments works out how the attachments of a draft were changed
+// in Gmail, whose copy holds files. Files the draft doesn't have are imported
+// as added by whoever holds the mailbox, and attachments Gmail had but no
+// longer has are removed. Those that never reached Gmail are kept. inGmail
+// are the IDs of the attachments Gmail has now.
+func (st *Stores) externalAttachments(mail *Email, files []MIMEAttachment) (added, removed []Attachment, inGmail []string, err error) {
+	unmatched := append([]MIMEAttachment(nil), files...)
+	inGmail = []string{}
+	for _, a := range mail.Attachments {
+		if i := pushedFile(unmatched, a); i >= 0 {
+			unmatched = append(unmatched[:i], unmatched[i+1:]...)
+			inGmail = append(inGmail, a.ID)
+		} else if containsString(mail.Sync.Attachments, a.ID) {
+			removed = append(removed, a)
+		}
+	}
+
+	imported := Email{
+		DraftID: mail.DraftID,
+		Owner:   mail.mailboxHolder(),
+		Message: MIMEMessage{Attachments: unmatched},
+	}
+	err = st.importAttachments(&imported)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	inGmail = append(inGmail, attachmentIDs(&imported)...)
+	return imported.Attachments, removed, inGmail, nil
+}
+
+// pushedFile returns the index of the file among files that a was pushed
+// as, or -1 if there is none
+func pushedFile(files []MIMEAttachment, a Attachment) int {
+	for i, f := range files {
+		if f.Filename == a.Filename && int64(len(f.Data)) == a.Size {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyExternalChange records the differences between msg and the draft as
+// it was last pushed to Gmail as Edits from whoever holds the mailbox. They
+// are made against the pushed revisions, so collaborators' Edits that haven't
+// reached Gmail yet are kept.
+func (st *Stores) applyExternalChange(mail *Email, msg *MIMEMessage) error {
+	texts := map[string]string{
+		fieldBody:    msg.Text,
+		fieldSubject: msg.headerValue("Subject"),
+	}
+	for field, text := range texts {
+		current, _ := mail.textField(field)
+		base, err := externalBase(current, mail.Sync.Revisions[field], text)
+		if err != nil {
+			return fmt.Errorf("Failed to rebuild %s => {%s}", field, err)
+		}
+		if base == nil || base.Content == text {
+			continue
+		}
+
+		_, err = st.acceptEdit(mail.DraftID, field, Edit{
+			Editor:       mail.mailboxHolder(),
+			BaseRevision: base.Revision,
+			Ops:          diffOps(base.Content, text),
+			External:     true,
+		})
+		if err == errStaleRevision {
+			// too far behind to rebase, so the Gmail copy wins
+			_, err = st.acceptEdit(mail.DraftID, field, Edit{
+				Editor:       mail.mailboxHolder(),
+				BaseRevision: current.Revision,
+				Ops:          diffOps(current.Content, text),
+				External:     true,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to record %s change => {%s}", field, err)
+		}
+	}
+
+	for field, header := range recipientHeaders {
+		list := mail.recipientField(field)
+		revision, ok := mail.Sync.Revisions[field]
+		if !ok {
+			revision = list.Revision
+		}
+		base := recipientsAt(list, revision)
+		external := parseAddresses(msg.headerValue(header))
+		if recipientsPushed(list, revision, external) {
+			continue
+		}
+
+		var add, remove []string
+		for _, a := range external {
+			if !containsAddress(base, addressKey(a)) {
+				add = append(add, a)
+			}
+		}
+		for _, a := range base {
+			if !containsAddress(external, addressKey(a)) {
+				remove = append(remove, a)
+			}
+		}
+		if len(add) == 0 && len(remove) == 0 {
+			continue
+		}
+
+		_, err := st.acceptRecipientEdit(mail.DraftID, field, RecipientEdit{
+			Editor:   mail.mailboxHolder(),
+			Add:      add,
+			Remove:   remove,
+			External: true,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to record %s change => {%s}", field, err)
+		}
+	}
+	return nil
+}
+
+// externalBase returns the revision of a text field that text, Gmail's copy
+// of it, was made from. That is the revision last pushed, or the current one
+// if none was recorded, unless text is a later revision whose push isn't
+// recorded yet.
+func externalBase(current TextField, pushed int, text string) (*Edit, error) {
+	if pushed < 1 || pushed > current.Revision {
+		pushed = current.Revision
+	}
+	from := lastSnapshot(current, pushed)
+	if from < 0 {
+		return nil, nil
+	}
+
+	var base *Edit
+	err := replay(current, from, current.Revision, func(e *Edit, content string) {
+		if e.Revision == pushed || (e.Revision > pushed && content == text) {
+			edit := *e
+			edit.Content = content
+			base = &edit
+		}
+	})
+	return base, err
+}
+
+// recipientsPushed tells whether external, Gmail's copy of a recipient list,
+// is the list at a revision after the one last pushed, whose push isn't
+// recorded yet
+func recipientsPushed(list *RecipientField, pushed int, external []string) bool {
+	for revision := pushed + 1; revision <= list.Revision; revision++ {
+		at := recipientsAt(list, revision)
+		same := len(at) == len(external)
+		for _, a := range external {
+			same = same && containsAddress(at, addressKey(a))
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// diffOps turns the word diff of a and b into ops that change a into b
+func diffOps(a, b string) []Op {
+	var ops []Op
+	pos := 0
+	for _, seg := range wordDiff(a, b) {
+		n := utf8.RuneCountInString(seg.Text)
+		switch seg.Op {
+		case diffEqual:
+			pos += n
+		case diffDelete:
+			ops = append(ops, Op{Type: opDelete, Pos: pos, Count: n})
+		case diffInsert:
+			ops = append(ops, Op{Type: opInsert, Pos: pos, Text: seg.Text})
+			pos += n
+		}
+	}
+	return ops
+}
+
+// orphanDraft marks a draft deleted from Gmail so it is no longer synced,
+// keeping its content and history here
+func (st *Stores) orphanDraft(mail *Email) error {
+	_, err := updateDraft(st.Drafts, mail.DraftID, func(mail *Email) error {
+		mail.Sync.State = syncOrphaned
+		mail.Sync.OrphanedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	publishDraftEvent(draftEvent{
+		Type:    eventOrphaned,
+		DraftID: mail.DraftID,
+		User:    mail.Owner,
+	})
+	return nil
+}
+
+// gmailPush receives Gmail notifications from a Pub/Sub push subscription
+// and queues the mailbox they are about to be checked. The Gmail watch on
+// each mailbox is set up outside of the server.
+func gmailPush(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !validToken(gmailPushToken, r.FormValue("token")) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No such endpoint %s %s", r.Method, r.URL.Path)
+		return
+	}
+
+	var push pushNotification
+	if !readJSON(w, r, &push) {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Failed to decode message data => {%s}", err)
+		return
+	}
+	var note gmailNotification
+	err = json.Unmarshal(data, &note)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Failed to decode notification => {%s}", err)
+		return
+	}
+
+	// a mailbox we hold no token for isn't ours, so acknowledge and drop it
+	tok, err := requestStores(r).Tokens.FindByEmail(note.EmailAddress)
+	if err == nil {
+		select {
+		case mailboxQueue <- tok.UserID:
+		default:
+			// the next poll will pick it up
+			log.Printf("gmailPush: queue full, deferring mailbox %s", tok.UserID)
+		}
+	} else if err != mgo.ErrNotFound {
+		log.Printf("gmailPush: failed to look up %s => {%s}", note.EmailAddress, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
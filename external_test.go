@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// push delivers a Gmail notification for the test mailbox the way Pub/Sub
+// does, with token in the URL
+func (ts *testServer) push(token string) int {
+	data, _ := json.Marshal(gmailNotification{EmailAddress: ts.fake.Email, HistoryID: 2})
+	var push pushNotification
+	push.Message.Data = base64.StdEncoding.EncodeToString(data)
+	body, _ := json.Marshal(push)
+
+	resp, err := http.Post(ts.server.URL+"/gmail/push?token="+token, "application/json", bytes.NewReader(body))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGmailPushChecksToken(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.signIn()
+
+	for _, token := range []string{"", "push", "push-token-", "wrong-token"} {
+		if status := ts.push(token); status != http.StatusNotFound {
+			t.Errorf("push with token %q = %d, want 404", token, status)
+		}
+	}
+	select {
+	case userID := <-mailboxQueue:
+		t.Fatalf("mailbox %s checked for a push with a bad token", userID)
+	default:
+	}
+
+	if status := ts.push("push-token"); status != http.StatusNoContent {
+		t.Fatalf("push with the token = %d, want 204", status)
+	}
+	select {
+	case userID := <-mailboxQueue:
+		if userID != ts.fake.UserID {
+			t.Fatalf("checking mailbox %s, want %s", userID, ts.fake.UserID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mailbox wasn't queued for a check")
+	}
+}
+
+// testDraftWithFile is testDraft edited in Gmail to say more and carry a file
+const testDraftWithFile = `Subject: Lunch
+To: bob@example.com
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: text/plain; charset=utf-8
+
+See you at noon sharp
+--outer
+Content-Type: application/pdf; name="menu.pdf"
+Content-Disposition: attachment; filename="menu.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`
+
+func TestExternalChangeImportsAttachments(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	ts.fake.SetDraft(draftID, []byte(strings.Replace(testDraftWithFile, "\n", "\r\n", -1)))
+	ts.stores.checkMailbox(ts.fake.UserID)
+
+	draft := owner.getDraft(draftID)
+	if draft.Body.Content != "See you at noon sharp" {
+		t.Fatalf("body = %q", draft.Body.Content)
+	}
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	if len(mail.Attachments) != 1 || mail.Attachments[0].Filename != "menu.pdf" || mail.Attachments[0].UploadedBy != "owner@example.com" {
+		t.Fatalf("attachments = %+v", mail.Attachments)
+	}
+	menu := mail.Attachments[0]
+	if resp, data := owner.download(draftID, menu.ID); resp.StatusCode != http.StatusOK || string(data) != "%PDF-1.4\n" {
+		t.Fatalf("download = %d %q", resp.StatusCode, data)
+	}
+
+	// one uploaded here but not pushed yet stays when the file goes in Gmail
+	var notes Attachment
+	if status := owner.upload(draftID, "notes.txt", []byte("bring snacks"), &notes); status != http.StatusCreated {
+		t.Fatalf("upload = %d", status)
+	}
+	ts.fake.SetDraft(draftID, []byte(testDraft))
+	ts.stores.checkMailbox(ts.fake.UserID)
+
+	mail, _ = ts.stores.Drafts.Get(draftID)
+	if len(mail.Attachments) != 1 || mail.Attachments[0].ID != notes.ID {
+		t.Fatalf("attachments = %+v, want only %s", mail.Attachments, notes.ID)
+	}
+	if _, err := ts.stores.Blobs.Open(menu.ID); err == nil {
+		t.Fatal("data of an attachment removed in Gmail is still kept")
+	}
+}
+
+func TestOwnPushIsNotAnExternalChange(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	before, _ := ts.stores.Drafts.Get(draftID)
+
+	edit := editRequest{BaseRevision: 1, Ops: []Op{{Type: opInsert, Pos: len("See you at noon"), Text: " tomorrow"}}}
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID, edit, nil); status != http.StatusOK {
+		t.Fatalf("edit = %d", status)
+	}
+	ts.syncQueued()
+
+	// the mailbox is checked after Gmail took the push but before it was
+	// recorded
+	updateDraft(ts.stores.Drafts, draftID, func(mail *Email) error {
+		mail.Sync.MessageID = before.Sync.MessageID
+		mail.Sync.Revisions = before.Sync.Revisions
+		return nil
+	})
+	ts.stores.checkMailbox(ts.fake.UserID)
+
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	if mail.Content != "See you at noon tomorrow" || mail.Revision != 2 {
+		t.Fatalf("body = %q at revision %d, want the pushed one at 2", mail.Content, mail.Revision)
+	}
+}
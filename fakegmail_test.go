@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	googleOauth "google.golang.org/api/oauth2/v2"
+)
+
+const (
+	fakeGmailPrefix = "/gmail/v1/users/me/"
+	fakeAuthPath    = "/o/oauth2/auth"
+	fakeTokenPath   = "/o/oauth2/token"
+	fakeRevokePath  = "/o/oauth2/revoke"
+	fakeUserinfo    = "/oauth2/v2/userinfo"
+)
+
+// fakeGmail is an in-process stand-in for Google's OAuth and Gmail APIs
+// holding a single mailbox, so the server can be driven from sign-in to send
+// without the network. It speaks the same HTTP as Google, so the real
+// clients are what talk to it.
+type fakeGmail struct {
+	UserID string
+	Email  string
+
+	server *httptest.Server
+
+	mu        sync.Mutex
+	lastID    int
+	historyID uint64
+	// oldestHistory is the oldest history ID the mailbox still has records
+	// from
+	oldestHistory uint64
+	// draftChanges are the history IDs at which a draft changed
+	draftChanges []uint64
+	drafts       map[string]*gmail.Message
+	messages     []*gmail.Message
+	// challenges are the PKCE code challenges codes were handed out for
+	challenges map[string]string
+	revoked    []string
+	// sendFailures are how the next sends fail: a 503 after or before the
+	// draft went out
+	sendFailures []bool
+	// rotateTokens makes refreshes hand out a new refresh token and an
+	// access token already due for a refresh
+	rotateTokens bool
+}
+
+// newFakeGmail starts a fake Gmail holding the mailbox of a user
+func newFakeGmail(userID, email string) *fakeGmail {
+	f := &fakeGmail{
+		UserID:        userID,
+		Email:         email,
+		historyID:     1,
+		oldestHistory: 1,
+		drafts:        make(map[string]*gmail.Message),
+		challenges:    make(map[string]string),
+	}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// Close stops the fake
+func (f *fakeGmail) Close() {
+	f.server.Close()
+}
+
+// use points the OAuth config and the Google clients at the fake and
+// returns a func that points them back
+func (f *fakeGmail) use() func() {
+	endpoint, gmailPath, userinfoPath, revokeURL := oauthCfg.Endpoint, gmailBasePath, userinfoBasePath, googleRevokeURL
+	oauthCfg.Endpoint = oauth2.Endpoint{
+		AuthURL:  f.server.URL + fakeAuthPath,
+		TokenURL: f.server.URL + fakeTokenPath,
+	}
+	gmailBasePath = f.server.URL + "/gmail/v1/users/"
+	userinfoBasePath = f.server.URL + "/"
+	googleRevokeURL = f.server.URL + fakeRevokePath
+	return func() {
+		oauthCfg.Endpoint = endpoint
+		gmailBasePath = gmailPath
+		userinfoBasePath = userinfoPath
+		googleRevokeURL = revokeURL
+	}
+}
+
+// AddDraft creates a draft holding raw, as if written in Gmail, and returns
+// its ID
+func (f *fakeGmail) AddDraft(raw []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	draftID := "r" + f.newID()
+	f.drafts[draftID] = f.newMessage(raw, "")
+	return draftID
+}
+
+// SetDraft replaces the message of a draft, as if edited in Gmail
+func (f *fakeGmail) SetDraft(draftID string, raw []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if old, ok := f.drafts[draftID]; ok {
+		f.drafts[draftID] = f.newMessage(raw, old.ThreadId)
+	}
+}
+
+// DeleteDraft deletes a draft, as if discarded in Gmail
+func (f *fakeGmail) DeleteDraft(draftID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.drafts[draftID]; ok {
+		delete(f.drafts, draftID)
+		f.changeDrafts()
+	}
+}
+
+// Draft returns the raw message a draft holds
+func (f *fakeGmail) Draft(draftID string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.drafts[draftID]
+	if !ok {
+		return nil, false
+	}
+	raw, _ := decodeRaw(msg.Raw)
+	return raw, true
+}
+
+// FailNextSend makes the next send answer with a 503, after sending the
+// draft if delivered is set, the way a send can fail without telling
+// whether it went out
+func (f *fakeGmail) FailNextSend(delivered bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sendFailures = append(f.sendFailures, delivered)
+}
+
+// Sent returns the raw messages sent from the mailbox, oldest first
+func (f *fakeGmail) Sent() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sent := [][]byte{}
+	for _, msg := range f.messages {
+		if containsString(msg.LabelIds, "SENT") {
+			raw, _ := decodeRaw(msg.Raw)
+			sent = append(sent, raw)
+		}
+	}
+	return sent
+}
+
+// ForgetHistory drops the history records of the mailbox, as Gmail does
+// with old ones
+func (f *fakeGmail) ForgetHistory() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.oldestHistory = f.historyID
+	f.draftChanges = nil
+}
+
+func (f *fakeGmail) newID() string {
+	f.lastID++
+	return fmt.Sprintf("%016x", f.lastID)
+}
+
+// newMessage stores raw as a new draft message, recording the change in the
+// history
+func (f *fakeGmail) newMessage(raw []byte, threadID string) *gmail.Message {
+	id := f.newID()
+	if threadID == "" {
+		threadID = id
+	}
+	msg := &gmail.Message{
+		Id:       id,
+		ThreadId: threadID,
+		LabelIds: []string{draftLabel},
+		Raw:      encodeRaw(raw),
+	}
+	f.messages = append(f.messages, msg)
+	f.changeDrafts()
+	return msg
+}
+
+func (f *fakeGmail) changeDrafts() {
+	f.historyID++
+	f.draftChanges = append(f.draftChanges, f.historyID)
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == fakeAuthPath:
+		f.authorize(w, r)
+	case r.URL.Path == fakeTokenPath:
+		f.token(w, r)
+	case r.URL.Path == fakeRevokePath:
+		f.revoke(w, r)
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+		fakeError(w, http.StatusUnauthorized, "Login Required")
+	case r.URL.Path == fakeUserinfo:
+		fakeReply(w, &googleOauth.Userinfoplus{Id: f.UserID, Email: f.Email})
+	case strings.HasPrefix(r.URL.Path, fakeGmailPrefix):
+		f.serveMailbox(w, r, strings.TrimPrefix(r.URL.Path, fakeGmailPrefix))
+	default:
+		fakeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// authorize consents right away and sends the browser back with a code
+func (f *fakeGmail) authorize(w http.ResponseWriter, r *http.Request) {
+	back, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "bad redirect_uri")
+		return
+	}
+	code := "fake-code-" + f.newID()
+	if challenge := r.FormValue("code_challenge"); challenge != "" {
+		f.challenges[code] = challenge
+	}
+	q := back.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	back.RawQuery = q.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token hands out a token for any code or refresh token, checking the code
+// verifier of codes handed out with a PKCE challenge
+func (f *fakeGmail) token(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	if code == "" && r.FormValue("refresh_token") == "" {
+		fakeError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	challenge, ok := f.challenges[code]
+	delete(f.challenges, code)
+	if ok && pkceChallenge(r.FormValue("code_verifier")) != challenge {
+		fakeError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	refresh, expiresIn := "fake-refresh-"+f.UserID, 3600
+	if f.rotateTokens && code == "" {
+		refresh, expiresIn = refresh+"-"+f.newID(), 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "fake-access-" + f.newID(),
+		"token_type":    "Bearer",
+		"refresh_token": refresh,
+		"expires_in":    expiresIn,
+	})
+}
+
+// RotateTokens makes every refresh hand out a new refresh token, as Google
+// may, and an access token that is refreshed again on its next use
+func (f *fakeGmail) RotateTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotateTokens = true
+}
+
+// revoke records the token revoked
+func (f *fakeGmail) revoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_token"})
+		return
+	}
+	f.revoked = append(f.revoked, token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Revoked lists the tokens revoked so far
+func (f *fakeGmail) Revoked() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.revoked...)
+}
+
+func (f *fakeGmail) serveMailbox(w http.ResponseWriter, r *http.Request, path string) {
+	switch {
+	case path == "messages" && r.Method == "GET":
+		resp := &gmail.ListMessagesResponse{}
+		for _, msg := range f.messages {
+			resp.Messages = append(resp.Messages, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+		}
+		fakeReply(w, resp)
+	case strings.HasPrefix(path, "messages/") && r.Method == "GET":
+		f.getMessage(w, strings.TrimPrefix(path, "messages/"))
+	case path == "profile" && r.Method == "GET":
+		fakeReply(w, &gmail.Profile{EmailAddress: f.Email, HistoryId: f.historyID})
+	case path == "history" && r.Method == "GET":
+		f.listHistory(w, r)
+	case path == "drafts/send" && r.Method == "POST":
+		f.sendDraft(w, r)
+	case strings.HasPrefix(path, "drafts/") && r.Method == "GET":
+		f.getDraft(w, r, strings.TrimPrefix(path, "drafts/"))
+	case strings.HasPrefix(path, "drafts/") && r.Method == "PUT":
+		f.updateDraft(w, r, strings.TrimPrefix(path, "drafts/"))
+	case strings.HasPrefix(path, "drafts/") && r.Method == "DELETE":
+		f.deleteDraft(w, strings.TrimPrefix(path, "drafts/"))
+	default:
+		fakeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (f *fakeGmail) listHistory(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.FormValue("startHistoryId"), 10, 64)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Invalid startHistoryId")
+		return
+	}
+	if start < f.oldestHistory {
+		fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+
+	resp := &gmail.ListHistoryResponse{HistoryId: f.historyID}
+	for _, id := range f.draftChanges {
+		if id > start {
+			resp.History = append(resp.History, &gmail.History{Id: id})
+		}
+	}
+	fakeReply(w, resp)
+}
+
+func (f *fakeGmail) getDraft(w http.ResponseWriter, r *http.Request, draftID string) {
+	msg, ok := f.drafts[draftID]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	out := &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: msg.LabelIds}
+	if r.FormValue("format") == "raw" {
+		out.Raw = msg.Raw
+	}
+	fakeReply(w, &gmail.Draft{Id: draftID, Message: out})
+}
+
+func (f *fakeGmail) updateDraft(w http.ResponseWriter, r *http.Request, draftID string) {
+	old, ok := f.drafts[draftID]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	var draft gmail.Draft
+	err := json.NewDecoder(r.Body).Decode(&draft)
+	if err != nil || draft.Message == nil {
+		fakeError(w, http.StatusBadRequest, "Invalid draft")
+		return
+	}
+	raw, err := decodeRaw(draft.Message.Raw)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Invalid raw message")
+		return
+	}
+
+	msg := f.newMessage(raw, old.ThreadId)
+	f.drafts[draftID] = msg
+	fakeReply(w, &gmail.Draft{Id: draftID, Message: &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId}})
+}
+
+func (f *fakeGmail) deleteDraft(w http.ResponseWriter, draftID string) {
+	if _, ok := f.drafts[draftID]; !ok {
+		fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	delete(f.drafts, draftID)
+	f.changeDrafts()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGmail) sendDraft(w http.ResponseWriter, r *http.Request) {
+	var draft gmail.Draft
+	err := json.NewDecoder(r.Body).Decode(&draft)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "Invalid draft")
+		return
+	}
+	msg, ok := f.drafts[draft.Id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+
+	failed, delivered := false, true
+	if len(f.sendFailures) > 0 {
+		failed, delivered = true, f.sendFailures[0]
+		f.sendFailures = f.sendFailures[1:]
+	}
+	if delivered {
+		delete(f.drafts, draft.Id)
+		f.changeDrafts()
+		msg.LabelIds = []string{"SENT"}
+	}
+	if failed {
+		fakeError(w, http.StatusServiceUnavailable, "Backend Error")
+		return
+	}
+	fakeReply(w, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: msg.LabelIds})
+}
+
+// getMessage finds a message that was sent or is held by a draft. Gmail
+// deletes the others along with their draft.
+func (f *fakeGmail) getMessage(w http.ResponseWriter, messageID string) {
+	found := []*gmail.Message{}
+	for _, msg := range f.drafts {
+		found = append(found, msg)
+	}
+	for _, msg := range f.messages {
+		if containsString(msg.LabelIds, "SENT") {
+			found = append(found, msg)
+		}
+	}
+	for _, msg := range found {
+		if msg.Id == messageID {
+			fakeReply(w, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: msg.LabelIds})
+			return
+		}
+	}
+	fakeError(w, http.StatusNotFound, "Requested entity was not found.")
+}
+
+func fakeReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fakeError answers the way Google's APIs report errors
+func fakeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	fieldBody    = "body"
+	fieldSubject = "subject"
+	fieldTo      = "to"
+	fieldCc      = "cc"
+	fieldBcc     = "bcc"
+)
+
+// recipientHeaders maps the recipient fields to the header they sync to
+var recipientHeaders = map[string]string{
+	fieldTo:  "To",
+	fieldCc:  "Cc",
+	fieldBcc: "Bcc",
+}
+
+// TextField is a header collaborators edit with the same operations as the
+// body, with its own revisions.
+type TextField struct {
+	Content  string `bson:"content" json:"content"`
+	Revision int    `bson:"revision" json:"revision"`
+	Edits    []Edit `bson:"edits" json:"edits"`
+}
+
+// RecipientField is a list of addresses. Adding and removing addresses
+// commute, so concurrent changes never need rebasing: each one is applied to
+// whatever list is current, and the last change to an address wins.
+type RecipientField struct {
+	Addresses []string        `bson:"addresses" json:"addresses"`
+	Revision  int             `bson:"revision" json:"revision"`
+	Edits     []RecipientEdit `bson:"edits" json:"edits"`
+}
+
+// RecipientEdit is one accepted change to a recipient list.
+type RecipientEdit struct {
+	Editor    string    `bson:"editor" json:"editor"`
+	Revision  int       `bson:"revision" json:"revision"`
+	Add       []string  `bson:"add,omitempty" json:"add,omitempty"`
+	Remove    []string  `bson:"remove,omitempty" json:"remove,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	External  bool      `bson:"external,omitempty" json:"external,omitempty"`
+}
+
+type recipientRequest struct {
+	Field  string   `json:"field"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type recipientsResponse struct {
+	To  *RecipientField `json:"to"`
+	Cc  *RecipientField `json:"cc"`
+	Bcc *RecipientField `json:"bcc"`
+}
+
+// textField returns the current state of a text field of mail
+func (m *Email) textField(field string) (TextField, bool) {
+	switch field {
+	case fieldBody:
+		return TextField{Content: m.Content, Revision: m.Revision, Edits: m.Edits}, true
+	case fieldSubject:
+		return m.Subject, true
+	}
+	return TextField{}, false
+}
+
+// setTextField replaces a text field of mail
+func (m *Email) setTextField(field string, text TextField) {
+	switch field {
+	case fieldBody:
+		m.Content, m.Revision, m.Edits = text.Content, text.Revision, text.Edits
+	case fieldSubject:
+		m.Subject = text
+	}
+}
+
+// recipientField returns a recipient list of mail
+func (m *Email) recipientField(field string) *RecipientField {
+	switch field {
+	case fieldTo:
+		return &m.To
+	case fieldCc:
+		return &m.Cc
+	case fieldBcc:
+		return &m.Bcc
+	}
+	return nil
+}
+
+// headerValue returns the first value of a header in msg
+func (msg *MIMEMessage) headerValue(name string) string {
+	for _, h := range msg.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// setHeader replaces every value of a header in msg, dropping it if value is
+// empty and adding it at the end if it wasn't there
+func (msg *MIMEMessage) setHeader(name, value string) {
+	headers := msg.Headers[:0:0]
+	found := false
+	for _, h := range msg.Headers {
+		if h.Name != name {
+			headers = append(headers, h)
+		} else if !found && value != "" {
+			headers = append(headers, Header{Name: name, Value: value})
+			found = true
+		}
+	}
+	if !found && value != "" {
+		headers = append(headers, Header{Name: name, Value: value})
+	}
+	msg.Headers = headers
+}
+
+// parseAddresses splits a header into normalised addresses, keeping unparsable
+// entries as they are
+func parseAddresses(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return []string{}
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil {
+		var out []string
+		for _, a := range strings.Split(value, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				out = append(out, a)
+			}
+		}
+		return out
+	}
+
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
+
+// addressKey is what makes two recipients the same, ignoring display names
+func addressKey(recipient string) string {
+	a, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(recipient))
+	}
+	return strings.ToLower(a.Address)
+}
+
+// initialFields sets up the header fields of a new draft from its message
+func initialFields(mail *Email, editor string) {
+	now := time.Now()
+	subject := mail.Message.headerValue("Subject")
+	mail.Subject = TextField{
+		Content:  subject,
+		Revision: 1,
+		Edits: []Edit{{
+			Editor:    editor,
+			Revision:  1,
+			Ops:       []Op{{Type: opInsert, Pos: 0, Text: subject}},
+			Content:   subject,
+			CreatedAt: now,
+		}},
+	}
+
+	for field, header := range recipientHeaders {
+		addrs := parseAddresses(mail.Message.headerValue(header))
+		*mail.recipientField(field) = RecipientField{
+			Addresses: addrs,
+			Revision:  1,
+			Edits: []RecipientEdit{{
+				Editor:    editor,
+				Revision:  1,
+				Add:       addrs,
+				CreatedAt: now,
+			}},
+		}
+	}
+}
+
+// mergedMessage returns the message of mail with the collaboratively edited
+// body and headers written into it
+func mergedMessage(mail *Email) MIMEMessage {
+	msg := mail.Message
+	msg.Headers = append([]Header(nil), msg.Headers...)
+
+	if msg.Text != mail.Content {
+		msg.Text = mail.Content
+		if msg.HTML != "" {
+			// the HTML body no longer matches, so render it from the text
+			msg.HTML = htmlFromText(mail.Content)
+		}
+	}
+
+	msg.setHeader("Subject", mail.Subject.Content)
+	for field, header := range recipientHeaders {
+		msg.setHeader(header, strings.Join(mail.recipientField(field).Addresses, ", "))
+	}
+	return msg
+}
+
+// applyRecipientEdit adds and removes addresses on a recipient list. Like
+// applyEdit it starts over if the draft is saved concurrently.
+func (st *Stores) applyRecipientEdit(draftID, field string, change RecipientEdit) (*RecipientEdit, error) {
+	var edit RecipientEdit
+	_, err := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		current := mail.recipientField(field)
+		if current == nil {
+			return fmt.Errorf("unknown field %q", field)
+		}
+
+		edit = change
+		edit.Revision = current.Revision + 1
+		edit.CreatedAt = time.Now()
+		current.Addresses = mergeRecipients(current.Addresses, change.Add, change.Remove)
+		current.Revision = edit.Revision
+		current.Edits = append(current.Edits, edit)
+		mail.Approval.Approvals = []Approval{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &edit, nil
+}
+
+// acceptRecipientEdit applies change to a recipient list of a draft, queues
+// the result for Gmail and broadcasts it to the draft's viewers.
+func (st *Stores) acceptRecipientEdit(draftID, field string, change RecipientEdit) (*RecipientEdit, error) {
+	edit, err := st.applyRecipientEdit(draftID, field, change)
+	if err != nil {
+		return nil, err
+	}
+
+	st.queueSync(draftID)
+	publishDraftEvent(draftEvent{
+		Type:       eventEdit,
+		DraftID:    draftID,
+		User:       edit.Editor,
+		Field:      field,
+		Recipients: edit,
+	})
+	return edit, nil
+}
+
+// recipientsAt replays the edits of a recipient list up to revision
+func recipientsAt(list *RecipientField, revision int) []string {
+	addresses := []string{}
+	for _, e := range list.Edits {
+		if e.Revision > revision {
+			break
+		}
+		addresses = mergeRecipients(addresses, e.Add, e.Remove)
+	}
+	return addresses
+}
+
+// mergeRecipients adds and removes addresses on a list, dropping duplicates.
+// An address both added and removed stays.
+func mergeRecipients(addresses, add, remove []string) []string {
+	removed := make(map[string]bool)
+	for _, a := range remove {
+		removed[addressKey(a)] = true
+	}
+	out := []string{}
+	seen := make(map[string]bool)
+	for _, a := range append(append([]string(nil), addresses...), add...) {
+		key := addressKey(a)
+		if seen[key] || (removed[key] && !containsAddress(add, key)) {
+			continue
+		}
+		seen[key] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+func containsAddress(list []string, key string) bool {
+	for _, a := range list {
+		if addressKey(a) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectUpdate applies text ops to the subject of a draft
+func subjectUpdate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var change editRequest
+	if !readJSON(w, r, &change) {
+		return
+	}
+	// a line break would end the Subject header and start another
+	for _, op := range change.Ops {
+		if strings.ContainsAny(op.Text, "\r\n") {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "The subject can't contain line breaks")
+			return
+		}
+	}
+
+	commitEdit(w, r, p.ByName(draftIDParam), fieldSubject, Edit{
+		Editor:       requestUser(r),
+		BaseRevision: change.BaseRevision,
+		Ops:          change.Ops,
+	})
+}
+
+// listRecipients returns the To, Cc and Bcc lists of a draft with their
+// histories
+func listRecipients(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	writeJSON(w, http.StatusOK, &recipientsResponse{To: &mail.To, Cc: &mail.Cc, Bcc: &mail.Bcc})
+}
+
+// recipientsUpdate adds and removes addresses on the To, Cc or Bcc list of a
+// draft
+func recipientsUpdate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	draftID := p.ByName(draftIDParam)
+
+	var req recipientRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if _, ok := recipientHeaders[req.Field]; !ok {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Field must be one of %s, %s or %s", fieldTo, fieldCc, fieldBcc)
+		return
+	}
+	for _, a := range append(req.Add, req.Remove...) {
+		if _, err := mail.ParseAddress(a); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid address %q => {%s}", a, err)
+			return
+		}
+	}
+
+	edit, err := requestStores(r).acceptRecipientEdit(draftID, req.Field, RecipientEdit{
+		Editor: requestUser(r),
+		Add:    req.Add,
+		Remove: req.Remove,
+	})
+	if err == errEditContention {
+		writeError(w, r, http.StatusConflict, codeConflict, "Failed to apply edit => {%s}", err)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to apply edit", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, edit)
+}
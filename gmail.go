@@ -1,63 +1,261 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 )
 
-func listEmails(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	client := makeClient(r)
-	if client == nil {
-		fmt.Fprintf(w, "Error while creating oauth2 client")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// gmailBasePath points the Gmail client at another server, such as a fake
+// one in tests. Empty means the real API.
+var gmailBasePath string
+
+// errGmailNotFound is returned by a Gmail when the draft or history asked for
+// doesn't exist (anymore).
+var errGmailNotFound = errors.New("not found in Gmail")
+
+// Gmail is the part of a user's mailbox the server works with.
+type Gmail interface {
+	// ListMessages returns the IDs of the messages in the mailbox
+	ListMessages() ([]string, error)
+
+	// GetDraft returns the message a draft holds, with its raw RFC 2822 form
+	GetDraft(draftID string) (*GmailMessage, error)
+
+	// DraftMessageID returns the ID of the message a draft holds, which
+	// changes every time the draft is updated
+	DraftMessageID(draftID string) (string, error)
+
+	// UpdateDraft replaces the message of a draft and returns the ID of the
+	// message now holding it
+	UpdateDraft(draftID string, raw []byte) (string, error)
+
+	// DeleteDraft deletes a draft for good
+	DeleteDraft(draftID string) error
+
+	// SendDraft sends a draft and returns the message it became
+	SendDraft(draftID string) (*GmailMessage, error)
+
+	// GetMessage returns a message of the mailbox, without its raw form
+	GetMessage(messageID string) (*GmailMessage, error)
+
+	// HistoryID returns the current history ID of the mailbox
+	HistoryID() (uint64, error)
+
+	// DraftsChangedSince reports whether any draft changed after historyID,
+	// and the history ID to read from next time
+	DraftsChangedSince(historyID uint64) (bool, uint64, error)
+}
+
+// GmailMessage is a Gmail message. Raw is only set where it was fetched.
+type GmailMessage struct {
+	ID       string
+	ThreadID string
+	Raw      []byte
+}
+
+// gmailForUser returns the mailbox of a user, using their stored token
+func (st *Stores) gmailForUser(userID string) (Gmail, error) {
+	client, err := st.clientForUser(userID)
+	if err != nil {
+		return nil, err
 	}
+	return newAPIGmail(client)
+}
 
+// gmailForSession returns the mailbox of the user signed in to the session
+// of r
+func gmailForSession(r *http.Request) (Gmail, error) {
+	session, err := store.Get(r, sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find session => {%s}", err)
+	}
+	userID, ok := session.Values[userIDKey].(string)
+	if !ok {
+		return nil, fmt.Errorf("No user id in session")
+	}
+	return requestStores(r).gmailForUser(userID)
+}
+
+// newGmailService creates a Gmail client making its calls with client
+func newGmailService(client *http.Client) (*gmail.Service, error) {
 	gservice, err := gmail.New(client)
 	if err != nil {
-		log.Fatalf("Failed to create new gmail service => %s", err.Error())
+		return nil, err
 	}
+	if gmailBasePath != "" {
+		gservice.BasePath = gmailBasePath
+	}
+	return gservice, nil
+}
 
-	call := gservice.Users.Messages.List("me")
-	resp, err := call.Do()
+// apiGmail is a Gmail reached through the Gmail API.
+type apiGmail struct {
+	service *gmail.Service
+	drafts  *gmail.UsersDraftsService
+}
+
+func newAPIGmail(client *http.Client) (*apiGmail, error) {
+	gservice, err := newGmailService(client)
 	if err != nil {
-		log.Fatalf("Failed to query gmail for email list => %s", err.Error())
+		return nil, fmt.Errorf("Failed to create new gmail service => {%s}", err)
 	}
+	return &apiGmail{service: gservice, drafts: gmail.NewUsersDraftsService(gservice)}, nil
+}
 
-	fmt.Fprintf(w, "<h1>emails</h1>")
+// apiError turns a 404 from the Gmail API into errGmailNotFound and keeps
+// any other error as is
+func apiError(err error) error {
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return errGmailNotFound
+	}
+	return err
+}
+
+func (g *apiGmail) ListMessages() ([]string, error) {
+	resp, err := g.service.Users.Messages.List("me").Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	ids := make([]string, 0, len(resp.Messages))
 	for _, m := range resp.Messages {
-		fmt.Fprintf(w, m.Id+"<br>")
+		ids = append(ids, m.Id)
 	}
+	return ids, nil
 }
 
-func getDraft(r *http.Request, draftID string) (string, error) {
-	client := makeClient(r)
-	if client == nil {
-		return "", fmt.Errorf("Error while creating oauth2 client")
+func (g *apiGmail) GetDraft(draftID string) (*GmailMessage, error) {
+	// the raw format is needed, otherwise Message.Raw comes back empty
+	draft, err := g.drafts.Get("me", draftID).Format("raw").Do()
+	if err != nil {
+		return nil, apiError(err)
 	}
+	if draft.Message == nil {
+		return nil, fmt.Errorf("Draft %s has no message", draftID)
+	}
+	raw, err := decodeRaw(draft.Message.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode raw draft => {%s}", err)
+	}
+	return &GmailMessage{ID: draft.Message.Id, ThreadID: draft.Message.ThreadId, Raw: raw}, nil
+}
 
-	gservice, err := gmail.New(client)
+func (g *apiGmail) DraftMessageID(draftID string) (string, error) {
+	draft, err := g.drafts.Get("me", draftID).Format("minimal").Do()
+	if err != nil {
+		return "", apiError(err)
+	}
+	if draft.Message == nil {
+		return "", nil
+	}
+	return draft.Message.Id, nil
+}
+
+func (g *apiGmail) UpdateDraft(draftID string, raw []byte) (string, error) {
+	draft, err := g.drafts.Update("me", draftID, &gmail.Draft{
+		Id:      draftID,
+		Message: &gmail.Message{Raw: encodeRaw(raw)},
+	}).Do()
+	if err != nil {
+		return "", apiError(err)
+	}
+	if draft.Message == nil {
+		return "", nil
+	}
+	return draft.Message.Id, nil
+}
+
+func (g *apiGmail) DeleteDraft(draftID string) error {
+	return apiError(g.drafts.Delete("me", draftID).Do())
+}
+
+func (g *apiGmail) SendDraft(draftID string) (*GmailMessage, error) {
+	msg, err := g.drafts.Send("me", &gmail.Draft{Id: draftID}).Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return &GmailMessage{ID: msg.Id, ThreadID: msg.ThreadId}, nil
+}
+
+func (g *apiGmail) GetMessage(messageID string) (*GmailMessage, error) {
+	msg, err := g.service.Users.Messages.Get("me", messageID).Format("minimal").Do()
+	if err != nil {
+		return nil, apiError(err)
+	}
+	return &GmailMessage{ID: msg.Id, ThreadID: msg.ThreadId}, nil
+}
+
+func (g *apiGmail) HistoryID() (uint64, error) {
+	profile, err := g.service.Users.GetProfile("me").Do()
 	if err != nil {
-		log.Fatalf("Failed to create new gmail service => %s", err.Error())
+		return 0, apiError(err)
+	}
+	return profile.HistoryId, nil
+}
+
+func (g *apiGmail) DraftsChangedSince(historyID uint64) (bool, uint64, error) {
+	changed := false
+	next := historyID
+	call := g.service.Users.History.List("me").StartHistoryId(historyID).LabelId(draftLabel)
+	for {
+		resp, err := call.Do()
+		if err != nil {
+			return false, 0, apiError(err)
+		}
+		if len(resp.History) > 0 {
+			changed = true
+		}
+		if resp.HistoryId > next {
+			next = resp.HistoryId
+		}
+		if resp.NextPageToken == "" {
+			return changed, next, nil
+		}
+		call.PageToken(resp.NextPageToken)
 	}
+}
 
-	// grab session reference
-	s, err := store.Get(r, sessionKey)
+func listEmails(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	gm, err := gmailForSession(r)
 	if err != nil {
-		return "", fmt.Errorf("Failed to access the session => {%s}", err)
+		log.Printf("listEmails: %s", err)
+		http.Error(w, "Error while creating oauth2 client", http.StatusBadRequest)
+		return
 	}
 
-	uds := gmail.NewUsersDraftsService(gservice)
-	// TODO: print out all ID's to see if it even has the same shape?
+	ids, err := gm.ListMessages()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query gmail for email list => {%s}", err), http.StatusBadGateway)
+		return
+	}
+
+	fmt.Fprintf(w, "<h1>emails</h1>")
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s<br>", id)
+	}
+}
 
-	draft, err := uds.Get(s.Values[userIDKey].(string), draftID).Do()
+// getDraft fetches a Gmail draft of a user as a parsed message, along with
+// the ID of the message holding it
+func (st *Stores) getDraft(userID, draftID string) (*MIMEMessage, string, error) {
+	gm, err := st.gmailForUser(userID)
 	if err != nil {
-		return "", fmt.Errorf("Failed to access draft => {%s}", err)
+		return nil, "", err
 	}
 
-	return draft.Message.Raw, nil
+	// the error keeps its type so callers can tell a missing draft apart
+	draft, err := gm.GetDraft(draftID)
+	if err != nil {
+		return nil, "", err
+	}
+	msg, err := parseMessage(draft.Raw)
+	if err != nil {
+		return nil, "", err
+	}
+	return msg, draft.ID, nil
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// revisionSummary describes one Edit in the history of a draft.
+type revisionSummary struct {
+	Revision     int       `json:"revision"`
+	Editor       string    `json:"editor"`
+	CreatedAt    time.Time `json:"created_at"`
+	Size         int       `json:"size"`
+	RestoredFrom int       `json:"restored_from,omitempty"`
+}
+
+type diffResponse struct {
+	From     int           `json:"from"`
+	To       int           `json:"to"`
+	Segments []diffSegment `json:"segments"`
+}
+
+type restoreRequest struct {
+	Revision int `json:"revision"`
+}
+
+// snapshot tells whether the document e produced is stored with it, which
+// it is every snapshotInterval revisions starting with the first
+func (e *Edit) snapshot() bool {
+	return e.Revision%snapshotInterval == 1
+}
+
+// replay calls fn with the Edits of a text field from the one at index
+// from, which must be a snapshot, up to revision, and the document each of
+// them produced
+func replay(text TextField, from, revision int, fn func(e *Edit, content string)) error {
+	content := ""
+	for i := from; i < len(text.Edits) && text.Edits[i].Revision <= revision; i++ {
+		e := &text.Edits[i]
+		if e.snapshot() {
+			content = e.Content
+		} else {
+			var err error
+			content, err = applyOps(content, e.Ops)
+			if err != nil {
+				return fmt.Errorf("revision %d => {%s}", e.Revision, err)
+			}
+		}
+		fn(e, content)
+	}
+	return nil
+}
+
+// lastSnapshot returns the index of the last snapshot of a text field at or
+// before revision, or -1 if there is none
+func lastSnapshot(text TextField, revision int) int {
+	from := -1
+	for i := range text.Edits {
+		if text.Edits[i].Revision > revision {
+			break
+		}
+		if text.Edits[i].snapshot() {
+			from = i
+		}
+	}
+	return from
+}
+
+// findRevision returns the Edit of a text field with the given revision
+// number, with the document it produced rebuilt from the last snapshot
+// before it. It returns nil if there is no such revision.
+func findRevision(text TextField, revision int) (*Edit, error) {
+	from := lastSnapshot(text, revision)
+	if from < 0 {
+		return nil, nil
+	}
+
+	var found *Edit
+	err := replay(text, from, revision, func(e *Edit, content string) {
+		if e.Revision == revision {
+			edit := *e
+			edit.Content = content
+			found = &edit
+		}
+	})
+	return found, err
+}
+
+// requestTextField returns the text field named by the field query
+// parameter, the body if there is none
+func requestTextField(w http.ResponseWriter, r *http.Request, mail *Email) (TextField, bool) {
+	field := r.FormValue("field")
+	if field == "" {
+		field = fieldBody
+	}
+	text, ok := mail.textField(field)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Field must be one of %s or %s", fieldBody, fieldSubject)
+	}
+	return text, ok
+}
+
+// draftHistory lists the revisions of the body of a draft, or of the text
+// field named by the field query parameter, oldest first. Size is the length
+// of the document in characters after that revision.
+func draftHistory(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	text, ok := requestTextField(w, r, mail)
+	if !ok {
+		return
+	}
+
+	history := make([]revisionSummary, 0, len(text.Edits))
+	err := replay(text, 0, text.Revision, func(e *Edit, content string) {
+		history = append(history, revisionSummary{
+			Revision:     e.Revision,
+			Editor:       e.Editor,
+			CreatedAt:    e.CreatedAt,
+			Size:         utf8.RuneCountInString(content),
+			RestoredFrom: e.RestoredFrom,
+		})
+	})
+	if err != nil {
+		internalError(w, r, "Failed to rebuild draft history", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// draftDiff compares two revisions of a text field of a draft, given as the
+// from and to query parameters. to defaults to the current revision. With
+// format=unified a line based unified diff is returned as text, otherwise a
+// word level diff as JSON segments.
+func draftDiff(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	text, ok := requestTextField(w, r, mail)
+	if !ok {
+		return
+	}
+
+	from, err := strconv.Atoi(r.FormValue("from"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid from revision => {%s}", err)
+		return
+	}
+	to := text.Revision
+	if v := r.FormValue("to"); v != "" {
+		to, err = strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid to revision => {%s}", err)
+			return
+		}
+	}
+
+	a, err := findRevision(text, from)
+	if err != nil {
+		internalError(w, r, "Failed to rebuild draft revision", err)
+		return
+	}
+	b, err := findRevision(text, to)
+	if err != nil {
+		internalError(w, r, "Failed to rebuild draft revision", err)
+		return
+	}
+	if a == nil || b == nil {
+		missing := from
+		if a != nil {
+			missing = to
+		}
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Draft %s has no revision %d", mail.DraftID, missing)
+		return
+	}
+
+	if r.FormValue("format") == "unified" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, unifiedDiff(
+			fmt.Sprintf("revision %d", from),
+			fmt.Sprintf("revision %d", to),
+			a.Content, b.Content))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &diffResponse{
+		From:     from,
+		To:       to,
+		Segments: wordDiff(a.Content, b.Content),
+	})
+}
+
+// draftRestore brings back the content of an old revision of a text field
+// as a new Edit, so the history in between is kept.
+func draftRestore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	text, ok := requestTextField(w, r, mail)
+	if !ok {
+		return
+	}
+
+	var req restoreRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	old, err := findRevision(text, req.Revision)
+	if err != nil {
+		internalError(w, r, "Failed to rebuild draft revision", err)
+		return
+	} else if old == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Draft %s has no revision %d", mail.DraftID, req.Revision)
+		return
+	}
+
+	// replace the whole document as it is at the revision we loaded
+	var ops []Op
+	if n := utf8.RuneCountInString(text.Content); n > 0 {
+		ops = append(ops, Op{Type: opDelete, Pos: 0, Count: n})
+	}
+	if old.Content != "" {
+		ops = append(ops, Op{Type: opInsert, Pos: 0, Text: old.Content})
+	}
+
+	field := r.FormValue("field")
+	if field == "" {
+		field = fieldBody
+	}
+	commitEdit(w, r, mail.DraftID, field, Edit{
+		Editor:       requestUser(r),
+		BaseRevision: text.Revision,
+		Ops:          ops,
+		RestoredFrom: old.Revision,
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHistoryRebuiltFromSnapshots(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID
+
+	// texts[r] is the body at revision r, past a second snapshot
+	texts := []string{"", "See you at noon"}
+	for r := 2; r <= snapshotInterval+5; r++ {
+		prev := texts[r-1]
+		word := fmt.Sprintf(" w%d", r)
+		req := editRequest{BaseRevision: r - 1, Ops: []Op{{Type: opInsert, Pos: len(prev), Text: word}}}
+		var edit Edit
+		if status := owner.do("POST", path, req, &edit); status != http.StatusOK {
+			t.Fatalf("edit %d = %d", r, status)
+		}
+		texts = append(texts, prev+word)
+		if edit.Content != texts[r] {
+			t.Fatalf("edit %d content = %q", r, edit.Content)
+		}
+	}
+	last := len(texts) - 1
+
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	for _, e := range mail.Edits {
+		if (e.Content != "") != e.snapshot() {
+			t.Fatalf("revision %d stored content %q", e.Revision, e.Content)
+		}
+	}
+
+	var history []revisionSummary
+	if status := owner.do("GET", path+"/history", nil, &history); status != http.StatusOK {
+		t.Fatalf("history = %d", status)
+	}
+	if len(history) != last {
+		t.Fatalf("history has %d revisions, want %d", len(history), last)
+	}
+	for _, h := range history {
+		if h.Size != len(texts[h.Revision]) {
+			t.Fatalf("revision %d size = %d, want %d", h.Revision, h.Size, len(texts[h.Revision]))
+		}
+	}
+
+	tests := []struct {
+		from, to int
+	}{
+		{1, 2},
+		{2, snapshotInterval - 1},
+		{snapshotInterval, snapshotInterval + 2},
+		{snapshotInterval + 3, last},
+	}
+	for _, tt := range tests {
+		var diff diffResponse
+		if status := owner.do("GET", fmt.Sprintf("%s/diff?from=%d&to=%d", path, tt.from, tt.to), nil, &diff); status != http.StatusOK {
+			t.Fatalf("diff %d-%d = %d", tt.from, tt.to, status)
+		}
+		var from, to []string
+		for _, s := range diff.Segments {
+			if s.Op != diffInsert {
+				from = append(from, s.Text)
+			}
+			if s.Op != diffDelete {
+				to = append(to, s.Text)
+			}
+		}
+		if strings.Join(from, "") != texts[tt.from] || strings.Join(to, "") != texts[tt.to] {
+			t.Fatalf("diff %d-%d = %+v", tt.from, tt.to, diff.Segments)
+		}
+	}
+	if status := owner.do("GET", path+"/diff?from=1&to=999", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("diff to a missing revision = %d, want 404", status)
+	}
+
+	var restored Edit
+	if status := owner.do("POST", path+"/restore", restoreRequest{Revision: snapshotInterval + 2}, &restored); status != http.StatusOK {
+		t.Fatalf("restore = %d", status)
+	}
+	if restored.Content != texts[snapshotInterval+2] || restored.RestoredFrom != snapshotInterval+2 || restored.Revision != last+1 {
+		t.Fatalf("restored %+v", restored)
+	}
+	if draft := owner.getDraft(draftID); draft.Body.Content != texts[snapshotInterval+2] {
+		t.Fatalf("body after restore = %q", draft.Body.Content)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	inviteCollection = "invitations"
+	inviteIDParam    = "invite_id_param"
+
+	invitePending  = "pending"
+	inviteAccepted = "accepted"
+	inviteDeclined = "declined"
+	inviteExpired  = "expired"
+
+	// inviteTTL is how long an invitation can be accepted for
+	inviteTTL = 7 * 24 * time.Hour
+)
+
+// Invitation asks Invitee to join a draft as a collaborator.
+type Invitation struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DraftID     string        `bson:"draft_id" json:"draft_id"`
+	Inviter     string        `bson:"inviter" json:"inviter"`
+	Invitee     string        `bson:"invitee" json:"invitee"`
+	Role        string        `bson:"role" json:"role"`
+	Status      string        `bson:"status" json:"status"`
+	CreatedAt   time.Time     `bson:"created_at" json:"created_at"`
+	ExpiresAt   time.Time     `bson:"expires_at" json:"expires_at"`
+	RespondedAt time.Time     `bson:"responded_at,omitempty" json:"responded_at,omitempty"`
+}
+
+type memberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
+}
+
+// readMemberRequest decodes the membership request and normalises its email
+// address. It writes the error response itself if the caller should stop.
+func readMemberRequest(w http.ResponseWriter, r *http.Request) (*memberRequest, bool) {
+	var req memberRequest
+	if !readJSON(w, r, &req) {
+		return nil, false
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "No email address given")
+		return nil, false
+	}
+	return &req, true
+}
+
+// inviteCollaborator lets the owner of a draft invite someone to it with a
+// role, editor unless another is asked for
+func inviteCollaborator(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+	user := requestUser(r)
+	draftID := mail.DraftID
+
+	req, ok := readMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	invitee := req.Email
+	if req.Role == "" {
+		req.Role = roleEditor
+	}
+	if _, ok := roleRank[req.Role]; !ok || req.Role == roleOwner {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Role must be one of %s, %s or %s", roleEditor, roleCommenter, roleViewer)
+		return
+	}
+	if roleOf(mail, invitee) != "" {
+		writeError(w, r, http.StatusConflict, codeConflict, "%s is already a collaborator", invitee)
+		return
+	}
+
+	// reuse an outstanding invitation rather than stacking them up
+	now := time.Now()
+	invite, err := requestStores(r).Invites.Invite(&Invitation{
+		ID:        bson.NewObjectId(),
+		DraftID:   draftID,
+		Inviter:   user,
+		Invitee:   invitee,
+		Role:      req.Role,
+		CreatedAt: now,
+		ExpiresAt: now.Add(inviteTTL),
+	})
+	if err != nil {
+		internalError(w, r, "Failed to store invitation", err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// listInvitations returns the pending invitations of the current user
+func listInvitations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := requestUser(r)
+
+	invites, err := requestStores(r).Invites.ListPending(user, time.Now())
+	if err != nil {
+		internalError(w, r, "Failed to list invitations", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invites)
+}
+
+// acceptInvitation adds the invitee to the draft's collaborators with the
+// role they were invited with
+func acceptInvitation(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	invite := respondToInvitation(w, r, p, inviteAccepted)
+	if invite == nil {
+		return
+	}
+
+	role := invite.Role
+	if role == "" {
+		role = roleEditor
+	}
+	err := requestStores(r).setMemberRole(invite.DraftID, invite.Invitee, role)
+	if err != nil {
+		internalError(w, r, "Failed to add collaborator", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invite)
+}
+
+// declineInvitation turns down an invitation
+func declineInvitation(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	invite := respondToInvitation(w, r, p, inviteDeclined)
+	if invite == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invite)
+}
+
+// respondToInvitation moves a pending invitation of the current user to
+// status. Expired invitations are marked as such and refused.
+func respondToInvitation(w http.ResponseWriter, r *http.Request, p httprouter.Params, status string) *Invitation {
+	id := p.ByName(inviteIDParam)
+	if !bson.IsObjectIdHex(id) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No invitation with id %s", id)
+		return nil
+	}
+
+	user := requestUser(r)
+	st := requestStores(r)
+
+	invite, err := st.Invites.Get(bson.ObjectIdHex(id))
+	if err == mgo.ErrNotFound || (err == nil && invite.Invitee != user) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No invitation with id %s", id)
+		return nil
+	} else if err != nil {
+		internalError(w, r, "Failed to load invitation", err)
+		return nil
+	}
+
+	if invite.Status != invitePending {
+		writeError(w, r, http.StatusConflict, codeConflict, "Invitation is already %s", invite.Status)
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(invite.ExpiresAt) {
+		status = inviteExpired
+	}
+
+	// only move it if nobody else responded in the meantime
+	err = st.Invites.Respond(invite.ID, status, now)
+	if err == mgo.ErrNotFound {
+		writeError(w, r, http.StatusConflict, codeConflict, "Invitation was already answered")
+		return nil
+	} else if err != nil {
+		internalError(w, r, "Failed to update invitation", err)
+		return nil
+	}
+
+	if status == inviteExpired {
+		writeError(w, r, http.StatusGone, codeExpired, "Invitation expired on %s", invite.ExpiresAt.Format(time.RFC1123))
+		return nil
+	}
+
+	invite.Status = status
+	invite.RespondedAt = now
+	return invite
+}
+
+// removeCollaborator lets the owner take someone off a draft
+func removeCollaborator(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+	req, ok := readMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Email == mail.Owner {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The owner can't be removed, transfer ownership first")
+		return
+	}
+	if req.Email == mail.mailboxHolder() {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "%s can't be removed, the Gmail draft is in their mailbox", req.Email)
+		return
+	}
+
+	mail, err := requestStores(r).removeMember(mail.DraftID, req.Email)
+	if err != nil {
+		internalError(w, r, "Failed to remove collaborator", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, members(mail))
+}
+
+// leaveDraft takes the signed in user off a draft. The owner has to hand it
+// over first, and whoever holds the Gmail draft can't leave at all.
+func leaveDraft(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	user := requestUser(r)
+	if user == mail.Owner {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The owner can't leave, transfer ownership first")
+		return
+	}
+	if user == mail.mailboxHolder() {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "You can't leave, the Gmail draft is in your mailbox")
+		return
+	}
+
+	_, err := requestStores(r).removeMember(mail.DraftID, user)
+	if err != nil {
+		internalError(w, r, "Failed to leave draft", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeMember takes user off a draft, along with their archive flag and any
+// approval still expected from them
+func (st *Stores) removeMember(draftID, user string) (*Email, error) {
+	mail, err := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		collaborators := []string{}
+		for _, c := range mail.Collaborators {
+			if c != user {
+				collaborators = append(collaborators, c)
+			}
+		}
+		mail.Collaborators = collaborators
+		mail.Roles = withoutMember(mail.Roles, user)
+		mail.ArchivedBy = withoutString(mail.ArchivedBy, user)
+		mail.Approval.Required = withoutString(mail.Approval.Required, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishMemberEvent(draftID, user, "")
+	return mail, nil
+}
+
+// mailboxHolder is who holds the Gmail draft of mail in their mailbox.
+// Drafts from before that was recorded were never handed over, so their
+// owner holds it.
+func (mail *Email) mailboxHolder() string {
+	if mail.MailboxEmail != "" {
+		return mail.MailboxEmail
+	}
+	return mail.Owner
+}
+
+// transferOwnership hands a draft over to another collaborator, leaving the
+// previous owner as an editor. The Gmail draft itself stays in the mailbox it
+// was created in, so whoever holds it stays on the draft.
+func transferOwnership(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+	req, ok := readMemberRequest(w, r)
+	if !ok {
+		return
+	}
+	if roleOf(mail, req.Email) == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "%s is not a collaborator on draft %s", req.Email, mail.DraftID)
+		return
+	}
+
+	draftID, owner := mail.DraftID, mail.Owner
+	updated, err := updateDraft(requestStores(r).Drafts, draftID, func(mail *Email) error {
+		if mail.Owner != owner {
+			return errDraftChanged
+		}
+		mail.MailboxEmail = mail.mailboxHolder()
+		mail.Owner = req.Email
+		mail.Roles = withoutMember(mail.Roles, req.Email)
+		mail.setMember(owner, roleEditor)
+		return nil
+	})
+	if err == errDraftChanged {
+		writeError(w, r, http.StatusConflict, codeConflict, "Draft %s changed owner meanwhile", draftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to transfer ownership", err)
+		return
+	}
+	publishMemberEvent(draftID, req.Email, roleOwner)
+	publishMemberEvent(draftID, owner, roleEditor)
+
+	writeJSON(w, http.StatusOK, newDraftResource(updated, requestUser(r)))
+}
+
+// withoutMember returns roles without the entry for user
+func withoutMember(roles []Member, user string) []Member {
+	kept := []Member{}
+	for _, m := range roles {
+		if m.Email != user {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// withoutString returns list without s
+func withoutString(list []string, s string) []string {
+	kept := []string{}
+	for _, v := range list {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestInvitationAccepted(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	bob := ts.clientFor("u2", "bob@example.com")
+	draftID := owner.shareDraft()
+
+	var invite Invitation
+	req := memberRequest{Email: "Bob@example.com", Role: roleCommenter}
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/invite", req, &invite); status != http.StatusCreated {
+		t.Fatalf("invite = %d", status)
+	}
+	// inviting again renews the same invitation
+	var again Invitation
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/invite", req, &again); status != http.StatusCreated || again.ID != invite.ID {
+		t.Fatalf("invite again = %d, %s want %s", status, again.ID.Hex(), invite.ID.Hex())
+	}
+	if status := bob.do("GET", apiPrefix+"/draft/id/"+draftID, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("get before accepting = %d, want 403", status)
+	}
+
+	var invites []Invitation
+	if status := bob.do("GET", apiPrefix+"/invite/list", nil, &invites); status != http.StatusOK {
+		t.Fatalf("list invitations = %d", status)
+	}
+	if len(invites) != 1 || invites[0].ID != invite.ID {
+		t.Fatalf("invitations = %+v", invites)
+	}
+	path := apiPrefix + "/invite/id/" + invite.ID.Hex()
+	if status := owner.do("POST", path+"/accept", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("accepting someone else's invitation = %d, want 404", status)
+	}
+	if status := bob.do("POST", path+"/accept", nil, nil); status != http.StatusOK {
+		t.Fatalf("accept = %d", status)
+	}
+	if status := bob.do("POST", path+"/decline", nil, nil); status != http.StatusConflict {
+		t.Fatalf("declining an accepted invitation = %d, want 409", status)
+	}
+
+	draft := bob.getDraft(draftID)
+	found := false
+	for _, m := range draft.Members {
+		found = found || (m.Email == "bob@example.com" && m.Role == roleCommenter)
+	}
+	if !found {
+		t.Fatalf("members = %+v", draft.Members)
+	}
+}
+
+func TestMailboxHolderStaysAfterTransfer(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	bob := ts.clientFor("u2", "bob@example.com")
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID
+
+	var invite Invitation
+	if status := owner.do("POST", path+"/invite", memberRequest{Email: "bob@example.com", Role: roleEditor}, &invite); status != http.StatusCreated {
+		t.Fatalf("invite = %d", status)
+	}
+	if status := bob.do("POST", apiPrefix+"/invite/id/"+invite.ID.Hex()+"/accept", nil, nil); status != http.StatusOK {
+		t.Fatalf("accept = %d", status)
+	}
+	if status := owner.do("POST", path+"/transfer", memberRequest{Email: "bob@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("transfer = %d", status)
+	}
+
+	// the Gmail draft is still in the former owner's mailbox
+	if status := bob.do("POST", path+"/remove", memberRequest{Email: "owner@example.com"}, nil); status != http.StatusBadRequest {
+		t.Fatalf("removing the mailbox holder = %d, want 400", status)
+	}
+	if status := owner.do("POST", path+"/leave", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("mailbox holder leaving = %d, want 400", status)
+	}
+	mail, _ := ts.stores.Drafts.Get(draftID)
+	if mail.Owner != "bob@example.com" || roleOf(mail, "owner@example.com") != roleEditor {
+		t.Fatalf("owner = %s, former owner's role = %q", mail.Owner, roleOf(mail, "owner@example.com"))
+	}
+
+	// handing it back leaves nobody stuck
+	if status := bob.do("POST", path+"/transfer", memberRequest{Email: "owner@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("transfer back = %d", status)
+	}
+	if status := bob.do("POST", path+"/leave", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("former owner leaving = %d, want 204", status)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// InviteStore keeps invitations to drafts. Missing invitations are reported
+// as mgo.ErrNotFound by every implementation.
+type InviteStore interface {
+	// Invite stores a pending invitation like invite, or renews the pending
+	// one the invitee already has to the draft with its inviter, role and
+	// expiry, and returns what was stored
+	Invite(invite *Invitation) (*Invitation, error)
+
+	Get(id bson.ObjectId) (*Invitation, error)
+
+	// ListPending returns the invitations of invitee that can still be
+	// answered at now, newest first
+	ListPending(invitee string, now time.Time) ([]Invitation, error)
+
+	// Respond moves a pending invitation to status. It reports
+	// mgo.ErrNotFound if the invitation isn't pending anymore.
+	Respond(id bson.ObjectId, status string, at time.Time) error
+
+	DeleteByDraft(draftID string) error
+}
+
+// mongoInviteStore keeps invitations in the invitations collection.
+type mongoInviteStore struct {
+	c *mgo.Collection
+}
+
+func newMongoInviteStore(db *mgo.Database) *mongoInviteStore {
+	return &mongoInviteStore{c: db.C(inviteCollection)}
+}
+
+// ensureIndexes indexes invitations by who they are for
+func (s *mongoInviteStore) ensureIndexes() error {
+	return s.c.EnsureIndexKey("invitee", "status")
+}
+
+func (s *mongoInviteStore) Invite(invite *Invitation) (*Invitation, error) {
+	var stored Invitation
+	_, err := s.c.Find(bson.M{
+		"draft_id": invite.DraftID,
+		"invitee":  invite.Invitee,
+		"status":   invitePending,
+	}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"inviter":    invite.Inviter,
+				"role":       invite.Role,
+				"expires_at": invite.ExpiresAt,
+			},
+			"$setOnInsert": bson.M{
+				"_id":        invite.ID,
+				"created_at": invite.CreatedAt,
+			},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (s *mongoInviteStore) Get(id bson.ObjectId) (*Invitation, error) {
+	var invite Invitation
+	err := s.c.FindId(id).One(&invite)
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (s *mongoInviteStore) ListPending(invitee string, now time.Time) ([]Invitation, error) {
+	invites := []Invitation{}
+	err := s.c.Find(bson.M{
+		"invitee":    invitee,
+		"status":     invitePending,
+		"expires_at": bson.M{"$gt": now},
+	}).Sort("-created_at").All(&invites)
+	return invites, err
+}
+
+func (s *mongoInviteStore) Respond(id bson.ObjectId, status string, at time.Time) error {
+	return s.c.Update(
+		bson.M{"_id": id, "status": invitePending},
+		bson.M{"$set": bson.M{"status": status, "responded_at": at}})
+}
+
+func (s *mongoInviteStore) DeleteByDraft(draftID string) error {
+	_, err := s.c.RemoveAll(bson.M{"draft_id": draftID})
+	return err
+}
+
+// memoryInviteStore keeps invitations in this process, for tests.
+type memoryInviteStore struct {
+	mu      sync.Mutex
+	invites map[bson.ObjectId]Invitation
+}
+
+func newMemoryInviteStore() *memoryInviteStore {
+	return &memoryInviteStore{invites: make(map[bson.ObjectId]Invitation)}
+}
+
+func (s *memoryInviteStore) Invite(invite *Invitation) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *invite
+	for _, other := range s.invites {
+		if other.DraftID == invite.DraftID && other.Invitee == invite.Invitee && other.Status == invitePending {
+			stored.ID, stored.CreatedAt = other.ID, other.CreatedAt
+			break
+		}
+	}
+	stored.Status = invitePending
+	s.invites[stored.ID] = stored
+	return &stored, nil
+}
+
+func (s *memoryInviteStore) Get(id bson.ObjectId) (*Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[id]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return &invite, nil
+}
+
+func (s *memoryInviteStore) ListPending(invitee string, now time.Time) ([]Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invites := []Invitation{}
+	for _, invite := range s.invites {
+		if invite.Invitee == invitee && invite.Status == invitePending && invite.ExpiresAt.After(now) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Sort(byNewest(invites))
+	return invites, nil
+}
+
+func (s *memoryInviteStore) Respond(id bson.ObjectId, status string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[id]
+	if !ok || invite.Status != invitePending {
+		return mgo.ErrNotFound
+	}
+	invite.Status, invite.RespondedAt = status, at
+	s.invites[id] = invite
+	return nil
+}
+
+func (s *memoryInviteStore) DeleteByDraft(draftID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, invite := range s.invites {
+		if invite.DraftID == draftID {
+			delete(s.invites, id)
+		}
+	}
+	return nil
+}
+
+// byNewest sorts invitations newest first.
+type byNewest []Invitation
+
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNewest) Less(i, j int) bool { return s[i].CreatedAt.After(s[j].CreatedAt) }
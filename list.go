@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultListLimit = 25
+	maxListLimit     = 100
+
+	// snippetLength is how many characters of the body a summary shows
+	snippetLength = 140
+)
+
+// draftSummary is how a draft is shown in a listing.
+type draftSummary struct {
+	DraftID         string    `json:"draft_id"`
+	Owner           string    `json:"owner"`
+	Role            string    `json:"role"`
+	Subject         string    `json:"subject"`
+	Snippet         string    `json:"snippet"`
+	LastEditor      string    `json:"last_editor"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Archived        bool      `json:"archived"`
+	PendingApproval bool      `json:"pending_approval"`
+	Sent            bool      `json:"sent"`
+}
+
+type listResponse struct {
+	Drafts     []draftSummary `json:"drafts"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func newDraftSummary(mail *Email, user string) draftSummary {
+	subject, _ := mail.textField(fieldSubject)
+	body, _ := mail.textField(fieldBody)
+	return draftSummary{
+		DraftID:         mail.DraftID,
+		Owner:           mail.Owner,
+		Role:            roleOf(mail, user),
+		Subject:         subject.Content,
+		Snippet:         snippet(body.Content),
+		LastEditor:      mail.LastEditor,
+		UpdatedAt:       mail.UpdatedAt,
+		Archived:        containsString(mail.ArchivedBy, user),
+		PendingApproval: len(mail.PendingApprovers) > 0,
+		Sent:            mail.Sent != nil,
+	}
+}
+
+// snippet is the start of text on one line, the way Gmail shows messages in
+// a list
+func snippet(text string) string {
+	words := strings.FieldsFunc(text, unicode.IsSpace)
+	runes := []rune(strings.Join(words, " "))
+	if len(runes) > snippetLength {
+		runes = runes[:snippetLength]
+	}
+	return string(runes)
+}
+
+// refreshActivity works out the fields of mail that are kept for listing it
+// from the rest of it
+func (m *Email) refreshActivity() {
+	m.PendingApprovers = pendingApprovers(m)
+
+	touch := func(at time.Time, user string) {
+		if at.After(m.UpdatedAt) {
+			m.UpdatedAt, m.LastEditor = at, user
+		}
+	}
+	for _, edits := range [][]Edit{m.Edits, m.Subject.Edits} {
+		for _, e := range edits {
+			touch(e.CreatedAt, e.Editor)
+		}
+	}
+	for _, list := range []RecipientField{m.To, m.Cc, m.Bcc} {
+		for _, e := range list.Edits {
+			touch(e.CreatedAt, e.Editor)
+		}
+	}
+	for _, a := range m.Attachments {
+		touch(a.UploadedAt, a.UploadedBy)
+	}
+	for _, a := range m.Approval.Approvals {
+		touch(a.ApprovedAt, a.User)
+	}
+	if m.Sent != nil {
+		touch(m.Sent.SentAt, m.Sent.SentBy)
+	}
+}
+
+// encodeCursor turns the position of the last draft of a page into an
+// opaque cursor for the next one
+func encodeCursor(mark activityMark) string {
+	buf, _ := json.Marshal(&mark)
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(cursor string) (*activityMark, error) {
+	buf, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var mark activityMark
+	err = json.Unmarshal(buf, &mark)
+	if err != nil {
+		return nil, err
+	}
+	return &mark, nil
+}
+
+// readListQuery turns the query string of listAvailable into a DraftQuery
+// for user. It writes the error response itself if the caller should stop.
+func readListQuery(w http.ResponseWriter, r *http.Request, user string) (*DraftQuery, bool) {
+	q := &DraftQuery{Collaborator: user, ByActivity: true, Limit: defaultListLimit}
+
+	switch r.FormValue("role") {
+	case "":
+	case "owned":
+		q.Owner = user
+	case "shared":
+		q.NotOwner = user
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "role must be owned or shared")
+		return nil, false
+	}
+
+	if r.FormValue("archived") == "true" {
+		q.ArchivedBy = user
+	} else {
+		q.NotArchivedBy = user
+	}
+
+	switch r.FormValue("pending_approval") {
+	case "":
+	case "true":
+		q.PendingApproval = true
+	case "false":
+		q.NoPendingApproval = true
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "pending_approval must be true or false")
+		return nil, false
+	}
+
+	if since := r.FormValue("modified_since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "modified_since must be an RFC 3339 time")
+			return nil, false
+		}
+		q.ModifiedSince = t
+	}
+
+	switch r.FormValue("sort") {
+	case "", "-updated_at":
+	case "updated_at":
+		q.Ascending = true
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "sort must be updated_at or -updated_at")
+		return nil, false
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and %d", maxListLimit)
+			return nil, false
+		}
+		q.Limit = n
+	}
+
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		mark, err := decodeCursor(cursor)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "Invalid cursor")
+			return nil, false
+		}
+		q.After = mark
+	}
+	return q, true
+}
+
+// listAvailable lists a page of the drafts the user has a role on, most
+// recently changed first. Archived drafts are only listed with
+// ?archived=true, and the other filters are described in the OpenAPI
+// document.
+func listAvailable(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := requestUser(r)
+	q, ok := readListQuery(w, r, user)
+	if !ok {
+		return
+	}
+
+	// ask for one more draft than fits the page, to know if there is a next
+	limit := q.Limit
+	q.Limit++
+	mails, err := requestStores(r).Drafts.List(*q)
+	if err != nil {
+		internalError(w, r, "Failed to list drafts", err)
+		return
+	}
+
+	resp := listResponse{Drafts: []draftSummary{}}
+	if len(mails) > limit {
+		mails = mails[:limit]
+		resp.NextCursor = encodeCursor(markOf(&mails[limit-1]))
+	}
+	for i := range mails {
+		resp.Drafts = append(resp.Drafts, newDraftSummary(&mails[i], user))
+	}
+
+	writeJSON(w, http.StatusOK, &resp)
+}
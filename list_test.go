@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// list fetches a page of the client's drafts with the given filters
+func (c *testClient) list(query url.Values) listResponse {
+	var resp listResponse
+	if status := c.do("GET", apiPrefix+"/draft/list?"+query.Encode(), nil, &resp); status != http.StatusOK {
+		c.ts.t.Fatalf("list %s = %d", query.Encode(), status)
+	}
+	return resp
+}
+
+func draftIDs(resp listResponse) []string {
+	ids := []string{}
+	for _, d := range resp.Drafts {
+		ids = append(ids, d.DraftID)
+	}
+	return ids
+}
+
+func TestListFiltersAndPages(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	bob := ts.clientFor("u2", "bob@example.com")
+
+	first, shared, archived := owner.shareDraft(), owner.shareDraft(), owner.shareDraft()
+	if err := ts.stores.setMemberRole(shared, "bob@example.com", roleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+archived+"/archive", nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("archive = %d", status)
+	}
+
+	// most recently changed first, which the role given to bob made shared
+	if ids := draftIDs(owner.list(nil)); len(ids) != 2 || ids[0] != shared || ids[1] != first {
+		t.Fatalf("owner's drafts = %v, want [%s %s]", ids, shared, first)
+	}
+	if ids := draftIDs(owner.list(url.Values{"archived": {"true"}})); len(ids) != 1 || ids[0] != archived {
+		t.Fatalf("owner's archived drafts = %v, want [%s]", ids, archived)
+	}
+	if ids := draftIDs(owner.list(url.Values{"role": {"shared"}})); len(ids) != 0 {
+		t.Fatalf("drafts shared with the owner = %v, want none", ids)
+	}
+
+	resp := bob.list(url.Values{"role": {"shared"}})
+	if len(resp.Drafts) != 1 || resp.Drafts[0].DraftID != shared || resp.Drafts[0].Role != roleEditor {
+		t.Fatalf("drafts shared with bob = %+v", resp.Drafts)
+	}
+
+	page := owner.list(url.Values{"limit": {"1"}, "sort": {"updated_at"}})
+	if ids := draftIDs(page); len(ids) != 1 || ids[0] != first || page.NextCursor == "" {
+		t.Fatalf("first page = %v, cursor %q", ids, page.NextCursor)
+	}
+	page = owner.list(url.Values{"limit": {"1"}, "sort": {"updated_at"}, "cursor": {page.NextCursor}})
+	if ids := draftIDs(page); len(ids) != 1 || ids[0] != shared || page.NextCursor != "" {
+		t.Fatalf("second page = %v, cursor %q", ids, page.NextCursor)
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gorilla/context"
-	"github.com/gorilla/sessions"
+	"github.com/gorilla/securecookie"
 	"github.com/julienschmidt/httprouter"
 
 	"gopkg.in/mgo.v2"
@@ -16,83 +18,168 @@ import (
 const (
 	applicationName = "Gmail Peer Edit"
 	sessionKey      = "blendr"
-	codeKey         = "gmail-code"
-	tokenKey        = "gmail-token"
 	userEmailKey    = "gmail-email"
 	userIDKey       = "gmail-id"
 	draftIDParam    = "draft_id_param"
 )
 
 var (
-	serverPort   string
-	clientID     = os.Getenv("GOOGLE_CLIENT_ID")
-	clientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+	baseURL string
 
-	mongoDatabase = "blendr"
+	// allowedOrigins may call the API from a browser
+	allowedOrigins []string
 
-	// store initializes the Gorilla session store.
-	store = sessions.NewCookieStore([]byte("qwerty1234")) // TODO: configure
-
-	// mgoConn is the connection to mongodb
-	mgoConn    *mgo.Database
-	mgoSession *mgo.Session
-
-	baseURL string = "https://cahoots-email.herokuapp.com"
+	// store initializes the Gorilla session store. Until the server is
+	// configured its key is random, so sessions don't outlive the process.
+	store = newServerStore(newMemorySessionStore(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
 )
 
-func init() {
-	serverPort = os.Getenv("PORT")
-	if serverPort == "" {
-		log.Fatal("No value found in environment for PORT")
-	}
+// server is the configured application, connected to its database.
+type server struct {
+	cfg     *Config
+	session *mgo.Session
+	stores  *Stores
+	handler http.Handler
+}
 
-	baseURL = os.Getenv("BASE_URL")
-	if baseURL == "" {
-		log.Fatal("No config found for BASE_URL")
+// newServer connects to Mongo, prepares its collections and applies cfg.
+// Nothing runs until run is called.
+func newServer(cfg *Config) (*server, error) {
+	session, err := mgo.DialWithTimeout(cfg.MongoURI, cfg.MongoTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to Mongo => {%s}", err)
 	}
+	session.SetSafe(&mgo.Safe{}) // durable writes
+	session.SetSocketTimeout(cfg.MongoTimeout)
 
-	var err error
-	if os.Getenv("MONGOLAB_URI") != "" {
-		mgoSession, err = mgo.Dial(os.Getenv("MONGOLAB_URI"))
-	} else {
-		mgoSession, err = mgo.Dial("localhost:27017")
-	}
+	st, err := newMongoStores(session.DB(cfg.MongoDatabase))
 	if err != nil {
-		log.Fatalf("Cannot connect to Mongo => {%s}", err)
+		session.Close()
+		return nil, err
 	}
-	mgoSession.SetSafe(&mgo.Safe{}) // durable writes
+	configure(cfg, st)
+
+	return &server{
+		cfg:     cfg,
+		session: session,
+		stores:  st,
+		handler: newHandler(st),
+	}, nil
+}
+
+// newHandler serves every endpoint, keeping data in st
+func newHandler(st *Stores) http.Handler {
+	return context.ClearHandler(withRequestID(withStores(st, withCORS(newRouter()))))
+}
+
+// configure points the package at the settings of cfg, with sessions kept
+// in st
+func configure(cfg *Config, st *Stores) {
+	baseURL = cfg.BaseURL
+	allowedOrigins = cfg.AllowedOrigins
+	store = newServerStore(st.Sessions, cfg.sessionKeyPairs()...)
+	store.LegacyCutoff = cfg.LegacyCookieCutoff
+	store.Options.Secure = strings.HasPrefix(cfg.BaseURL, "https://")
+
+	oauthCfg.ClientID = cfg.GoogleClientID
+	oauthCfg.ClientSecret = cfg.GoogleClientSecret
+	oauthCfg.RedirectURL = cfg.BaseURL + "/oauth2callback"
+
+	gmailPushToken = cfg.GmailPushToken
+	gmailBasePath = cfg.GmailBasePath
+	maxAttachmentSize = cfg.AttachmentMaxSize
+	maxDraftAttachmentSize = cfg.DraftAttachmentMaxSize
+}
+
+// run starts the background workers and serves until the listener fails
+func (s *server) run() error {
+	go s.stores.runSyncWorker()
+	go s.stores.runHistoryPoller()
+	go s.stores.runScheduler()
 
-	mgoSession.Refresh()
-	if os.Getenv("MONGO_DATABASE") != "" {
-		mongoDatabase = os.Getenv("MONGO_DATABASE")
+	hs := &http.Server{
+		Addr:         ":" + s.cfg.Port,
+		Handler:      s.handler,
+		ReadTimeout:  s.cfg.ReadTimeout,
+		WriteTimeout: s.cfg.WriteTimeout,
 	}
+	return hs.ListenAndServe()
+}
 
-	// connect to the right database
-	mgoConn = mgoSession.DB(mongoDatabase)
+// Close disconnects from Mongo once the work started by requests is done
+func (s *server) Close() {
+	resuming.Wait()
+	s.session.Close()
 }
 
-// checkIfAuthenticated handles checking if the token is in the cookie. If it is not
+// checkIfAuthenticated handles checking if a user signed in to the session. If not
 // then we redirect to let the user re-authenticate.
 func checkIfAuthenticated(h func(http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
 	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		w.Header().Set("Access-Control-Allow-Origin", "https://mail.google.com")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-
 		session, err := store.Get(r, sessionKey)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
 			log.Printf("error getting session => {%s}", err)
+			http.Error(w, "Session is invalid, sign in again", http.StatusUnauthorized)
 			return
 		}
 
 		// see if the key is there
-		_, exists := session.Values[tokenKey]
+		_, exists := session.Values[userIDKey]
 		if !exists {
 			http.Redirect(w, r, "/authenticate", http.StatusSeeOther)
 			log.Printf("Couldn't find data in session values => {%#v}", session.Values)
 			return
 		}
 
+		// a session still held in its cookie moves server side, as its
+		// cookie is only accepted once
+		if session.ID == "" {
+			err = store.Save(r, w, session)
+			if err != nil {
+				log.Printf("failed to save session => {%s}", err)
+				http.Error(w, "Failed to save the session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		h(w, r, p)
+	})
+}
+
+// requireSession is checkIfAuthenticated for the API: a request without a
+// signed in user gets a 401 rather than being sent to sign in. The user is
+// stashed in the request context for the handler.
+func requireSession(h func(http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		session, err := store.Get(r, sessionKey)
+		if err != nil {
+			log.Printf("error getting session => {%s}", err)
+			writeError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Session is invalid, sign in again")
+			return
+		}
+		_, exists := session.Values[userIDKey]
+		user, ok := session.Values[userEmailKey].(string)
+		if !exists || !ok {
+			writeError(w, r, http.StatusUnauthorized, codeUnauthenticated, "Sign in at %s/authenticate first", baseURL)
+			return
+		}
+
+		// a session still held in its cookie moves server side, as its
+		// cookie is only accepted once
+		if session.ID == "" {
+			err = store.Save(r, w, session)
+			if err != nil {
+				internalError(w, r, "Failed to save the session", err)
+				return
+			}
+		}
+
+		if !checkCSRF(r, session) {
+			writeError(w, r, http.StatusForbidden, codeBadCSRFToken, "The %s header must hold the token from %s/session", csrfHeader, apiPrefix)
+			return
+		}
+
+		context.Set(r, userContextKey, user)
 		h(w, r, p)
 	})
 }
@@ -100,7 +187,7 @@ func checkIfAuthenticated(h func(http.ResponseWriter, *http.Request, httprouter.
 func hi(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	s, err := store.Get(r, sessionKey)
 	if err != nil {
-		fmt.Fprintf(w, "Failed to access the session => {%s}", err)
+		http.Error(w, fmt.Sprintf("Failed to access the session => {%s}", err), http.StatusInternalServerError)
 		return
 	}
 
@@ -110,31 +197,99 @@ func hi(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		user = val.(string)
 	}
 	fmt.Fprintf(w, "<h1>hi %s</h1><a href=\"/list\">list emails</a>", user)
+	if token, ok := s.Values[csrfTokenKey].(string); ok && user != "" {
+		fmt.Fprintf(w, "<form action=\"/logout\" method=\"POST\"><input type=\"hidden\" name=\"csrf_token\" value=\"%s\"/><input type=\"submit\" value=\"Sign out\"/></form>", token)
+	}
 }
 
-func debugLog(w http.ResponseWriter, r *http.Request) {
-	log.Printf("DEBUG => %s: %s", r.Method, r.URL.Path)
-}
-
-func main() {
+// newRouter routes every endpoint of the server
+func newRouter() *httprouter.Router {
 	router := httprouter.New()
 
 	router.GET("/", hi)
 	router.POST("/authorize", handleAuthorize)
 	router.GET("/authenticate", needAuth)
 	router.GET("/list", checkIfAuthenticated(listEmails))
+	router.POST("/logout", logout)
 
 	// API
-	router.POST("/draft/create", checkIfAuthenticated(newEmail))
-	router.GET("/draft/list", checkIfAuthenticated(listAvailable))
-	router.POST(fmt.Sprintf("/draft/id/:%s", draftIDParam), checkIfAuthenticated(draftUpdate))
+	draftPath := fmt.Sprintf("%s/draft/id/:%s", apiPrefix, draftIDParam)
+	commentPath := fmt.Sprintf("%s/comments/:%s", draftPath, commentIDParam)
+	router.GET(apiPrefix+"/openapi.json", serveOpenAPI)
+	router.GET(apiPrefix+"/session", requireSession(getSession))
+	router.GET(apiPrefix+"/sessions", requireSession(listSessions))
+	router.DELETE(fmt.Sprintf("%s/sessions/:%s", apiPrefix, sessionIDParam), requireSession(revokeSession))
+	router.POST(apiPrefix+"/account/google/disconnect", requireSession(disconnectGoogle))
+	router.POST(apiPrefix+"/draft/create", requireSession(newEmail))
+	router.GET(apiPrefix+"/draft/list", requireSession(listAvailable))
+	router.GET(apiPrefix+"/draft/search", requireSession(searchDrafts))
+	router.GET(draftPath, requireRole(roleViewer, draftGet))
+	router.POST(draftPath, requireRole(roleEditor, draftUpdate))
+	router.DELETE(draftPath, requireRole(roleOwner, draftDelete))
+	router.POST(draftPath+"/archive", requireRole(roleViewer, archiveDraft))
+	router.POST(draftPath+"/unarchive", requireRole(roleViewer, unarchiveDraft))
+	router.POST(draftPath+"/leave", requireRole(roleViewer, leaveDraft))
+	router.GET(draftPath+"/stream", requireRole(roleViewer, draftStream))
+	router.POST(draftPath+"/cursor", requireRole(roleViewer, draftCursor))
+	router.GET(draftPath+"/history", requireRole(roleViewer, draftHistory))
+	router.GET(draftPath+"/diff", requireRole(roleViewer, draftDiff))
+	router.POST(draftPath+"/restore", requireRole(roleEditor, draftRestore))
+	router.POST(draftPath+"/subject", requireRole(roleEditor, subjectUpdate))
+	router.GET(draftPath+"/recipients", requireRole(roleViewer, listRecipients))
+	router.POST(draftPath+"/recipients", requireRole(roleEditor, recipientsUpdate))
+	router.GET(draftPath+"/approval", requireRole(roleViewer, draftApproval))
+	router.POST(draftPath+"/approvers", requireRole(roleOwner, setApprovers))
+	router.POST(draftPath+"/approve", requireRole(roleViewer, approveDraft))
+	router.POST(draftPath+"/send", requireRole(roleOwner, sendDraft))
+	router.GET(draftPath+"/schedule", requireRole(roleViewer, draftSchedule))
+	router.POST(draftPath+"/schedule", requireRole(roleOwner, scheduleSend))
+	router.POST(draftPath+"/schedule/reschedule", requireRole(roleEditor, rescheduleSend))
+	router.POST(draftPath+"/schedule/cancel", requireRole(roleEditor, cancelSend))
+	router.GET(draftPath+"/attachments", requireRole(roleViewer, listAttachments))
+	router.POST(draftPath+"/attachments", requireRole(roleEditor, uploadAttachment))
+	router.GET(fmt.Sprintf("%s/attachments/:%s", draftPath, attachmentIDParam), requireRole(roleViewer, downloadAttachment))
+	router.POST(fmt.Sprintf("%s/attachments/:%s/remove", draftPath, attachmentIDParam), requireRole(roleEditor, removeAttachment))
+
+	router.GET(draftPath+"/comments", requireRole(roleViewer, listComments))
+	router.POST(draftPath+"/comments", requireRole(roleCommenter, newComment))
+	router.POST(commentPath+"/reply", requireComment(roleCommenter, replyToComment))
+	router.POST(commentPath+"/resolve", requireComment(roleCommenter, resolveComment))
+	router.POST(commentPath+"/unresolve", requireComment(roleCommenter, unresolveComment))
+	router.POST(commentPath+"/accept", requireComment(roleOwner, acceptSuggestion))
+	router.POST(commentPath+"/reject", requireComment(roleOwner, rejectSuggestion))
+	router.POST(draftPath+"/invite", requireRole(roleOwner, inviteCollaborator))
+	router.POST(draftPath+"/remove", requireRole(roleOwner, removeCollaborator))
+	router.POST(draftPath+"/transfer", requireRole(roleOwner, transferOwnership))
+	router.POST(draftPath+"/role", requireRole(roleOwner, setRole))
+
+	router.GET(apiPrefix+"/invite/list", requireSession(listInvitations))
+	router.POST(fmt.Sprintf("%s/invite/id/:%s/accept", apiPrefix, inviteIDParam), requireSession(acceptInvitation))
+	router.POST(fmt.Sprintf("%s/invite/id/:%s/decline", apiPrefix, inviteIDParam), requireSession(declineInvitation))
 
 	//Google will redirect to this page to return your code, so handle it appropriately
 	router.GET("/oauth2callback", handleOAuth2Callback)
+	router.POST("/gmail/push", gmailPush)
+
+	router.NotFound = notFound
+
+	return router
+}
 
-	router.NotFound = debugLog
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "JSON `file` with settings, overridden by the environment")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := newServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Close()
 
-	err := http.ListenAndServe(":"+serverPort, context.ClearHandler(router))
+	err = srv.run()
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
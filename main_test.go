@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// testServer runs the whole server on the in-memory stores, talking to a
+// fake Gmail, so the API can be driven without Mongo or Google.
+type testServer struct {
+	t      *testing.T
+	fake   *fakeGmail
+	stores *Stores
+	server *httptest.Server
+	done   func()
+}
+
+// testEnv is the environment the test server is configured from
+func testEnv(key string) string {
+	return map[string]string{
+		"PORT":                 "8080",
+		"BASE_URL":             "http://localhost:8080",
+		"SESSION_KEYS":         strings.Repeat("k", minSessionKeyLength),
+		"GOOGLE_CLIENT_ID":     "client",
+		"GOOGLE_CLIENT_SECRET": "secret",
+		"GMAIL_PUSH_TOKEN":     "push-token",
+	}[key]
+}
+
+func newTestServer(t *testing.T) *testServer {
+	cfg, err := loadConfig("", testEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := newMemoryStores()
+	configure(cfg, st)
+
+	fake := newFakeGmail("u1", "owner@example.com")
+	restore := fake.use()
+	server := httptest.NewServer(newHandler(st))
+	oauthCfg.RedirectURL = server.URL + "/oauth2callback"
+
+	return &testServer{t: t, fake: fake, stores: st, server: server, done: func() {
+		server.Close()
+		resuming.Wait()
+		restore()
+		fake.Close()
+	}}
+}
+
+func (ts *testServer) Close() {
+	ts.done()
+}
+
+// testClient is a browser using the test server.
+type testClient struct {
+	ts   *testServer
+	http *http.Client
+	csrf string
+}
+
+// newClient is a browser that hasn't signed in
+func (ts *testServer) newClient() *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{ts: ts, http: &http.Client{Jar: jar}}
+}
+
+// signIn goes through Google's consent, as faked, and fetches the CSRF token
+func (ts *testServer) signIn() *testClient {
+	c := ts.newClient()
+	resp, err := c.http.Post(ts.server.URL+"/authorize", "", nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		ts.t.Fatalf("signing in ended with %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	var info sessionInfo
+	if status := c.do("GET", apiPrefix+"/session", nil, &info); status != http.StatusOK {
+		ts.t.Fatalf("GET /session = %d", status)
+	}
+	c.csrf = info.CSRFToken
+	return c
+}
+
+// clientFor is a browser already signed in as another user, whose session
+// is made directly as the fake only knows the owner's mailbox
+func (ts *testServer) clientFor(userID, email string) *testClient {
+	c := ts.newClient()
+	c.csrf = randomToken()
+
+	session := sessions.NewSession(store, sessionKey)
+	opts := *store.Options
+	session.Options = &opts
+	session.Values[userIDKey] = userID
+	session.Values[userEmailKey] = email
+	session.Values[csrfTokenKey] = c.csrf
+	req := httptest.NewRequest("GET", ts.server.URL, nil)
+	rec := httptest.NewRecorder()
+	err := store.Save(req, rec, session)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	c.http.Jar.SetCookies(req.URL, rec.Result().Cookies())
+	return c
+}
+
+// do makes a request with body as JSON, decodes the response into out if
+// given, and returns the status
+func (c *testClient) do(method, path string, body, out interface{}) int {
+	var rd io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			c.ts.t.Fatal(err)
+		}
+		rd = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.ts.server.URL+path, rd)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	if c.csrf != "" {
+		req.Header.Set(csrfHeader, c.csrf)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			c.ts.t.Fatalf("%s %s: decoding %d response => {%s}", method, path, resp.StatusCode, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// syncQueued pushes the drafts waiting for a sync, as the sync worker would
+func (ts *testServer) syncQueued() {
+	for {
+		select {
+		case draftID := <-syncQueue:
+			ts.stores.syncDraft(draftID)
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+const testDraft = "Subject: Lunch\r\nTo: bob@example.com\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nSee you at noon"
+
+func TestSignInShareEditSyncSend(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+
+	draftID := ts.fake.AddDraft([]byte(testDraft))
+	var draft draftResource
+	if status := owner.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, &draft); status != http.StatusCreated {
+		t.Fatalf("create = %d", status)
+	}
+	if draft.Body.Content != "See you at noon" || draft.Subject.Content != "Lunch" {
+		t.Fatalf("shared draft = %q / %q", draft.Subject.Content, draft.Body.Content)
+	}
+
+	edit := editRequest{BaseRevision: draft.Body.Revision, Ops: []Op{{Type: opInsert, Pos: len("See you at noon"), Text: " tomorrow"}}}
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID, edit, nil); status != http.StatusOK {
+		t.Fatalf("edit = %d", status)
+	}
+
+	ts.syncQueued()
+	raw, ok := ts.fake.Draft(draftID)
+	if !ok || !strings.Contains(string(raw), "See you at noon tomorrow") {
+		t.Fatalf("Gmail draft after sync:\n%s", raw)
+	}
+
+	var sent SentInfo
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/send", nil, &sent); status != http.StatusOK {
+		t.Fatalf("send = %d", status)
+	}
+	if sent.MessageID == "" {
+		t.Fatal("send returned no message ID")
+	}
+	msgs := ts.fake.Sent()
+	if len(msgs) != 1 || !strings.Contains(string(msgs[0]), "See you at noon tomorrow") {
+		t.Fatalf("sent messages = %q", msgs)
+	}
+}
+
+func TestSignInChecksState(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.server.URL + "/oauth2callback?code=fake-code&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("callback without a sign in started = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestWritesNeedCSRFToken(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+
+	draftID := ts.fake.AddDraft([]byte(testDraft))
+	owner.csrf = ""
+	var apiErr errorEnvelope
+	if status := owner.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, &apiErr); status != http.StatusForbidden {
+		t.Fatalf("create without CSRF token = %d, want 403", status)
+	}
+	if apiErr.Error.Code != codeBadCSRFToken {
+		t.Fatalf("error code = %q", apiErr.Error.Code)
+	}
+}
+
+func TestEditOutOfRangeIsBadRequest(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+
+	draftID := ts.fake.AddDraft([]byte(testDraft))
+	var draft draftResource
+	if status := owner.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, &draft); status != http.StatusCreated {
+		t.Fatalf("create = %d", status)
+	}
+
+	edit := editRequest{BaseRevision: draft.Body.Revision, Ops: []Op{{Type: opDelete, Pos: 5, Count: 100}}}
+	var apiErr errorEnvelope
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID, edit, &apiErr); status != http.StatusBadRequest {
+		t.Fatalf("edit out of range = %d, want 400", status)
+	}
+	if apiErr.Error.Code != codeBadRequest {
+		t.Fatalf("error code = %q", apiErr.Error.Code)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+)
+
+// MIMEMessage is an email broken into the parts collaborators work with.
+// Header values are decoded to UTF-8, and the structural headers describing
+// the body (Content-Type and friends) are left out since they are rebuilt
+// when the message is serialised.
+type MIMEMessage struct {
+	Headers     []Header         `bson:"headers" json:"headers"`
+	Text        string           `bson:"text" json:"text"`
+	HTML        string           `bson:"html,omitempty" json:"html,omitempty"`
+	Attachments []MIMEAttachment `bson:"attachments" json:"attachments"`
+}
+
+// Header is a single email header.
+type Header struct {
+	Name  string `bson:"name" json:"name"`
+	Value string `bson:"value" json:"value"`
+}
+
+// MIMEAttachment is a file carried by a message.
+type MIMEAttachment struct {
+	Filename    string `bson:"filename" json:"filename"`
+	ContentType string `bson:"content_type" json:"content_type"`
+	ContentID   string `bson:"content_id,omitempty" json:"content_id,omitempty"`
+	Inline      bool   `bson:"inline,omitempty" json:"inline,omitempty"`
+	Data        []byte `bson:"data" json:"-"`
+}
+
+// structuralHeaders are regenerated by buildMessage rather than kept
+var structuralHeaders = map[string]bool{
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Mime-Version":              true,
+}
+
+// windows1252 maps the bytes 0x80-0x9F, where windows-1252 differs from
+// ISO-8859-1, to their code points. Zero entries are unassigned.
+var windows1252 = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// iso885915 maps the bytes where ISO-8859-15 differs from ISO-8859-1 to
+// their code points
+var iso885915 = map[byte]rune{
+	0xA4: 0x20AC, 0xA6: 0x0160, 0xA8: 0x0161, 0xB4: 0x017D,
+	0xB8: 0x017E, 0xBC: 0x0152, 0xBD: 0x0153, 0xBE: 0x0178,
+}
+
+// decodeCharset converts text in charset to UTF-8. Only the charsets Gmail
+// commonly produces are understood; callers keep the bytes of anything else
+// as they are.
+func decodeCharset(charset string, buf []byte) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if !utf8.Valid(buf) {
+			return "", fmt.Errorf("invalid UTF-8 text")
+		}
+		return string(buf), nil
+	case "iso-8859-1", "latin1", "latin-1":
+		runes := make([]rune, len(buf))
+		for i, b := range buf {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	case "iso-8859-15", "latin9", "latin-9":
+		runes := make([]rune, len(buf))
+		for i, b := range buf {
+			runes[i] = rune(b)
+			if r, ok := iso885915[b]; ok {
+				runes[i] = r
+			}
+		}
+		return string(runes), nil
+	case "windows-1252", "cp1252":
+		runes := make([]rune, len(buf))
+		for i, b := range buf {
+			runes[i] = rune(b)
+			if b >= 0x80 && b <= 0x9F && windows1252[b-0x80] != 0 {
+				runes[i] = windows1252[b-0x80]
+			}
+		}
+		return string(runes), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// headerDecoder decodes RFC 2047 encoded words in the charsets above
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		buf, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		s, err := decodeCharset(charset, buf)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(s), nil
+	},
+}
+
+// decodeRaw decodes the base64url encoded raw message of the Gmail API,
+// with or without padding
+func decodeRaw(raw string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(raw, "="))
+}
+
+// encodeRaw encodes a message the way the Gmail API expects it
+func encodeRaw(msg []byte) string {
+	return base64.URLEncoding.EncodeToString(msg)
+}
+
+// parseMessage decodes an RFC 2822 message into a MIMEMessage
+func parseMessage(raw []byte) (*MIMEMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read message => {%s}", err)
+	}
+
+	m := &MIMEMessage{Attachments: []MIMEAttachment{}}
+	for _, name := range headerOrder(raw) {
+		if structuralHeaders[name] {
+			continue
+		}
+		for _, v := range msg.Header[name] {
+			decoded, err := headerDecoder.DecodeHeader(v)
+			if err != nil {
+				decoded = v
+			}
+			m.Headers = append(m.Headers, Header{Name: name, Value: decoded})
+		}
+	}
+
+	err = m.readPart(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// headerOrder lists the canonical header names of raw in the order they
+// first appear, since mail.Header is a map
+func headerOrder(raw []byte) []string {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = bytes.Index(raw, []byte("\n\n"))
+	}
+	if end < 0 {
+		end = len(raw)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(raw[:end]), "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// readPart walks a MIME part, keeping the first text/plain and text/html
+// bodies and collecting everything else as attachments. A body in a charset
+// that can't be decoded is kept byte for byte as an inline part, charset and
+// all, so it still goes out as it came in.
+func (m *MIMEMessage) readPart(header textproto.MIMEHeader, body io.Reader) error {
+	ctype := header.Get("Content-Type")
+	if ctype == "" {
+		ctype = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return fmt.Errorf("Failed to parse content type %q => {%s}", ctype, err)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("Failed to read multipart body => {%s}", err)
+			}
+			err = m.readPart(part.Header, part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	buf, err := ioutil.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("Failed to decode %s part => {%s}", mediaType, err)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename != "" {
+		if decoded, err := headerDecoder.DecodeHeader(filename); err == nil {
+			filename = decoded
+		}
+	}
+
+	isBody := disposition != "attachment" && filename == ""
+	contentType := mediaType
+	var text *string
+	switch {
+	case isBody && mediaType == "text/plain" && m.Text == "":
+		text = &m.Text
+	case isBody && mediaType == "text/html" && m.HTML == "":
+		text = &m.HTML
+	}
+	if text != nil {
+		decoded, err := decodeCharset(params["charset"], buf)
+		if err == nil {
+			*text = decoded
+			return nil
+		}
+		contentType = mime.FormatMediaType(mediaType, params)
+		disposition = "inline"
+	}
+
+	m.Attachments = append(m.Attachments, MIMEAttachment{
+		Filename:    filename,
+		ContentType: contentType,
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+		Inline:      disposition == "inline",
+		Data:        buf,
+	})
+	return nil
+}
+
+// transferDecoder undoes the Content-Transfer-Encoding of a part
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &lineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// lineStripper drops line breaks so base64 bodies can be decoded
+type lineStripper struct {
+	r io.Reader
+}
+
+func (l *lineStripper) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
+
+// htmlFromText renders plain text as a minimal HTML body
+func htmlFromText(text string) string {
+	escaped := html.EscapeString(text)
+	return "<div dir=\"ltr\">" + strings.Replace(escaped, "\n", "<br>\n", -1) + "</div>"
+}
+
+// addressHeaders hold address lists, whose display names are encoded one by one
+var addressHeaders = map[string]bool{
+	"From":     true,
+	"To":       true,
+	"Cc":       true,
+	"Bcc":      true,
+	"Reply-To": true,
+	"Sender":   true,
+}
+
+// encodeHeader encodes a header value for the wire on a single line, leaving
+// plain ASCII values otherwise untouched
+func encodeHeader(name, value string) string {
+	// a value never spans lines, whatever it was edited into
+	value = headerLineBreaks.Replace(value)
+	if isASCII(value) {
+		return value
+	}
+	if addressHeaders[name] {
+		addrs, err := mail.ParseAddressList(value)
+		if err == nil {
+			parts := make([]string, len(addrs))
+			for i, a := range addrs {
+				if isASCII(a.Name) {
+					parts[i] = a.String()
+				} else {
+					parts[i] = mime.QEncoding.Encode("utf-8", a.Name) + " <" + a.Address + ">"
+				}
+			}
+			return strings.Join(parts, ", ")
+		}
+	}
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// headerLineBreaks turns the line breaks of a header value into spaces
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// buildMessage serialises m as a UTF-8 RFC 2822 message. The body is a
+// multipart/alternative when there is HTML, wrapped in multipart/mixed when
+// there are attachments.
+func buildMessage(m *MIMEMessage) ([]byte, error) {
+	var out bytes.Buffer
+	for _, h := range m.Headers {
+		fmt.Fprintf(&out, "%s: %s\r\n", h.Name, encodeHeader(h.Name, h.Value))
+	}
+	out.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(m.Attachments) == 0 {
+		err := writeBody(&out, m)
+		return out.Bytes(), err
+	}
+
+	mw := multipart.NewWriter(&out)
+	fmt.Fprintf(&out, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	// the body goes in a part of its own, ahead of the attachments
+	var body bytes.Buffer
+	err := writeBody(&body, m)
+	if err != nil {
+		return nil, err
+	}
+	header, content, err := splitPart(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	pw.Write(content)
+
+	for _, a := range m.Attachments {
+		h := make(textproto.MIMEHeader)
+		ctype := a.ContentType
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		disposition := "attachment"
+		if a.Inline {
+			disposition = "inline"
+		}
+		if a.Filename != "" {
+			// the content type may carry parameters, such as the charset of
+			// text that couldn't be decoded
+			mediaType, params, err := mime.ParseMediaType(ctype)
+			if err != nil {
+				mediaType, params = "application/octet-stream", map[string]string{}
+			}
+			params["name"] = a.Filename
+			ctype = mime.FormatMediaType(mediaType, params)
+			disposition = mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename})
+		}
+		h.Set("Content-Type", ctype)
+		h.Set("Content-Disposition", disposition)
+		h.Set("Content-Transfer-Encoding", "base64")
+		if a.ContentID != "" {
+			h.Set("Content-Id", "<"+a.ContentID+">")
+		}
+
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(pw, a.Data)
+	}
+
+	err = mw.Close()
+	return out.Bytes(), err
+}
+
+// writeBody writes the Content-Type headers and text of m
+func writeBody(w io.Writer, m *MIMEMessage) error {
+	if m.HTML == "" {
+		return writeTextPart(w, "text/plain", m.Text)
+	}
+
+	mw := multipart.NewWriter(w)
+	fmt.Fprintf(w, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ mediaType, text string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		var buf bytes.Buffer
+		writeTextPart(&buf, part.mediaType, part.text)
+		header, content, err := splitPart(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		pw.Write(content)
+	}
+	return mw.Close()
+}
+
+// writeTextPart writes text as a quoted-printable UTF-8 part with its headers
+func writeTextPart(w io.Writer, mediaType, text string) error {
+	fmt.Fprintf(w, "Content-Type: %s; charset=UTF-8\r\n", mediaType)
+	io.WriteString(w, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	qp := quotedprintable.NewWriter(w)
+	_, err := io.WriteString(qp, strings.Replace(text, "\n", "\r\n", -1))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// splitPart separates the headers written by writeBody from the content
+func splitPart(part []byte) (textproto.MIMEHeader, []byte, error) {
+	end := bytes.Index(part, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, fmt.Errorf("malformed part")
+	}
+	header := make(textproto.MIMEHeader)
+	for _, line := range strings.Split(string(part[:end]), "\r\n") {
+		i := strings.Index(line, ":")
+		if i > 0 {
+			header.Add(line[:i], strings.TrimSpace(line[i+1:]))
+		}
+	}
+	return header, part[end+4:], nil
+}
+
+// writeBase64 writes data base64 encoded in 76 character lines
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
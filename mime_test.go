@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTrip parses raw, builds it back and parses the result again, which
+// must give the same message
+func roundTrip(t *testing.T, raw string) *MIMEMessage {
+	m, err := parseMessage([]byte(strings.Replace(raw, "\n", "\r\n", -1)))
+	if err != nil {
+		t.Fatalf("parsing => {%s}", err)
+	}
+	built, err := buildMessage(m)
+	if err != nil {
+		t.Fatalf("building => {%s}", err)
+	}
+	again, err := parseMessage(built)
+	if err != nil {
+		t.Fatalf("parsing built message => {%s}\n%s", err, built)
+	}
+	if !reflect.DeepEqual(m, again) {
+		t.Fatalf("message changed on the way through:\n%+v\n%+v\n%s", m, again, built)
+	}
+	return m
+}
+
+func header(m *MIMEMessage, name string) string {
+	for _, h := range m.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func TestRoundTripMultipart(t *testing.T) {
+	m := roundTrip(t, `Subject: Report
+To: bob@example.com
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+Figures attached
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Figures attached</p>
+--inner--
+--outer
+Content-Type: application/pdf; name="q3.pdf"
+Content-Disposition: attachment; filename="q3.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`)
+	if m.Text != "Figures attached" || m.HTML != "<p>Figures attached</p>" {
+		t.Fatalf("body = %q / %q", m.Text, m.HTML)
+	}
+	if len(m.Attachments) != 1 {
+		t.Fatalf("attachments = %+v", m.Attachments)
+	}
+	a := m.Attachments[0]
+	if a.Filename != "q3.pdf" || a.ContentType != "application/pdf" || string(a.Data) != "%PDF-1.4\n" {
+		t.Fatalf("attachment = %+v", a)
+	}
+}
+
+func TestRoundTripQuotedPrintable(t *testing.T) {
+	m := roundTrip(t, `Subject: =?utf-8?q?Caf=C3=A9?=
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+A line long enough to be soft wrapped by the sender, which quoted-printa=
+ble does at 76 characters, and a caf=C3=A9.
+`)
+	if header(m, "Subject") != "Café" {
+		t.Fatalf("subject = %q", header(m, "Subject"))
+	}
+	want := "A line long enough to be soft wrapped by the sender, which quoted-printable does at 76 characters, and a café.\r\n"
+	if m.Text != want {
+		t.Fatalf("text = %q", m.Text)
+	}
+}
+
+func TestRoundTripEightBitCharsets(t *testing.T) {
+	for _, c := range []struct {
+		charset string
+		body    []byte
+		want    string
+	}{
+		{"iso-8859-1", []byte("Caf\xe9"), "Café"},
+		{"windows-1252", []byte("\x93Caf\xe9\x94"), "“Café”"},
+		{"iso-8859-15", []byte("10 \xa4, \xbd"), "10 €, œ"},
+	} {
+		raw := "Subject: =?" + c.charset + "?q?Caf=E9?=\nContent-Type: text/plain; charset=" + c.charset + "\n\n" + string(c.body)
+		m := roundTrip(t, raw)
+		if m.Text != c.want {
+			t.Errorf("%s: text = %q, want %q", c.charset, m.Text, c.want)
+		}
+		if header(m, "Subject") != "Café" {
+			t.Errorf("%s: subject = %q", c.charset, header(m, "Subject"))
+		}
+	}
+}
+
+func TestUnsupportedCharsetIsKept(t *testing.T) {
+	koi8 := []byte("\xf0\xd2\xc9\xd7\xc5\xd4") // Привет
+	m := roundTrip(t, `Subject: =?koi8-r?b?8NLJ18XU?=
+Content-Type: multipart/alternative; boundary=b
+
+--b
+Content-Type: text/plain; charset=koi8-r
+Content-Transfer-Encoding: 8bit
+
+`+string(koi8)+`
+--b
+Content-Type: text/html; charset=utf-8
+
+<p>Hello</p>
+--b--
+`)
+	if header(m, "Subject") != "=?koi8-r?b?8NLJ18XU?=" {
+		t.Fatalf("subject = %q, want the encoded word kept", header(m, "Subject"))
+	}
+	if m.Text != "" || m.HTML != "<p>Hello</p>" {
+		t.Fatalf("body = %q / %q", m.Text, m.HTML)
+	}
+	if len(m.Attachments) != 1 {
+		t.Fatalf("attachments = %+v", m.Attachments)
+	}
+	a := m.Attachments[0]
+	if a.ContentType != "text/plain; charset=koi8-r" || !a.Inline || !bytes.Equal(a.Data, koi8) {
+		t.Fatalf("kept part = %+v", a)
+	}
+}
+
+func TestHeaderValuesStayOnOneLine(t *testing.T) {
+	built, err := buildMessage(&MIMEMessage{
+		Headers: []Header{{Name: "Subject", Value: "Hi\r\nBcc: eve@example.com"}},
+		Text:    "Hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMessage(built)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header(m, "Bcc") != "" || header(m, "Subject") != "Hi Bcc: eve@example.com" {
+		t.Fatalf("headers = %+v", m.Headers)
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	googleOauth "google.golang.org/api/oauth2/v2"
@@ -26,15 +33,24 @@ var notAuthenticatedTemplate = template.Must(template.New("").Parse(`
 </html>
 `))
 
+const (
+	// oauthStateKey and pkceVerifierKey hold, in the session, what the
+	// callback checks to be sure it finishes a sign in this browser started
+	oauthStateKey   = "oauth-state"
+	pkceVerifierKey = "oauth-pkce-verifier"
+)
+
+// userinfoBasePath points the userinfo client at another server, such as a
+// fake one in tests. Empty means the real API.
+var userinfoBasePath string
+
 // var oauthCfg = &oauth.Config{
+// The client ID, secret and redirect URL are filled in by configure.
 var oauthCfg = &oauth2.Config{
-	ClientID:     clientID,
-	ClientSecret: clientSecret,
-	Endpoint:     google.Endpoint,
+	Endpoint: google.Endpoint,
 	// To return your oauth2 code, Google will redirect the browser to this page that you have defined
 	// TODO: This exact URL should also be added in your Google API console for this project
 	// within "API Access"->"Redirect URIs"
-	RedirectURL: baseURL + "/oauth2callback",
 	// This is the 'scope' of the data that you are asking the user's permission to access.
 	// For getting user's info, this is the url that Google has defined.
 	Scopes: []string{
@@ -44,107 +60,182 @@ var oauthCfg = &oauth2.Config{
 }
 
 func needAuth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	w.Header().Set("Access-Control-Allow-Origin", "https://mail.google.com")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	notAuthenticatedTemplate.Execute(w, nil)
 }
 
-// Start the authorization process
+// Start the authorization process. A random state and PKCE verifier are
+// kept in the session, so the callback only accepts a code meant for this
+// browser and obtained by this server.
 func handleAuthorize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// a cookie that can't be read anymore just means starting over
+	s, _ := store.Get(r, sessionKey)
+
+	state := randomToken()
+	verifier := randomToken()
+	s.Values[oauthStateKey] = state
+	s.Values[pkceVerifierKey] = verifier
+	err := store.Save(r, w, s)
+	if err != nil {
+		log.Printf("failed to save session => {%s}", err)
+		http.Error(w, "Failed to start signing in", http.StatusInternalServerError)
+		return
+	}
+
 	//Get the Google URL which shows the Authentication page to the user
-	url := oauthCfg.AuthCodeURL("")
+	// ask for offline access so Google issues a refresh token
+	authURL := oauthCfg.AuthCodeURL(state, oauth2.AccessTypeOffline) + "&" + url.Values{
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}.Encode()
 	//redirect user to that page
-	http.Redirect(w, r, url, http.StatusFound)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// randomToken returns 32 random bytes, URL safe base64 encoded
+func randomToken() string {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(fmt.Sprintf("crypto/rand failed => {%s}", err))
+	}
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(buf), "=")
+}
+
+// pkceChallenge is the S256 code challenge for verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(sum[:]), "=")
+}
+
+// exchangeCode trades an authorization code for a token, proving with
+// verifier that this server asked for it. oauth2.Config.Exchange can't send
+// a code verifier.
+func exchangeCode(code, verifier string) (*oauth2.Token, error) {
+	resp, err := http.PostForm(oauthCfg.Endpoint.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {oauthCfg.RedirectURL},
+		"client_id":     {oauthCfg.ClientID},
+		"client_secret": {oauthCfg.ClientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode token response (%s) => {%s}", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, fmt.Errorf("Token request failed (%s) => {%s %s}", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	tok := &oauth2.Token{
+		AccessToken:  body.AccessToken,
+		TokenType:    body.TokenType,
+		RefreshToken: body.RefreshToken,
+	}
+	if body.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
 }
 
 // Function that handles the callback from the Google server
 func handleOAuth2Callback(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	//Get the code from the response
-	code := r.FormValue("code")
-
 	// access the session
-	s, err := store.New(r, sessionKey)
+	s, err := store.Get(r, sessionKey)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to create new session => {%s}", err)
+		http.Error(w, "Your session expired, sign in again", http.StatusBadRequest)
 		return
 	}
 
-	// add the code to regenerate a token to the cookie
-	s.Values[codeKey] = code
-
-	// createa token with the code
-	tok, err := oauthCfg.Exchange(oauth2.NoContext, code)
-	if err != nil {
-		log.Printf("failed to exchange with code => {%s}", err)
+	// only finish a sign in started from this session
+	state, _ := s.Values[oauthStateKey].(string)
+	verifier, _ := s.Values[pkceVerifierKey].(string)
+	if state == "" || verifier == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		http.Error(w, "This sign in wasn't started here or has expired, sign in again", http.StatusBadRequest)
 		return
 	}
+	if reason := r.FormValue("error"); reason != "" {
+		http.Error(w, fmt.Sprintf("Google didn't sign you in (%s)", reason), http.StatusForbidden)
+		return
+	}
+
+	// signing in starts a new session, under a new ID
+	st := requestStores(r)
+	if s.ID != "" {
+		st.Sessions.Delete(s.ID)
+		s.ID = ""
+	}
+	for key := range s.Values {
+		delete(s.Values, key)
+	}
+	s.Values[csrfTokenKey] = randomToken()
 
-	// stuff the token into the cookie
-	s.Values[tokenKey], err = json.Marshal(tok)
+	//Get the code from the response
+	code := r.FormValue("code")
+
+	// createa token with the code
+	tok, err := exchangeCode(code, verifier)
 	if err != nil {
-		log.Printf("failed to marshal token to JSON => {%s}", err)
+		log.Printf("failed to exchange with code => {%s}", err)
+		http.Error(w, "Failed to sign in with Google, try again", http.StatusBadGateway)
 		return
 	}
 
-	// get the user's email and add it to the cookie
+	// get the user's email and add it to the session
 	client := oauthCfg.Client(oauth2.NoContext, tok)
 	srv, err := googleOauth.New(client)
 	if err != nil {
 		log.Printf("failed to createa google oauth service => {%s}", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
 		return
 	}
+	if userinfoBasePath != "" {
+		srv.BasePath = userinfoBasePath
+	}
 	callRes, err := googleOauth.NewUserinfoService(srv).Get().Do()
 	if err != nil {
 		log.Printf("failed to make call to google plus => {%s}", err)
+		http.Error(w, "Failed to look up your Google account, try again", http.StatusBadGateway)
 		return
 	}
 	s.Values[userEmailKey] = callRes.Email
 	s.Values[userIDKey] = callRes.Id
 
-	// save the cookie and return
-	store.Save(r, w, s)
-
-	// redirect to the homepage
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// makeClient creates an oauth2 client from a session variable
-func makeClient(r *http.Request) *http.Client {
-	// grab the cookie
-	session, err := store.Get(r, sessionKey)
+	// keep the token server side, where requests and work done while the
+	// user is away find it
+	err = st.saveToken(callRes.Id, callRes.Email, tok)
 	if err != nil {
-		log.Printf("makeClient: Failed to find session => {%s}")
-		return nil
+		log.Printf("failed to store token for %s => {%s}", callRes.Email, err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
 	}
-
-	tok := new(oauth2.Token)
-	err = json.Unmarshal(session.Values[tokenKey].([]byte), tok)
+	resuming.Add(1)
+	go func() {
+		defer resuming.Done()
+		st.resumeSync(callRes.Id)
+	}()
+
+	// save the session and return
+	err = store.Save(r, w, s)
 	if err != nil {
-		log.Printf("makeClient: Failed to unmarshal token => {%s}")
-		return nil
-	}
-
-	// refresh token
-	/*
-		if !tok.Valid() {
-			// createa token with the code
-			newToken, err := oauthCfg.Exchange(oauth2.NoContext, session.Values[codeKey].(string))
-			if err != nil {
-				log.Printf("makeClient: failed to exchange with code => {%s}", err)
-				return nil
-			}
-
-			// stuff the token into the cookie
-			session.Values[tokenKey], err = json.Marshal(newToken)
-			if err != nil {
-				log.Printf("makeClient: failed to marshal token to JSON => {%s}", err)
-				return nil
-			}
-
-			tok = newToken
-		}
-	*/
-
-	return oauthCfg.Client(oauth2.NoContext, tok)
+		log.Printf("failed to save session => {%s}", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	// redirect to the homepage
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
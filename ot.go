@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	opInsert = "insert"
+	opDelete = "delete"
+
+	// maxRebaseDistance is how many revisions an Edit may lag behind the
+	// current document and still be transformed onto it.
+	maxRebaseDistance = 50
+
+	// maxApplyAttempts bounds the optimistic retries when several Edits
+	// race for the same revision.
+	maxApplyAttempts = 5
+
+	// snapshotInterval is how many revisions apart the document is stored
+	// with an Edit. The documents in between are rebuilt from the ops, so a
+	// draft doesn't hold a copy of itself per revision.
+	snapshotInterval = 50
+)
+
+var (
+	errStaleRevision   = errors.New("base revision is too old to rebase")
+	errUnknownRevision = errors.New("base revision does not exist yet")
+	errEditContention  = errors.New("draft is being edited too quickly, try again")
+)
+
+// invalidEditError is an Edit whose ops don't fit the document, which is the
+// client's fault.
+type invalidEditError string
+
+func (e invalidEditError) Error() string {
+	return string(e)
+}
+
+// Op is a single change to a document. Positions and counts are in runes,
+// and the Ops of an Edit apply one after the other.
+type Op struct {
+	Type  string `bson:"type" json:"type"`
+	Pos   int    `bson:"pos" json:"pos"`
+	Text  string `bson:"text,omitempty" json:"text,omitempty"`
+	Count int    `bson:"count,omitempty" json:"count,omitempty"`
+}
+
+// applyOps applies ops to doc in order.
+func applyOps(doc string, ops []Op) (string, error) {
+	text := []rune(doc)
+	for i, op := range ops {
+		if op.Pos < 0 || op.Pos > len(text) {
+			return "", invalidEditError(fmt.Sprintf("op %d: position %d out of range", i, op.Pos))
+		}
+		switch op.Type {
+		case opInsert:
+			ins := []rune(op.Text)
+			out := make([]rune, 0, len(text)+len(ins))
+			out = append(out, text[:op.Pos]...)
+			out = append(out, ins...)
+			text = append(out, text[op.Pos:]...)
+		case opDelete:
+			if op.Count < 0 || op.Pos+op.Count > len(text) {
+				return "", invalidEditError(fmt.Sprintf("op %d: delete of %d at %d out of range", i, op.Count, op.Pos))
+			}
+			text = append(text[:op.Pos:op.Pos], text[op.Pos+op.Count:]...)
+		default:
+			return "", invalidEditError(fmt.Sprintf("op %d: unknown type %q", i, op.Type))
+		}
+	}
+	return string(text), nil
+}
+
+// transform takes two lists of ops made against the same document and
+// returns a2, which applies a after b, and b2, which applies b after a.
+// At equal insert positions b goes first.
+func transform(a, b []Op) ([]Op, []Op) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+	if len(a) == 1 && len(b) == 1 {
+		return transformOp(a[0], b[0], false), transformOp(b[0], a[0], true)
+	}
+	if len(a) > 1 {
+		a1, b1 := transform(a[:1], b)
+		a2, b2 := transform(a[1:], b1)
+		return append(a1, a2...), b2
+	}
+	a1, b1 := transform(a, b[:1])
+	a2, b2 := transform(a1, b[1:])
+	return a2, append(b1, b2...)
+}
+
+// transformOp rewrites x so it applies after y. first decides which insert
+// goes first when both are at the same position.
+func transformOp(x, y Op, first bool) []Op {
+	switch {
+	case x.Type == opInsert && y.Type == opInsert:
+		if y.Pos < x.Pos || (y.Pos == x.Pos && !first) {
+			x.Pos += len([]rune(y.Text))
+		}
+	case x.Type == opInsert && y.Type == opDelete:
+		if x.Pos >= y.Pos+y.Count {
+			x.Pos -= y.Count
+		} else if x.Pos > y.Pos {
+			x.Pos = y.Pos
+		}
+	case x.Type == opDelete && y.Type == opInsert:
+		n := len([]rune(y.Text))
+		if y.Pos <= x.Pos {
+			x.Pos += n
+		} else if y.Pos < x.Pos+x.Count {
+			// the insert lands inside the deleted range, so delete around it
+			before := y.Pos - x.Pos
+			return []Op{
+				{Type: opDelete, Pos: x.Pos, Count: before},
+				{Type: opDelete, Pos: x.Pos + n, Count: x.Count - before},
+			}
+		}
+	case x.Type == opDelete && y.Type == opDelete:
+		xEnd, yEnd := x.Pos+x.Count, y.Pos+y.Count
+		if yEnd <= x.Pos {
+			x.Pos -= y.Count
+		} else if y.Pos < xEnd {
+			overlap := minInt(xEnd, yEnd) - maxInt(x.Pos, y.Pos)
+			x.Count -= overlap
+			x.Pos = minInt(x.Pos, y.Pos)
+			if x.Count == 0 {
+				return nil
+			}
+		}
+	}
+	return []Op{x}
+}
+
+// transformPos moves a position in a document through ops. An insert right
+// at the position pushes it along unless stick is set, which keeps it in
+// place; the end of a range sticks so text typed after it stays outside.
+func transformPos(pos int, ops []Op, stick bool) int {
+	for _, op := range ops {
+		switch op.Type {
+		case opInsert:
+			if op.Pos < pos || (op.Pos == pos && !stick) {
+				pos += len([]rune(op.Text))
+			}
+		case opDelete:
+			if pos >= op.Pos+op.Count {
+				pos -= op.Count
+			} else if pos > op.Pos {
+				pos = op.Pos
+			}
+		}
+	}
+	return pos
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// applyEdit rebases the ops of change from its BaseRevision onto the current
+// revision of a text field of a draft and stores the result as a new Edit.
+// Edits saved concurrently make it start over rather than get lost.
+func (st *Stores) applyEdit(draftID, field string, change Edit) (*Edit, error) {
+	base := change.BaseRevision
+	var edit Edit
+	_, err := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		current, ok := mail.textField(field)
+		if !ok {
+			return fmt.Errorf("unknown field %q", field)
+		}
+
+		switch {
+		case base > current.Revision:
+			return errUnknownRevision
+		case current.Revision-base > maxRebaseDistance:
+			return errStaleRevision
+		}
+
+		// bring the ops up to date with everything accepted since base
+		rebased := change.Ops
+		for _, e := range current.Edits {
+			if e.Revision > base {
+				rebased, _ = transform(rebased, e.Ops)
+			}
+		}
+
+		content, err := applyOps(current.Content, rebased)
+		if err != nil {
+			return err
+		}
+
+		edit = change
+		edit.Revision = current.Revision + 1
+		edit.Ops = rebased
+		edit.CreatedAt = time.Now()
+		stored := edit
+		if stored.snapshot() {
+			stored.Content = content
+		}
+		// the caller is handed the document either way
+		edit.Content = content
+		mail.setTextField(field, TextField{
+			Content:  content,
+			Revision: edit.Revision,
+			Edits:    append(current.Edits, stored),
+		})
+		mail.Approval.Approvals = []Approval{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &edit, nil
+}
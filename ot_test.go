@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func ins(pos int, text string) Op { return Op{Type: opInsert, Pos: pos, Text: text} }
+func del(pos, count int) Op       { return Op{Type: opDelete, Pos: pos, Count: count} }
+
+func TestTransformConverges(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		doc  string
+		a, b []Op
+		want string
+	}{
+		{"inserts apart", "hello world", []Op{ins(0, ">")}, []Op{ins(11, "!")}, ">hello world!"},
+		{"inserts at one place", "ab", []Op{ins(1, "x")}, []Op{ins(1, "y")}, "ayxb"},
+		{"insert before delete", "abcdef", []Op{ins(1, "x")}, []Op{del(3, 2)}, "axbcf"},
+		{"insert inside delete", "abcdef", []Op{ins(3, "x")}, []Op{del(1, 4)}, "axf"},
+		{"delete around insert", "abcdef", []Op{del(1, 4)}, []Op{ins(3, "x")}, "axf"},
+		{"same delete", "abcdef", []Op{del(2, 2)}, []Op{del(2, 2)}, "abef"},
+		{"overlapping deletes", "abcdef", []Op{del(1, 3)}, []Op{del(2, 3)}, "af"},
+		{"delete inside delete", "abcdef", []Op{del(0, 6)}, []Op{del(2, 1)}, ""},
+		{"unicode", "héllo", []Op{ins(2, "✓")}, []Op{del(0, 2)}, "✓llo"},
+		{"several ops", "one two three",
+			[]Op{del(0, 4), ins(3, "2")},
+			[]Op{ins(13, "!"), del(4, 4)},
+			"2three!"},
+		{"nothing against something", "abc", nil, []Op{del(0, 1)}, "bc"},
+	} {
+		a2, b2 := transform(c.a, c.b)
+		afterA, err := applyOps(c.doc, c.a)
+		if err != nil {
+			t.Fatalf("%s: applying a => {%s}", c.name, err)
+		}
+		afterB, err := applyOps(c.doc, c.b)
+		if err != nil {
+			t.Fatalf("%s: applying b => {%s}", c.name, err)
+		}
+		ab, err := applyOps(afterA, b2)
+		if err != nil {
+			t.Errorf("%s: applying b after a => {%s}", c.name, err)
+			continue
+		}
+		ba, err := applyOps(afterB, a2)
+		if err != nil {
+			t.Errorf("%s: applying a after b => {%s}", c.name, err)
+			continue
+		}
+		if ab != c.want || ba != c.want {
+			t.Errorf("%s: b after a = %q, a after b = %q, want %q", c.name, ab, ba, c.want)
+		}
+	}
+}
+
+func TestTransformPos(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		pos   int
+		ops   []Op
+		stick bool
+		want  int
+	}{
+		{"insert before", 5, []Op{ins(2, "abc")}, false, 8},
+		{"insert after", 5, []Op{ins(6, "abc")}, false, 5},
+		{"insert at", 5, []Op{ins(5, "abc")}, false, 8},
+		{"insert at, sticking", 5, []Op{ins(5, "abc")}, true, 5},
+		{"delete before", 5, []Op{del(0, 2)}, false, 3},
+		{"delete after", 5, []Op{del(5, 2)}, false, 5},
+		{"delete around", 5, []Op{del(3, 4)}, false, 3},
+		{"unicode insert", 1, []Op{ins(0, "✓✓")}, false, 3},
+		{"in order", 5, []Op{del(0, 5), ins(0, "ab")}, true, 0},
+		{"in order, pushed", 5, []Op{del(0, 5), ins(0, "ab")}, false, 2},
+	} {
+		if got := transformPos(c.pos, c.ops, c.stick); got != c.want {
+			t.Errorf("%s: position %d moved to %d, want %d", c.name, c.pos, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	roleOwner     = "owner"
+	roleEditor    = "editor"
+	roleCommenter = "commenter"
+	roleViewer    = "viewer"
+)
+
+// roleRank orders the roles, each one allowing everything the ones below it do
+var roleRank = map[string]int{
+	roleViewer:    1,
+	roleCommenter: 2,
+	roleEditor:    3,
+	roleOwner:     4,
+}
+
+type contextKey int
+
+const (
+	draftContextKey contextKey = iota
+	userContextKey
+	commentContextKey
+	requestIDContextKey
+	storesContextKey
+)
+
+// Member is the role a collaborator has on a draft.
+type Member struct {
+	Email string `bson:"email" json:"email"`
+	Role  string `bson:"role" json:"role"`
+}
+
+type roleRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// roleOf returns the role user has on mail, or "" if they have none. Drafts
+// created before roles existed give every collaborator the editor role.
+func roleOf(mail *Email, user string) string {
+	if user == mail.Owner {
+		return roleOwner
+	}
+	for _, m := range mail.Roles {
+		if m.Email == user {
+			return m.Role
+		}
+	}
+	for _, c := range mail.Collaborators {
+		if c == user {
+			return roleEditor
+		}
+	}
+	return ""
+}
+
+// members lists everyone with a role on mail, the owner first
+func members(mail *Email) []Member {
+	list := []Member{{Email: mail.Owner, Role: roleOwner}}
+	for _, m := range mail.Roles {
+		if m.Email != mail.Owner {
+			list = append(list, m)
+		}
+	}
+	for _, c := range mail.Collaborators {
+		if c != mail.Owner && roleOf(mail, c) == roleEditor && !hasMember(list, c) {
+			list = append(list, Member{Email: c, Role: roleEditor})
+		}
+	}
+	return list
+}
+
+func hasMember(list []Member, user string) bool {
+	for _, m := range list {
+		if m.Email == user {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether role grants at least the access of required
+func allows(role, required string) bool {
+	return role != "" && roleRank[role] >= roleRank[required]
+}
+
+// requireRole wraps a draft handler so it only runs for a signed in user
+// holding at least role on the draft named by the route. Sent drafts only
+// allow what viewers can do. The draft and user are stashed in the request
+// context for the handler.
+func requireRole(role string, h func(http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
+	return requireSession(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		draftID := p.ByName(draftIDParam)
+		user := requestUser(r)
+
+		mail, err := requestStores(r).Drafts.Get(draftID)
+		if err == mgo.ErrNotFound {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "No draft with id %s", draftID)
+			return
+		} else if err != nil {
+			internalError(w, r, "Failed to load draft", err)
+			return
+		}
+
+		has := roleOf(mail, user)
+		if !allows(has, role) {
+			log.Printf("refused %s %s to %s (%s, needs %s)", r.Method, r.URL.Path, user, has, role)
+			if has == "" {
+				writeError(w, r, http.StatusForbidden, codeForbidden, "%s is not a collaborator on draft %s", user, draftID)
+				return
+			}
+			writeError(w, r, http.StatusForbidden, codeForbidden, "%s is a %s on draft %s, this needs %s", user, has, draftID, role)
+			return
+		}
+		if mail.Sent != nil && role != roleViewer {
+			writeError(w, r, http.StatusConflict, codeReadOnly, "Draft %s was sent and is read-only", draftID)
+			return
+		}
+
+		context.Set(r, draftContextKey, mail)
+		h(w, r, p)
+	})
+}
+
+// requestDraft returns the draft loaded by requireRole
+func requestDraft(r *http.Request) *Email {
+	return context.Get(r, draftContextKey).(*Email)
+}
+
+// requestUser returns the user checked by requireSession
+func requestUser(r *http.Request) string {
+	return context.Get(r, userContextKey).(string)
+}
+
+// setRole lets the owner change the role of a collaborator
+func setRole(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mail := requestDraft(r)
+
+	var req roleRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if _, ok := roleRank[req.Role]; !ok || req.Role == roleOwner {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "Role must be one of %s, %s or %s", roleEditor, roleCommenter, roleViewer)
+		return
+	}
+	if req.Email == mail.Owner {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "The owner's role can't be changed, transfer ownership instead")
+		return
+	}
+	if roleOf(mail, req.Email) == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "%s is not a collaborator on draft %s", req.Email, mail.DraftID)
+		return
+	}
+
+	err := requestStores(r).setMemberRole(mail.DraftID, req.Email, req.Role)
+	if err != nil {
+		internalError(w, r, "Failed to set role", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &Member{Email: req.Email, Role: req.Role})
+}
+
+// setMemberRole adds user to the draft's collaborators, or changes their role
+// if they already are one.
+func (st *Stores) setMemberRole(draftID, user, role string) error {
+	_, err := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		mail.setMember(user, role)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	publishMemberEvent(draftID, user, role)
+	return nil
+}
+
+// publishMemberEvent tells a draft's subscribers that user now has role on
+// it, no role meaning they were removed. Their streams check their access
+// again on it.
+func publishMemberEvent(draftID, user, role string) {
+	publishDraftEvent(draftEvent{
+		Type:    eventMembers,
+		DraftID: draftID,
+		User:    user,
+		Member:  &Member{Email: user, Role: role},
+	})
+}
+
+// setMember gives user role on mail, adding them as a collaborator if needed
+func (m *Email) setMember(user, role string) {
+	for i := range m.Roles {
+		if m.Roles[i].Email == user {
+			m.Roles[i].Role = role
+			return
+		}
+	}
+	m.Roles = append(m.Roles, Member{Email: user, Role: role})
+	if !containsString(m.Collaborators, user) {
+		m.Collaborators = append(m.Collaborators, user)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// PubSub fans messages out to every subscriber of a topic. The in-memory
+// implementation only reaches subscribers in this process; running several
+// server processes needs an implementation backed by a shared broker.
+type PubSub interface {
+	Publish(topic string, msg []byte) error
+	Subscribe(topic string) (Subscription, error)
+}
+
+// Subscription delivers the messages published to a topic until it is closed.
+type Subscription interface {
+	Messages() <-chan []byte
+	Close() error
+}
+
+// pubsub is the broker used to broadcast draft events.
+var pubsub PubSub = newMemoryPubSub()
+
+// memoryPubSub is a PubSub local to this process.
+type memoryPubSub struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscription]struct{}
+}
+
+func newMemoryPubSub() *memoryPubSub {
+	return &memoryPubSub{topics: make(map[string]map[*memorySubscription]struct{})}
+}
+
+func (ps *memoryPubSub) Publish(topic string, msg []byte) error {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for sub := range ps.topics[topic] {
+		select {
+		case sub.ch <- msg:
+		default:
+			// drop rather than block everyone on a slow reader
+			log.Printf("memoryPubSub: dropping message for slow subscriber on %s", topic)
+		}
+	}
+	return nil
+}
+
+func (ps *memoryPubSub) Subscribe(topic string) (Subscription, error) {
+	sub := &memorySubscription{
+		ps:    ps,
+		topic: topic,
+		ch:    make(chan []byte, 64),
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.topics[topic] == nil {
+		ps.topics[topic] = make(map[*memorySubscription]struct{})
+	}
+	ps.topics[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+type memorySubscription struct {
+	ps    *memoryPubSub
+	topic string
+	ch    chan []byte
+	once  sync.Once
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+	return s.ch
+}
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() {
+		s.ps.mu.Lock()
+		defer s.ps.mu.Unlock()
+		delete(s.ps.topics[s.topic], s)
+		if len(s.ps.topics[s.topic]) == 0 {
+			delete(s.ps.topics, s.topic)
+		}
+		close(s.ch)
+	})
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/api/googleapi"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	scheduleCollection = "scheduled_sends"
+
+	scheduleWaiting   = "scheduled"
+	scheduleSent      = "sent"
+	scheduleFailed    = "failed"
+	scheduleCancelled = "cancelled"
+
+	eventScheduled = "scheduled"
+
+	// schedulePeriod is how often each server looks for sends that are due
+	schedulePeriod = 15 * time.Second
+
+	// scheduleLease is how long a server may hold a send before another one
+	// assumes it died and takes over. It is renewed every
+	// scheduleLeaseRenewal while the send is under way, which takes several
+	// Gmail calls of up to gmailTimeout each.
+	scheduleLease        = 2 * time.Minute
+	scheduleLeaseRenewal = scheduleLease / 3
+
+	maxScheduleAttempts = 5
+	scheduleRetryDelay  = 30 * time.Second
+)
+
+// schedulerID tells the servers sharing the database apart in leases.
+var schedulerID = bson.NewObjectId().Hex()
+
+// ScheduledSend is a draft waiting to be sent at SendAt. Servers take a
+// lease on it before sending, so only one of them sends it.
+type ScheduledSend struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DraftID     string        `bson:"draft_id" json:"draft_id"`
+	ScheduledBy string        `bson:"scheduled_by" json:"scheduled_by"`
+	SendAt      time.Time     `bson:"send_at" json:"send_at"`
+	Status      string        `bson:"status" json:"status"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	LastError   string        `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LeaseOwner  string        `bson:"lease_owner,omitempty" json:"-"`
+	LeaseUntil  time.Time     `bson:"lease_until,omitempty" json:"-"`
+	CreatedAt   time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+type scheduleRequest struct {
+	SendAt time.Time `json:"send_at"`
+}
+
+// runScheduler sends the drafts that are due, taking them one at a time
+// until none are left each period.
+func (st *Stores) runScheduler() {
+	tick := time.NewTicker(schedulePeriod)
+	defer tick.Stop()
+
+	for {
+		<-tick.C
+		for {
+			job, err := st.claimScheduledSend()
+			if err == mgo.ErrNotFound {
+				break
+			} else if err != nil {
+				log.Printf("runScheduler: failed to claim a send => {%s}", err)
+				break
+			}
+			st.runScheduledSend(job)
+		}
+	}
+}
+
+// claimScheduledSend leases the send that has been due the longest and isn't
+// leased to a live server
+func (st *Stores) claimScheduledSend() (*ScheduledSend, error) {
+	now := time.Now()
+	return st.Schedules.Claim(schedulerID, now, now.Add(scheduleLease))
+}
+
+// runScheduledSend sends a leased draft. Gmail errors that may go away are
+// retried later with a growing delay; anything else fails the send.
+func (st *Stores) runScheduledSend(job *ScheduledSend) {
+	mail, err := st.Drafts.Get(job.DraftID)
+	alreadySent := err == nil && mail.Sent != nil && !mail.Sent.Sending
+	if err == nil && !alreadySent {
+		stop := st.keepLease(job)
+		_, err = st.sendEmail(mail, job.ScheduledBy)
+		stop()
+	}
+
+	job.UpdatedAt = time.Now()
+	job.Attempts++
+	switch {
+	case alreadySent && job.LastError == errSendUnconfirmed.Error():
+		// the last attempt went out after all, as confirmSend found
+		job.Status = scheduleSent
+		job.LastError = ""
+	case alreadySent:
+		// it was sent by hand before it was due
+		job.Status = scheduleCancelled
+	case err == nil:
+		job.Status = scheduleSent
+		job.LastError = ""
+	case isTransient(err) && job.Attempts < maxScheduleAttempts:
+		log.Printf("runScheduledSend: retrying send of %s => {%s}", job.DraftID, err)
+		job.LastError = err.Error()
+		job.SendAt = time.Now().Add(scheduleRetryDelay * time.Duration(job.Attempts))
+	default:
+		log.Printf("runScheduledSend: failed to send %s => {%s}", job.DraftID, err)
+		job.Status = scheduleFailed
+		job.LastError = err.Error()
+	}
+
+	// only record the outcome if the lease is still ours
+	err = st.Schedules.Finish(job, schedulerID)
+	if err != nil {
+		log.Printf("runScheduledSend: failed to record send of %s => {%s}", job.DraftID, err)
+		return
+	}
+
+	if job.Status != scheduleWaiting {
+		publishDraftEvent(draftEvent{
+			Type:     eventScheduled,
+			DraftID:  job.DraftID,
+			User:     job.ScheduledBy,
+			Schedule: job,
+		})
+	}
+}
+
+// keepLease renews the lease on job until the returned func is called
+func (st *Stores) keepLease(job *ScheduledSend) func() {
+	done := make(chan struct{})
+	go func() {
+		renew := time.NewTicker(scheduleLeaseRenewal)
+		defer renew.Stop()
+		for {
+			select {
+			case <-renew.C:
+				err := st.Schedules.Renew(job, schedulerID, time.Now().Add(scheduleLease))
+				if err != nil {
+					log.Printf("keepLease: failed to renew lease on send of %s => {%s}", job.DraftID, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// isTransient reports whether a failed send is worth trying again: Gmail
+// rate limiting or failing, or the network. Anything else is permanent.
+func isTransient(err error) bool {
+	if err == errSendUnconfirmed {
+		// it's known whether it went out once Gmail is checked
+		return true
+	}
+	if gerr, ok := err.(*googleapi.Error); ok {
+		// 429 is Gmail rate limiting
+		return gerr.Code == 429 || gerr.Code >= 500
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// readScheduleRequest decodes a send time, which must be in the future
+func readScheduleRequest(w http.ResponseWriter, r *http.Request) (*scheduleRequest, bool) {
+	var req scheduleRequest
+	if !readJSON(w, r, &req) {
+		return nil, false
+	}
+	if !req.SendAt.After(time.Now()) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "send_at must be in the future")
+		return nil, false
+	}
+	return &req, true
+}
+
+// writeSchedule publishes a change to a draft's scheduled send and returns it
+func writeSchedule(w http.ResponseWriter, r *http.Request, status int, job *ScheduledSend) {
+	publishDraftEvent(draftEvent{
+		Type:     eventScheduled,
+		DraftID:  job.DraftID,
+		User:     requestUser(r),
+		Schedule: job,
+	})
+
+	writeJSON(w, status, job)
+}
+
+// draftSchedule returns the send waiting for a draft, if any
+func draftSchedule(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	job, err := requestStores(r).Schedules.Waiting(mail.DraftID)
+	if err == mgo.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Draft %s isn't scheduled", mail.DraftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to load schedule", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// scheduleSend schedules a draft to be sent from the owner's mailbox at
+// send_at. Approval is checked when it goes out, not now.
+func scheduleSend(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	req, ok := readScheduleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	st := requestStores(r)
+	_, err := st.Schedules.Waiting(mail.DraftID)
+	if err == nil {
+		writeError(w, r, http.StatusConflict, codeConflict, "Draft %s is already scheduled, reschedule it instead", mail.DraftID)
+		return
+	} else if err != mgo.ErrNotFound {
+		internalError(w, r, "Failed to load schedule", err)
+		return
+	}
+
+	now := time.Now()
+	job := ScheduledSend{
+		ID:          bson.NewObjectId(),
+		DraftID:     mail.DraftID,
+		ScheduledBy: requestUser(r),
+		SendAt:      req.SendAt,
+		Status:      scheduleWaiting,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = st.Schedules.Insert(&job)
+	if err == errAlreadyScheduled {
+		// scheduled by someone else since it was looked up
+		writeError(w, r, http.StatusConflict, codeConflict, "Draft %s is already scheduled, reschedule it instead", mail.DraftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to schedule draft", err)
+		return
+	}
+	writeSchedule(w, r, http.StatusCreated, &job)
+}
+
+// rescheduleSend moves the waiting send of a draft to a new time
+func rescheduleSend(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+	req, ok := readScheduleRequest(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := requestStores(r).Schedules.Reschedule(mail.DraftID, req.SendAt, time.Now())
+	writeScheduleChange(w, r, mail.DraftID, job, err)
+}
+
+// cancelSend calls off the waiting send of a draft
+func cancelSend(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mail := requestDraft(r)
+
+	job, err := requestStores(r).Schedules.Cancel(mail.DraftID, time.Now())
+	writeScheduleChange(w, r, mail.DraftID, job, err)
+}
+
+// writeScheduleChange answers a change to the waiting send of a draft, which
+// is refused while a server is sending it
+func writeScheduleChange(w http.ResponseWriter, r *http.Request, draftID string, job *ScheduledSend, err error) {
+	if err == mgo.ErrNotFound {
+		writeError(w, r, http.StatusConflict, codeConflict, "Draft %s isn't scheduled or is being sent", draftID)
+		return
+	} else if err != nil {
+		internalError(w, r, "Failed to update schedule", err)
+		return
+	}
+	writeSchedule(w, r, http.StatusOK, job)
+}
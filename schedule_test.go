@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsTransient(t *testing.T) {
+	dropped := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 403}, false},
+		{dropped, true},
+		{&url.Error{Op: "Post", URL: "https://gmail.googleapis.com", Err: dropped}, true},
+		{errSendUnconfirmed, true},
+		{errDraftOrphaned, false},
+		{errNeedsApproval, false},
+		{errors.New("Failed to build message"), false},
+	} {
+		if got := isTransient(c.err); got != c.want {
+			t.Errorf("isTransient(%#v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestScheduleRescheduleCancel(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+	path := apiPrefix + "/draft/id/" + draftID + "/schedule"
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	if status := owner.do("POST", path, scheduleRequest{SendAt: at}, nil); status != http.StatusCreated {
+		t.Fatalf("schedule = %d", status)
+	}
+	if status := owner.do("POST", path, scheduleRequest{SendAt: at}, nil); status != http.StatusConflict {
+		t.Fatalf("scheduling twice = %d, want 409", status)
+	}
+
+	var job ScheduledSend
+	later := at.Add(time.Hour)
+	if status := owner.do("POST", path+"/reschedule", scheduleRequest{SendAt: later}, &job); status != http.StatusOK || !job.SendAt.Equal(later) {
+		t.Fatalf("reschedule = %d, send at %s", status, job.SendAt)
+	}
+	if status := owner.do("GET", path, nil, &job); status != http.StatusOK || !job.SendAt.Equal(later) {
+		t.Fatalf("get = %d, send at %s", status, job.SendAt)
+	}
+
+	if status := owner.do("POST", path+"/cancel", nil, &job); status != http.StatusOK || job.Status != scheduleCancelled {
+		t.Fatalf("cancel = %d, status %s", status, job.Status)
+	}
+	if status := owner.do("GET", path, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("get after cancelling = %d, want 404", status)
+	}
+}
+
+// runDue runs the scheduled send of the test server that is due at at, as
+// the scheduler would then
+func (ts *testServer) runDue(at time.Time) *ScheduledSend {
+	job, err := ts.stores.Schedules.Claim(schedulerID, at, at.Add(scheduleLease))
+	if err != nil {
+		ts.t.Fatalf("claim at %s => {%s}", at, err)
+	}
+	ts.stores.runScheduledSend(job)
+	return job
+}
+
+func TestScheduledSendConfirmedLater(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	draftID := owner.shareDraft()
+
+	at := time.Now().Add(time.Hour)
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/schedule", scheduleRequest{SendAt: at}, nil); status != http.StatusCreated {
+		t.Fatalf("schedule = %d", status)
+	}
+
+	// Gmail sends it but fails to say so, so it is retried
+	ts.fake.FailNextSend(true)
+	job := ts.runDue(at)
+	if job.Status != scheduleWaiting || job.LastError != errSendUnconfirmed.Error() {
+		t.Fatalf("unconfirmed send left %s: %s", job.Status, job.LastError)
+	}
+
+	// confirming it meanwhile makes the retry record it as sent
+	ts.stores.confirmSend(draftID, maxSendConfirmAttempts)
+	job = ts.runDue(job.SendAt)
+	if job.Status != scheduleSent || job.LastError != "" {
+		t.Fatalf("confirmed send recorded as %s: %s", job.Status, job.LastError)
+	}
+	if len(ts.fake.Sent()) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(ts.fake.Sent()))
+	}
+}
+
+func TestClaimScheduledSend(t *testing.T) {
+	now := time.Now()
+	job := func(draftID string, sendAt time.Time, status, owner string, until time.Time) ScheduledSend {
+		return ScheduledSend{
+			ID:         bson.NewObjectId(),
+			DraftID:    draftID,
+			SendAt:     sendAt,
+			Status:     status,
+			LeaseOwner: owner,
+			LeaseUntil: until,
+		}
+	}
+	for _, c := range []struct {
+		name string
+		jobs []ScheduledSend
+		want string
+	}{
+		{"nothing due", []ScheduledSend{
+			job("later", now.Add(time.Hour), scheduleWaiting, "", time.Time{}),
+		}, ""},
+		{"longest due first", []ScheduledSend{
+			job("due", now.Add(-time.Minute), scheduleWaiting, "", time.Time{}),
+			job("overdue", now.Add(-time.Hour), scheduleWaiting, "", time.Time{}),
+		}, "overdue"},
+		{"leased elsewhere", []ScheduledSend{
+			job("leased", now.Add(-time.Hour), scheduleWaiting, "other", now.Add(time.Minute)),
+			job("due", now.Add(-time.Minute), scheduleWaiting, "", time.Time{}),
+		}, "due"},
+		{"lease ran out", []ScheduledSend{
+			job("abandoned", now.Add(-time.Hour), scheduleWaiting, "other", now.Add(-time.Minute)),
+		}, "abandoned"},
+		{"done already", []ScheduledSend{
+			job("sent", now.Add(-time.Hour), scheduleSent, "", time.Time{}),
+			job("cancelled", now.Add(-time.Hour), scheduleCancelled, "", time.Time{}),
+		}, ""},
+	} {
+		st := newMemoryStores()
+		for i := range c.jobs {
+			if err := st.Schedules.Insert(&c.jobs[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		claimed, err := st.claimScheduledSend()
+		if c.want == "" {
+			if err != mgo.ErrNotFound {
+				t.Errorf("%s: claimed %+v => {%v}, want nothing", c.name, claimed, err)
+			}
+			continue
+		}
+		if err != nil || claimed.DraftID != c.want {
+			t.Errorf("%s: claimed %+v => {%v}, want %s", c.name, claimed, err, c.want)
+			continue
+		}
+		if claimed.LeaseOwner != schedulerID || !claimed.LeaseUntil.After(now) {
+			t.Errorf("%s: lease = %s until %s", c.name, claimed.LeaseOwner, claimed.LeaseUntil)
+		}
+
+		// the lease keeps others off until it runs out
+		if other, err := st.Schedules.Claim("other", now, now.Add(scheduleLease)); err == nil && other.ID == claimed.ID {
+			t.Errorf("%s: claimed twice", c.name)
+		}
+		if _, err := st.Schedules.Cancel(claimed.DraftID, now); err != mgo.ErrNotFound {
+			t.Errorf("%s: cancelling a leased send => {%v}", c.name, err)
+		}
+		if _, err := st.Schedules.Claim("other", claimed.LeaseUntil.Add(time.Second), now.Add(2*scheduleLease)); err != nil {
+			t.Errorf("%s: claiming once the lease ran out => {%v}", c.name, err)
+		}
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name  string
+		owner string
+		// finish ends the lease before renewing it
+		finish bool
+		want   error
+	}{
+		{"held", schedulerID, false, nil},
+		{"held by another", "other", false, mgo.ErrNotFound},
+		{"finished", schedulerID, true, mgo.ErrNotFound},
+	} {
+		st := newMemoryStores()
+		job := &ScheduledSend{ID: bson.NewObjectId(), DraftID: "d1", SendAt: now, Status: scheduleWaiting}
+		if err := st.Schedules.Insert(job); err != nil {
+			t.Fatal(err)
+		}
+		job, err := st.claimScheduledSend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.finish {
+			if err := st.Schedules.Finish(job, schedulerID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		until := now.Add(3 * scheduleLease)
+		if err := st.Schedules.Renew(job, c.owner, until); err != c.want {
+			t.Errorf("%s: renew => {%v}, want {%v}", c.name, err, c.want)
+			continue
+		}
+		// a renewed lease outlives the one first taken
+		_, err = st.Schedules.Claim("other", now.Add(2*scheduleLease), until)
+		if renewed := c.want == nil; renewed != (err == mgo.ErrNotFound) {
+			t.Errorf("%s: claim after the first lease ran out => {%v}", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errAlreadyScheduled is returned by Insert when the draft already has a
+// send waiting
+var errAlreadyScheduled = errors.New("draft is already scheduled")
+
+// ScheduleStore keeps scheduled sends. Missing sends are reported as
+// mgo.ErrNotFound by every implementation.
+type ScheduleStore interface {
+	// Waiting returns the send waiting for a draft
+	Waiting(draftID string) (*ScheduledSend, error)
+
+	// Insert stores a new waiting send, reporting errAlreadyScheduled if the
+	// draft has one already
+	Insert(job *ScheduledSend) error
+
+	// Claim leases to owner until until the send that has been due the
+	// longest at now and isn't leased to a live server
+	Claim(owner string, now, until time.Time) (*ScheduledSend, error)
+
+	// Finish records the status, attempts, error and send time of job, which
+	// owner leased, and ends the lease. It reports mgo.ErrNotFound if the
+	// lease was lost meanwhile.
+	Finish(job *ScheduledSend, owner string) error
+
+	// Renew extends the lease owner holds on job until until. It reports
+	// mgo.ErrNotFound if the lease was lost meanwhile.
+	Renew(job *ScheduledSend, owner string, until time.Time) error
+
+	// Reschedule and Cancel change the waiting send of a draft, unless it
+	// is leased at now, and return it as changed
+	Reschedule(draftID string, sendAt, now time.Time) (*ScheduledSend, error)
+	Cancel(draftID string, now time.Time) (*ScheduledSend, error)
+
+	// CancelByDraft cancels the waiting send of a draft, leased or not
+	CancelByDraft(draftID string, now time.Time) error
+}
+
+// mongoScheduleStore keeps sends in the scheduled_sends collection.
+type mongoScheduleStore struct {
+	db *mgo.Database
+	c  *mgo.Collection
+}
+
+func newMongoScheduleStore(db *mgo.Database) *mongoScheduleStore {
+	return &mongoScheduleStore{db: db, c: db.C(scheduleCollection)}
+}
+
+// ensureIndexes indexes sends by when they are due and by draft, and keeps
+// a draft from having two sends waiting at once
+func (s *mongoScheduleStore) ensureIndexes() error {
+	err := s.c.EnsureIndexKey("status", "send_at")
+	if err != nil {
+		return err
+	}
+	err = s.c.EnsureIndexKey("draft_id", "status")
+	if err != nil {
+		return err
+	}
+
+	// mgo.Index has no partial filter, so the command is run as is
+	return s.db.Run(bson.D{
+		{Name: "createIndexes", Value: scheduleCollection},
+		{Name: "indexes", Value: []bson.M{{
+			"name":                    "draft_id_waiting",
+			"key":                     bson.M{"draft_id": 1},
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"status": scheduleWaiting},
+		}}},
+	}, nil)
+}
+
+func (s *mongoScheduleStore) Waiting(draftID string) (*ScheduledSend, error) {
+	var job ScheduledSend
+	err := s.c.Find(bson.M{
+		"draft_id": draftID,
+		"status":   scheduleWaiting,
+	}).One(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *mongoScheduleStore) Insert(job *ScheduledSend) error {
+	err := s.c.Insert(job)
+	if mgo.IsDup(err) {
+		return errAlreadyScheduled
+	}
+	return err
+}
+
+// notLeased matches the sends no live server holds at now
+func notLeased(now time.Time) []bson.M {
+	return []bson.M{
+		{"lease_until": nil},
+		{"lease_until": bson.M{"$lt": now}},
+	}
+}
+
+func (s *mongoScheduleStore) Claim(owner string, now, until time.Time) (*ScheduledSend, error) {
+	var job ScheduledSend
+	_, err := s.c.Find(bson.M{
+		"status":  scheduleWaiting,
+		"send_at": bson.M{"$lte": now},
+		"$or":     notLeased(now),
+	}).Sort("send_at").Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"lease_owner": owner,
+			"lease_until": until,
+		}},
+		ReturnNew: true,
+	}, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *mongoScheduleStore) Finish(job *ScheduledSend, owner string) error {
+	return s.c.Update(
+		bson.M{"_id": job.ID, "lease_owner": owner},
+		bson.M{
+			"$set": bson.M{
+				"status":     job.Status,
+				"attempts":   job.Attempts,
+				"last_error": job.LastError,
+				"send_at":    job.SendAt,
+				"updated_at": job.UpdatedAt,
+			},
+			"$unset": bson.M{"lease_owner": "", "lease_until": ""},
+		})
+}
+
+func (s *mongoScheduleStore) Renew(job *ScheduledSend, owner string, until time.Time) error {
+	return s.c.Update(
+		bson.M{"_id": job.ID, "lease_owner": owner},
+		bson.M{"$set": bson.M{"lease_until": until}})
+}
+
+// update changes the waiting send of a draft, unless it is leased at now
+func (s *mongoScheduleStore) update(draftID string, now time.Time, set bson.M) (*ScheduledSend, error) {
+	var job ScheduledSend
+	_, err := s.c.Find(bson.M{
+		"draft_id": draftID,
+		"status":   scheduleWaiting,
+		"$or":      notLeased(now),
+	}).Apply(mgo.Change{Update: bson.M{"$set": set}, ReturnNew: true}, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *mongoScheduleStore) Reschedule(draftID string, sendAt, now time.Time) (*ScheduledSend, error) {
+	return s.update(draftID, now, bson.M{
+		"send_at":    sendAt,
+		"attempts":   0,
+		"last_error": "",
+		"updated_at": now,
+	})
+}
+
+func (s *mongoScheduleStore) Cancel(draftID string, now time.Time) (*ScheduledSend, error) {
+	return s.update(draftID, now, bson.M{
+		"status":     scheduleCancelled,
+		"updated_at": now,
+	})
+}
+
+func (s *mongoScheduleStore) CancelByDraft(draftID string, now time.Time) error {
+	_, err := s.c.UpdateAll(
+		bson.M{"draft_id": draftID, "status": scheduleWaiting},
+		bson.M{"$set": bson.M{"status": scheduleCancelled, "updated_at": now}})
+	return err
+}
+
+// memoryScheduleStore keeps sends in this process, for tests.
+type memoryScheduleStore struct {
+	mu   sync.Mutex
+	jobs map[bson.ObjectId]ScheduledSend
+}
+
+func newMemoryScheduleStore() *memoryScheduleStore {
+	return &memoryScheduleStore{jobs: make(map[bson.ObjectId]ScheduledSend)}
+}
+
+// waiting returns the send waiting for a draft, if any
+func (s *memoryScheduleStore) waiting(draftID string) (ScheduledSend, bool) {
+	for _, job := range s.jobs {
+		if job.DraftID == draftID && job.Status == scheduleWaiting {
+			return job, true
+		}
+	}
+	return ScheduledSend{}, false
+}
+
+func (s *memoryScheduleStore) Waiting(draftID string) (*ScheduledSend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.waiting(draftID)
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return &job, nil
+}
+
+func (s *memoryScheduleStore) Insert(job *ScheduledSend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.waiting(job.DraftID); ok && job.Status == scheduleWaiting {
+		return errAlreadyScheduled
+	}
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+func (s *memoryScheduleStore) Claim(owner string, now, until time.Time) (*ScheduledSend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due *ScheduledSend
+	for _, job := range s.jobs {
+		if job.Status != scheduleWaiting || job.SendAt.After(now) || job.LeaseUntil.After(now) {
+			continue
+		}
+		if due == nil || job.SendAt.Before(due.SendAt) {
+			job := job
+			due = &job
+		}
+	}
+	if due == nil {
+		return nil, mgo.ErrNotFound
+	}
+	due.LeaseOwner, due.LeaseUntil = owner, until
+	s.jobs[due.ID] = *due
+	return due, nil
+}
+
+func (s *memoryScheduleStore) Finish(job *ScheduledSend, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.jobs[job.ID]
+	if !ok || stored.LeaseOwner != owner {
+		return mgo.ErrNotFound
+	}
+	stored.Status, stored.Attempts, stored.LastError = job.Status, job.Attempts, job.LastError
+	stored.SendAt, stored.UpdatedAt = job.SendAt, job.UpdatedAt
+	stored.LeaseOwner, stored.LeaseUntil = "", time.Time{}
+	s.jobs[job.ID] = stored
+	return nil
+}
+
+func (s *memoryScheduleStore) Renew(job *ScheduledSend, owner string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.jobs[job.ID]
+	if !ok || stored.LeaseOwner != owner {
+		return mgo.ErrNotFound
+	}
+	stored.LeaseUntil = until
+	s.jobs[job.ID] = stored
+	return nil
+}
+
+// update changes the waiting send of a draft, unless it is leased at now
+func (s *memoryScheduleStore) update(draftID string, now time.Time, change func(job *ScheduledSend)) (*ScheduledSend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.waiting(draftID)
+	if !ok || job.LeaseUntil.After(now) {
+		return nil, mgo.ErrNotFound
+	}
+	change(&job)
+	s.jobs[job.ID] = job
+	return &job, nil
+}
+
+func (s *memoryScheduleStore) Reschedule(draftID string, sendAt, now time.Time) (*ScheduledSend, error) {
+	return s.update(draftID, now, func(job *ScheduledSend) {
+		job.SendAt, job.Attempts, job.LastError, job.UpdatedAt = sendAt, 0, "", now
+	})
+}
+
+func (s *memoryScheduleStore) Cancel(draftID string, now time.Time) (*ScheduledSend, error) {
+	return s.update(draftID, now, func(job *ScheduledSend) {
+		job.Status, job.UpdatedAt = scheduleCancelled, now
+	})
+}
+
+func (s *memoryScheduleStore) CancelByDraft(draftID string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, job := range s.jobs {
+		if job.DraftID == draftID && job.Status == scheduleWaiting {
+			job.Status, job.UpdatedAt = scheduleCancelled, now
+			s.jobs[id] = job
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+
+	// maxSearchTerms is how many words of a query are searched for
+	maxSearchTerms = 10
+
+	// searchCandidates is how many drafts are fetched by text score before
+	// being ranked, per page of results
+	searchCandidates = 5
+
+	// highlightContext is how many characters are kept around the first
+	// match in a highlighted excerpt
+	highlightContext = 60
+
+	fieldComment = "comment"
+)
+
+// searchWeights is how much a match in each field counts towards the rank of
+// a draft
+var searchWeights = map[string]int{
+	fieldSubject: 5,
+	fieldTo:      3,
+	fieldCc:      3,
+	fieldBcc:     3,
+	fieldBody:    1,
+	fieldComment: 1,
+}
+
+// searchResult is a draft found by a search, with the excerpts that matched.
+type searchResult struct {
+	draftSummary
+	Matches []searchMatch `json:"matches"`
+}
+
+// searchMatch is an excerpt of a field that matched the search, cut into
+// segments so the client can highlight the matching ones.
+type searchMatch struct {
+	Field     string             `json:"field"`
+	CommentID string             `json:"comment_id,omitempty"`
+	Segments  []highlightSegment `json:"segments"`
+}
+
+type highlightSegment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// searchText is a piece of text a draft can be found by.
+type searchText struct {
+	field     string
+	commentID string
+	text      string
+}
+
+// searchTerms splits a query into the lowercase words to search for
+func searchTerms(query string) []string {
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), notWordRune) {
+		if !containsString(terms, word) && len(terms) < maxSearchTerms {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// draftTexts lists the text of mail that searches look at
+func draftTexts(mail *Email) []searchText {
+	subject, _ := mail.textField(fieldSubject)
+	body, _ := mail.textField(fieldBody)
+	texts := []searchText{
+		{field: fieldSubject, text: subject.Content},
+		{field: fieldBody, text: body.Content},
+	}
+	for _, field := range []string{fieldTo, fieldCc, fieldBcc} {
+		if list := mail.recipientField(field); len(list.Addresses) > 0 {
+			texts = append(texts, searchText{field: field, text: strings.Join(list.Addresses, ", ")})
+		}
+	}
+	return texts
+}
+
+// commentTexts lists the text of a comment thread that searches look at
+func commentTexts(c *Comment) []searchText {
+	id := c.ID.Hex()
+	texts := []searchText{{field: fieldComment, commentID: id, text: c.Body}}
+	if c.Suggestion != nil {
+		texts = append(texts, searchText{field: fieldComment, commentID: id, text: *c.Suggestion})
+	}
+	for _, reply := range c.Replies {
+		texts = append(texts, searchText{field: fieldComment, commentID: id, text: reply.Body})
+	}
+	return texts
+}
+
+// matchWords returns the [start, end) rune ranges of the words of text that
+// start with one of terms, so "send" finds "sending" much like Mongo's
+// stemming does
+func matchWords(text []rune, terms []string) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < len(text); {
+		if notWordRune(text[i]) {
+			i++
+			continue
+		}
+		end := i
+		for end < len(text) && !notWordRune(text[end]) {
+			end++
+		}
+		word := strings.ToLower(string(text[i:end]))
+		for _, term := range terms {
+			if strings.HasPrefix(word, term) {
+				ranges = append(ranges, [2]int{i, end})
+				break
+			}
+		}
+		i = end
+	}
+	return ranges
+}
+
+// searchScore weighs how well mail matches terms, 0 meaning not at all.
+// Comments are scored separately.
+func searchScore(mail *Email, terms []string) int {
+	score := 0
+	for _, t := range draftTexts(mail) {
+		score += searchWeights[t.field] * len(matchWords([]rune(t.text), terms))
+	}
+	return score
+}
+
+// highlight cuts an excerpt around the first matches of terms in text into
+// segments, or returns nil if nothing matches
+func highlight(text string, terms []string) []highlightSegment {
+	runes := []rune(text)
+	ranges := matchWords(runes, terms)
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	start, end := ranges[0][0]-highlightContext, ranges[0][1]+highlightContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	segments := []highlightSegment{}
+	add := func(from, to int, match bool) {
+		if from < to {
+			segments = append(segments, highlightSegment{Text: collapseSpace(runes[from:to]), Match: match})
+		}
+	}
+	pos := start
+	for _, r := range ranges {
+		if r[1] > end {
+			break
+		}
+		add(pos, r[0], false)
+		add(r[0], r[1], true)
+		pos = r[1]
+	}
+	add(pos, end, false)
+	return segments
+}
+
+// collapseSpace puts text on one line, turning each run of white space into
+// a single space
+func collapseSpace(text []rune) string {
+	out := make([]rune, 0, len(text))
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			if len(out) > 0 && out[len(out)-1] == ' ' {
+				continue
+			}
+			r = ' '
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// searchComments finds the comment threads containing any of terms on the
+// drafts user can see, by draft
+func (st *Stores) searchComments(user string, terms []string) (map[string][]Comment, error) {
+	draftIDs, err := st.Comments.DraftsMatching(terms)
+	if err != nil || len(draftIDs) == 0 {
+		return nil, err
+	}
+
+	// only keep the comments of drafts the user has a role on
+	mails, err := st.Drafts.List(DraftQuery{DraftIDs: draftIDs, Collaborator: user})
+	if err != nil || len(mails) == 0 {
+		return nil, err
+	}
+	visible := make([]string, len(mails))
+	for i := range mails {
+		visible[i] = mails[i].DraftID
+	}
+
+	comments, err := st.Comments.Search(terms, visible)
+	if err != nil {
+		return nil, err
+	}
+	byDraft := map[string][]Comment{}
+	for _, c := range comments {
+		byDraft[c.DraftID] = append(byDraft[c.DraftID], c)
+	}
+	return byDraft, nil
+}
+
+// searchDrafts finds the drafts the user has a role on whose subject, body,
+// recipients or comments contain the words of ?q=, best matches first
+func searchDrafts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := requestUser(r)
+	terms := searchTerms(r.FormValue("q"))
+	if len(terms) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "q must contain a word to search for")
+		return
+	}
+	limit := defaultSearchLimit
+	if l := r.FormValue("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be between 1 and %d", maxSearchLimit)
+			return
+		}
+		limit = n
+	}
+
+	st := requestStores(r)
+	mails, err := st.Drafts.Search(DraftQuery{Collaborator: user, Limit: limit * searchCandidates}, terms)
+	if err != nil {
+		internalError(w, r, "Failed to search drafts", err)
+		return
+	}
+	comments, err := st.searchComments(user, terms)
+	if err != nil {
+		internalError(w, r, "Failed to search comments", err)
+		return
+	}
+
+	// drafts only found by their comments still need loading
+	found := map[string]bool{}
+	for i := range mails {
+		found[mails[i].DraftID] = true
+	}
+	missing := []string{}
+	for draftID := range comments {
+		if !found[draftID] {
+			missing = append(missing, draftID)
+		}
+	}
+	if len(missing) > 0 {
+		more, err := st.Drafts.List(DraftQuery{DraftIDs: missing, Collaborator: user})
+		if err != nil {
+			internalError(w, r, "Failed to load drafts", err)
+			return
+		}
+		mails = append(mails, more...)
+	}
+
+	results := []searchResult{}
+	scores := map[string]int{}
+	for i := range mails {
+		mail := &mails[i]
+		texts := draftTexts(mail)
+		for j := range comments[mail.DraftID] {
+			texts = append(texts, commentTexts(&comments[mail.DraftID][j])...)
+		}
+
+		res := searchResult{draftSummary: newDraftSummary(mail, user), Matches: []searchMatch{}}
+		for _, t := range texts {
+			segments := highlight(t.text, terms)
+			if segments == nil {
+				continue
+			}
+			res.Matches = append(res.Matches, searchMatch{Field: t.field, CommentID: t.commentID, Segments: segments})
+			scores[mail.DraftID] += searchWeights[t.field] * len(matchWords([]rune(t.text), terms))
+		}
+		results = append(results, res)
+	}
+
+	// a draft Mongo matched through stemming alone keeps a score of 0 and
+	// goes last
+	sort.Stable(byRank{results, scores})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// byRank sorts search results by score, best first.
+type byRank struct {
+	results []searchResult
+	scores  map[string]int
+}
+
+func (s byRank) Len() int      { return len(s.results) }
+func (s byRank) Swap(i, j int) { s.results[i], s.results[j] = s.results[j], s.results[i] }
+func (s byRank) Less(i, j int) bool {
+	return s.scores[s.results[i].DraftID] > s.scores[s.results[j].DraftID]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// shareMessage shares a new Gmail draft with the given subject, recipient
+// and body
+func (c *testClient) shareMessage(subject, to, body string) string {
+	raw := fmt.Sprintf("Subject: %s\r\nTo: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s", subject, to, body)
+	draftID := c.ts.fake.AddDraft([]byte(raw))
+	if status := c.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, nil); status != http.StatusCreated {
+		c.ts.t.Fatalf("create = %d", status)
+	}
+	return draftID
+}
+
+func TestSearchRanksAndFilters(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	bob := ts.clientFor("u2", "bob@example.com")
+
+	drafts := map[string]string{
+		"subject":   owner.shareMessage("Budget review", "carol@example.com", "Numbers attached"),
+		"recipient": owner.shareMessage("Question", "budget@example.com", "Who signs off?"),
+		"body":      owner.shareMessage("Notes", "carol@example.com", "The budget, and the budgets after it"),
+		"comment":   owner.shareMessage("Plans", "carol@example.com", "Nothing yet"),
+		"unrelated": owner.shareMessage("Lunch", "carol@example.com", "See you at noon"),
+	}
+	comment := commentRequest{Anchor: Anchor{Start: 0, End: 7}, Body: "Is this in the budget?"}
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+drafts["comment"]+"/comments", comment, nil); status != http.StatusCreated {
+		t.Fatalf("comment = %d", status)
+	}
+	for _, name := range []string{"body", "comment"} {
+		if err := ts.stores.setMemberRole(drafts[name], "bob@example.com", roleViewer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		client *testClient
+		query  string
+		want   []string
+	}{
+		// a subject match weighs 5, a recipient 3, each body or comment match 1
+		{"owner", owner, "budget", []string{"subject", "recipient", "body", "comment"}},
+		{"by word start", owner, "budg", []string{"subject", "recipient", "body", "comment"}},
+		{"several words", owner, "review noon", []string{"subject", "unrelated"}},
+		{"collaborator", bob, "budget", []string{"body", "comment"}},
+		{"nothing visible", bob, "review", []string{}},
+		{"no match", owner, "invoice", []string{}},
+	} {
+		var results []searchResult
+		if status := c.client.do("GET", apiPrefix+"/draft/search?"+url.Values{"q": {c.query}}.Encode(), nil, &results); status != http.StatusOK {
+			t.Errorf("%s: search = %d", c.name, status)
+			continue
+		}
+		got := []string{}
+		for _, res := range results {
+			for name, draftID := range drafts {
+				if res.DraftID == draftID {
+					got = append(got, name)
+				}
+			}
+			if len(res.Matches) == 0 {
+				t.Errorf("%s: %s found without matches", c.name, res.DraftID)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: found %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	for _, query := range []string{"q=", "q=...", "q=budget&limit=0", "q=budget&limit=51"} {
+		if status := owner.do("GET", apiPrefix+"/draft/search?"+query, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("search ?%s = %d, want 400", query, status)
+		}
+	}
+}
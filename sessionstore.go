@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	sessionCollection = "sessions"
+
+	// sessionTTL is how long a session lasts after it was last saved
+	sessionTTL = 30 * 24 * time.Hour
+
+	// sessionSeenInterval is how stale the last seen time of a session may
+	// get before a request updates it
+	sessionSeenInterval = time.Minute
+
+	// legacyCodeKey and legacyTokenKey held the OAuth code and token in
+	// cookies from before sessions were kept server side. Tokens are in the
+	// token store.
+	legacyCodeKey  = "gmail-code"
+	legacyTokenKey = "gmail-token"
+
+	// legacyMarkerPrefix starts the ID of the marker kept for a user whose
+	// cookie store session was moved server side
+	legacyMarkerPrefix = "legacy-migrated-"
+)
+
+// legacyCookieKey is the key the cookie store signed cookies with. It is
+// only used to read them, never to sign anything.
+var legacyCookieKey = []byte("qwerty1234")
+
+// errLegacyCookie is the reason a cookie from the cookie store is refused
+var errLegacyCookie = errors.New("session cookie is from before sessions were kept server side")
+
+// storedSession is a session kept server side. The cookie only carries its
+// ID.
+type storedSession struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"user_id,omitempty"`
+	Email     string    `bson:"email,omitempty"`
+	Values    []byte    `bson:"values"` // gob encoded
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+
+	// IP, UserAgent and LastSeen describe the last request made with the
+	// session, so users can tell their sessions apart
+	IP        string    `bson:"ip"`
+	UserAgent string    `bson:"user_agent"`
+	LastSeen  time.Time `bson:"last_seen"`
+}
+
+// SessionStore keeps sessions. Missing and expired sessions are reported as
+// mgo.ErrNotFound by every implementation.
+type SessionStore interface {
+	Load(id string) (*storedSession, error)
+
+	// ListByUser returns the sessions a user is signed in to, most recently
+	// seen first
+	ListByUser(userID string) ([]storedSession, error)
+
+	// Save stores ss, keeping its creation time if it already exists
+	Save(ss *storedSession) error
+
+	// Seen records a request made with a session
+	Seen(id, ip, userAgent string, at time.Time) error
+
+	Delete(id string) error
+	DeleteByUser(userID string) error
+}
+
+// serverStore is a gorilla sessions.Store keeping sessions in Sessions.
+// Cookies hold the session ID, signed and encrypted with Codecs, the first of
+// which is used for new cookies so keys can be rotated. Cookies from before
+// sessions were kept server side, which hold the values themselves and were
+// signed with LegacyCodec, are read once per user until LegacyCutoff so they
+// can be replaced with an ID, and refused after.
+type serverStore struct {
+	Sessions SessionStore
+	Codecs   []securecookie.Codec
+	Options  *sessions.Options
+
+	LegacyCodec  securecookie.Codec
+	LegacyCutoff time.Time
+}
+
+// newServerStore makes a store keeping sessions in kept, whose cookies are
+// secured by keyPairs, given as for sessions.NewCookieStore
+func newServerStore(kept SessionStore, keyPairs ...[]byte) *serverStore {
+	return &serverStore{
+		Sessions: kept,
+		Codecs:   securecookie.CodecsFromPairs(keyPairs...),
+		// the cookie store only signed its cookies
+		LegacyCodec: securecookie.New(legacyCookieKey, nil),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(sessionTTL / time.Second),
+			HttpOnly: true,
+		},
+	}
+}
+
+// Get returns the session named name of r, loading it once per request.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named name of r, or returns a new one if r has no
+// session or an unknown or expired one. The error tells why a cookie
+// couldn't be used.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...)
+	if err != nil {
+		// a cookie from the cookie store holds the values themselves
+		values := map[interface{}]interface{}{}
+		if s.LegacyCodec.Decode(name, c.Value, &values) != nil {
+			return session, err
+		}
+		err = s.migrateLegacyCookie(values)
+		if err != nil {
+			return session, err
+		}
+		delete(values, legacyCodeKey)
+		delete(values, legacyTokenKey)
+		session.Values = values
+		session.IsNew = false
+		return session, nil
+	}
+
+	ss, err := s.Sessions.Load(id)
+	if err != nil {
+		return session, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(ss.Values)).Decode(&session.Values)
+	if err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+
+	if time.Since(ss.LastSeen) > sessionSeenInterval {
+		err = s.Sessions.Seen(id, clientIP(r), r.UserAgent(), time.Now())
+		if err != nil && err != mgo.ErrNotFound {
+			log.Printf("failed to record session activity => {%s}", err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores session and sets its cookie. A session with a negative MaxAge
+// is deleted along with its cookie.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.Sessions.Delete(session.ID)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	var values bytes.Buffer
+	err := gob.NewEncoder(&values).Encode(session.Values)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ss := &storedSession{
+		ID:        session.ID,
+		Values:    values.Bytes(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		LastSeen:  now,
+	}
+	ss.UserID, _ = session.Values[userIDKey].(string)
+	ss.Email, _ = session.Values[userEmailKey].(string)
+	err = s.Sessions.Save(ss)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// migrateLegacyCookie checks that the values of a cookie from the cookie
+// store may still be used, which they only can be once for a user who has no
+// other session. As the cookie can't be taken back, a copy of it would
+// otherwise outlive signing out. A marker kept in the session store until the
+// cutoff records that the user's cookie was used.
+func (s *serverStore) migrateLegacyCookie(values map[interface{}]interface{}) error {
+	now := time.Now()
+	if !now.Before(s.LegacyCutoff) {
+		return errLegacyCookie
+	}
+	userID, _ := values[userIDKey].(string)
+	if userID == "" {
+		return errLegacyCookie
+	}
+
+	_, err := s.Sessions.Load(legacyMarkerPrefix + userID)
+	if err == nil {
+		return errLegacyCookie
+	} else if err != mgo.ErrNotFound {
+		return err
+	}
+	list, err := s.Sessions.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		return errLegacyCookie
+	}
+
+	// the marker has no user, so signing out everywhere leaves it be
+	return s.Sessions.Save(&storedSession{
+		ID:        legacyMarkerPrefix + userID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: s.LegacyCutoff,
+		LastSeen:  now,
+	})
+}
+
+// newSessionID returns a new random session ID
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+// clientIP is the address r came from. Behind a proxy such as Heroku's
+// router, that is the last address the proxy added to X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// mongoSessionStore keeps sessions in the sessions collection.
+type mongoSessionStore struct {
+	c *mgo.Collection
+}
+
+func newMongoSessionStore(db *mgo.Database) *mongoSessionStore {
+	return &mongoSessionStore{c: db.C(sessionCollection)}
+}
+
+// ensureIndexes lets Mongo drop expired sessions and find those of a user
+func (s *mongoSessionStore) ensureIndexes() error {
+	err := s.c.EnsureIndex(mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second, // at expires_at; 0 would mean no TTL
+	})
+	if err != nil {
+		return err
+	}
+	return s.c.EnsureIndexKey("user_id", "-last_seen")
+}
+
+func (s *mongoSessionStore) Load(id string) (*storedSession, error) {
+	var ss storedSession
+	// Mongo only removes expired sessions every minute or so
+	err := s.c.Find(bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}}).One(&ss)
+	if err != nil {
+		return nil, err
+	}
+	return &ss, nil
+}
+
+func (s *mongoSessionStore) ListByUser(userID string) ([]storedSession, error) {
+	var list []storedSession
+	err := s.c.Find(bson.M{
+		"user_id":    userID,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Sort("-last_seen").All(&list)
+	return list, err
+}
+
+func (s *mongoSessionStore) Save(ss *storedSession) error {
+	_, err := s.c.UpsertId(ss.ID, bson.M{
+		"$set": bson.M{
+			"user_id":    ss.UserID,
+			"email":      ss.Email,
+			"values":     ss.Values,
+			"updated_at": ss.UpdatedAt,
+			"expires_at": ss.ExpiresAt,
+			"ip":         ss.IP,
+			"user_agent": ss.UserAgent,
+			"last_seen":  ss.LastSeen,
+		},
+		"$setOnInsert": bson.M{"created_at": ss.CreatedAt},
+	})
+	return err
+}
+
+func (s *mongoSessionStore) Seen(id, ip, userAgent string, at time.Time) error {
+	return s.c.UpdateId(id, bson.M{"$set": bson.M{
+		"ip":         ip,
+		"user_agent": userAgent,
+		"last_seen":  at,
+	}})
+}
+
+func (s *mongoSessionStore) Delete(id string) error {
+	return s.c.RemoveId(id)
+}
+
+func (s *mongoSessionStore) DeleteByUser(userID string) error {
+	_, err := s.c.RemoveAll(bson.M{"user_id": userID})
+	return err
+}
+
+// memorySessionStore keeps sessions in this process, for tests.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]storedSession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]storedSession)}
+}
+
+func (s *memorySessionStore) Load(id string) (*storedSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[id]
+	if !ok || !ss.ExpiresAt.After(time.Now()) {
+		return nil, mgo.ErrNotFound
+	}
+	return &ss, nil
+}
+
+func (s *memorySessionStore) ListByUser(userID string) ([]storedSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []storedSession{}
+	for _, ss := range s.sessions {
+		if ss.UserID == userID && ss.ExpiresAt.After(time.Now()) {
+			list = append(list, ss)
+		}
+	}
+	sort.Sort(byLastSeen(list))
+	return list, nil
+}
+
+func (s *memorySessionStore) Save(ss *storedSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.sessions[ss.ID]; ok {
+		ss.CreatedAt = old.CreatedAt
+	}
+	s.sessions[ss.ID] = *ss
+	return nil
+}
+
+func (s *memorySessionStore) Seen(id, ip, userAgent string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[id]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	ss.IP, ss.UserAgent, ss.LastSeen = ip, userAgent, at
+	s.sessions[id] = ss
+	return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) DeleteByUser(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ss := range s.sessions {
+		if ss.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// byLastSeen sorts sessions most recently seen first.
+type byLastSeen []storedSession
+
+func (s byLastSeen) Len() int           { return len(s) }
+func (s byLastSeen) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastSeen) Less(i, j int) bool { return s[i].LastSeen.After(s[j].LastSeen) }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// legacyCookie is a cookie as the cookie store used to set it, holding the
+// session values themselves
+func legacyCookie(t *testing.T) *http.Cookie {
+	values := map[interface{}]interface{}{
+		userIDKey:      "u1",
+		userEmailKey:   "owner@example.com",
+		legacyTokenKey: "old-token",
+	}
+	// what sessions.NewCookieStore([]byte("qwerty1234")) did
+	encoded, err := securecookie.New([]byte("qwerty1234"), nil).Encode(sessionKey, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: sessionKey, Value: encoded}
+}
+
+// getSessionWith fetches the session info with nothing but cookie
+func (ts *testServer) getSessionWith(cookie *http.Cookie) *http.Response {
+	req, _ := http.NewRequest("GET", ts.server.URL+apiPrefix+"/session", nil)
+	req.AddCookie(cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestLegacyCookieIsMigratedOnce(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	store.LegacyCutoff = time.Now().Add(time.Hour)
+	cookie := legacyCookie(t)
+
+	resp := ts.getSessionWith(cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first use of a legacy cookie = %d", resp.StatusCode)
+	}
+	var migrated *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionKey {
+			migrated = c
+		}
+	}
+	if migrated == nil || migrated.Value == cookie.Value {
+		t.Fatal("legacy cookie wasn't replaced")
+	}
+	list, _ := ts.stores.Sessions.ListByUser("u1")
+	if len(list) != 1 {
+		t.Fatalf("server side sessions = %d, want 1", len(list))
+	}
+	if ts.getSessionWith(migrated).StatusCode != http.StatusOK {
+		t.Fatal("migrated cookie doesn't work")
+	}
+
+	if status := ts.getSessionWith(cookie).StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("replayed legacy cookie = %d, want 401", status)
+	}
+
+	// signing out everywhere doesn't let it back in
+	ts.stores.Sessions.DeleteByUser("u1")
+	if status := ts.getSessionWith(cookie).StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("legacy cookie after signing out = %d, want 401", status)
+	}
+}
+
+func TestLegacyCookieRefusedWithServerSession(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	store.LegacyCutoff = time.Now().Add(time.Hour)
+	ts.signIn()
+
+	if status := ts.getSessionWith(legacyCookie(t)).StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("legacy cookie of a signed in user = %d, want 401", status)
+	}
+}
+
+func TestLegacyCookieRefusedAfterCutoff(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	store.LegacyCutoff = time.Now().Add(-time.Hour)
+
+	if status := ts.getSessionWith(legacyCookie(t)).StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("legacy cookie after the cutoff = %d, want 401", status)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stores are where the server keeps its data. Handlers find them in the
+// request context, see withStores, and background work is handed them, so
+// the whole server can run on the in-memory stores.
+type Stores struct {
+	Drafts    DraftStore
+	Tokens    TokenStore
+	Sessions  SessionStore
+	Comments  CommentStore
+	Invites   InviteStore
+	Schedules ScheduleStore
+	Mailboxes MailboxStore
+	Blobs     BlobStore
+}
+
+// newMemoryStores keeps everything in this process, for tests.
+func newMemoryStores() *Stores {
+	return &Stores{
+		Drafts:    newMemoryDraftStore(),
+		Tokens:    newMemoryTokenStore(),
+		Sessions:  newMemorySessionStore(),
+		Comments:  newMemoryCommentStore(),
+		Invites:   newMemoryInviteStore(),
+		Schedules: newMemoryScheduleStore(),
+		Mailboxes: newMemoryMailboxStore(),
+		Blobs:     newMemoryBlobStore(),
+	}
+}
+
+// newMongoStores keeps everything in db, creating the indexes it needs
+func newMongoStores(db *mgo.Database) (*Stores, error) {
+	drafts := newMongoDraftStore(db)
+	if err := drafts.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create draft indexes => {%s}", err)
+	}
+	if err := drafts.backfillActivity(); err != nil {
+		return nil, fmt.Errorf("Cannot backfill draft activity => {%s}", err)
+	}
+	tokens := newMongoTokenStore(db)
+	if err := tokens.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create token indexes => {%s}", err)
+	}
+	sessions := newMongoSessionStore(db)
+	if err := sessions.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create session indexes => {%s}", err)
+	}
+	comments := newMongoCommentStore(db)
+	if err := comments.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create comment indexes => {%s}", err)
+	}
+	invites := newMongoInviteStore(db)
+	if err := invites.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create invitation indexes => {%s}", err)
+	}
+	schedules := newMongoScheduleStore(db)
+	if err := schedules.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create schedule indexes => {%s}", err)
+	}
+	mailboxes := newMongoMailboxStore(db)
+	if err := mailboxes.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create mailbox indexes => {%s}", err)
+	}
+	blobs := newMongoBlobStore(db)
+	if err := blobs.ensureIndexes(); err != nil {
+		return nil, fmt.Errorf("Cannot create attachment indexes => {%s}", err)
+	}
+
+	return &Stores{
+		Drafts:    drafts,
+		Tokens:    tokens,
+		Sessions:  sessions,
+		Comments:  comments,
+		Invites:   invites,
+		Schedules: schedules,
+		Mailboxes: mailboxes,
+		Blobs:     blobs,
+	}, nil
+}
+
+// DraftStore keeps the shared drafts. Drafts are written whole, and Save only
+// succeeds if nobody else saved the draft since it was read, so changes are
+// made with updateDraft rather than by patching fields in place. Missing
+// drafts are reported as mgo.ErrNotFound by every implementation.
+type DraftStore interface {
+	Get(draftID string) (*Email, error)
+	Insert(mail *Email) error
+	Save(mail *Email) error
+	Delete(draftID string) error
+	List(q DraftQuery) ([]Email, error)
+
+	// Search returns up to q.Limit of the drafts selected by q that contain
+	// any of terms in their subject, body or recipients, best matches first
+	Search(q DraftQuery, terms []string) ([]Email, error)
+
+	// MailboxIDs returns the mailboxes holding the drafts selected by q,
+	// once each
+	MailboxIDs(q DraftQuery) ([]string, error)
+}
+
+// DraftQuery selects drafts for List. Empty fields match every draft.
+type DraftQuery struct {
+	DraftIDs          []string
+	Collaborator      string
+	MailboxID         string
+	SyncStates        []string
+	ExcludeSyncStates []string
+
+	// ArchivedBy matches drafts the user archived, NotArchivedBy those they
+	// didn't. Only one of them should be set.
+	ArchivedBy    string
+	NotArchivedBy string
+
+	// Owner matches drafts owned by the user, NotOwner those owned by
+	// someone else
+	Owner    string
+	NotOwner string
+
+	// PendingApproval matches drafts still waiting for an approval,
+	// NoPendingApproval those that aren't
+	PendingApproval   bool
+	NoPendingApproval bool
+
+	// ModifiedSince matches drafts changed after it
+	ModifiedSince time.Time
+
+	// MaxSyncAttempts matches drafts with fewer sync attempts than it
+	MaxSyncAttempts int
+
+	// SendClaimedBefore matches drafts whose send was claimed before it and
+	// isn't confirmed yet
+	SendClaimedBefore time.Time
+
+	// ByActivity orders the drafts by when they last changed, most recent
+	// first unless Ascending. After then resumes the listing past a draft.
+	ByActivity bool
+	Ascending  bool
+	After      *activityMark
+
+	// Limit is the most drafts to return, 0 for all of them
+	Limit int
+}
+
+// activityMark is the position of a draft in a listing by activity.
+type activityMark struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	DraftID   string    `json:"draft_id"`
+}
+
+// before reports whether a draft at m comes before one at other in a listing
+// by activity
+func (m activityMark) before(other activityMark, ascending bool) bool {
+	if !m.UpdatedAt.Equal(other.UpdatedAt) {
+		return m.UpdatedAt.Before(other.UpdatedAt) == ascending
+	}
+	return m.DraftID != other.DraftID && (m.DraftID < other.DraftID) == ascending
+}
+
+func markOf(mail *Email) activityMark {
+	return activityMark{UpdatedAt: mail.UpdatedAt, DraftID: mail.DraftID}
+}
+
+// errVersionConflict is returned by Save when the draft was saved by someone
+// else since it was read.
+var errVersionConflict = errors.New("draft was changed concurrently")
+
+// updateDraft reads a draft from drafts, lets change modify it and saves it,
+// starting over if the draft was saved by someone else in between. An error
+// from change is returned as is and nothing is saved.
+func updateDraft(drafts DraftStore, draftID string, change func(mail *Email) error) (*Email, error) {
+	for attempt := 0; attempt < maxApplyAttempts; attempt++ {
+		mail, err := drafts.Get(draftID)
+		if err != nil {
+			return nil, err
+		}
+		err = change(mail)
+		if err != nil {
+			return nil, err
+		}
+		mail.refreshActivity()
+
+		err = drafts.Save(mail)
+		if err == errVersionConflict {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return mail, nil
+	}
+	return nil, errEditContention
+}
+
+// versionSelector matches a stored version, treating version 0 as a draft
+// saved before drafts had versions
+func versionSelector(version int) interface{} {
+	if version == 0 {
+		return nil
+	}
+	return version
+}
+
+// mongoDraftStore keeps drafts in the emails collection.
+type mongoDraftStore struct {
+	c *mgo.Collection
+}
+
+func newMongoDraftStore(db *mgo.Database) *mongoDraftStore {
+	return &mongoDraftStore{c: db.C(emailCollection)}
+}
+
+// ensureIndexes indexes drafts by ID and by who can see them, in the order
+// they are listed in, the sends left claimed and the text they are searched
+// by
+func (s *mongoDraftStore) ensureIndexes() error {
+	err := s.c.EnsureIndexKey("draft_id")
+	if err != nil {
+		return err
+	}
+	// only drafts being sent have a claim time
+	err = s.c.EnsureIndex(mgo.Index{Key: []string{"sent.claimed_at"}, Sparse: true})
+	if err != nil {
+		return err
+	}
+	err = s.c.EnsureIndexKey("collaborators", "-updated_at", "-draft_id")
+	if err != nil {
+		return err
+	}
+	return s.c.EnsureIndex(mgo.Index{
+		Key: []string{
+			"$text:subject.content", "$text:content",
+			"$text:to.addresses", "$text:cc.addresses", "$text:bcc.addresses",
+		},
+		Name:    "draft_text",
+		Weights: map[string]int{"subject.content": 5, "to.addresses": 3, "cc.addresses": 3, "bcc.addresses": 3},
+	})
+}
+
+// backfillActivity works out the fields drafts are listed by for drafts
+// stored before those fields existed
+func (s *mongoDraftStore) backfillActivity() error {
+	var stale []struct {
+		DraftID string `bson:"draft_id"`
+	}
+	err := s.c.Find(bson.M{"updated_at": bson.M{"$exists": false}}).Select(bson.M{"draft_id": 1}).All(&stale)
+	if err != nil {
+		return err
+	}
+	for _, d := range stale {
+		// updateDraft refreshes the fields on the way
+		_, err = updateDraft(s, d.DraftID, func(mail *Email) error { return nil })
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoDraftStore) Get(draftID string) (*Email, error) {
+	var mail Email
+	err := s.c.Find(bson.M{"draft_id": draftID}).One(&mail)
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (s *mongoDraftStore) Insert(mail *Email) error {
+	mail.Version = 1
+	return s.c.Insert(mail)
+}
+
+func (s *mongoDraftStore) Save(mail *Email) error {
+	version := mail.Version
+	mail.Version++
+	err := s.c.Update(bson.M{"draft_id": mail.DraftID, "version": versionSelector(version)}, mail)
+	if err == mgo.ErrNotFound {
+		mail.Version = version
+		return errVersionConflict
+	} else if err != nil {
+		mail.Version = version
+		return err
+	}
+	return nil
+}
+
+func (s *mongoDraftStore) Delete(draftID string) error {
+	return s.c.Remove(bson.M{"draft_id": draftID})
+}
+
+// selector is the Mongo query matching the drafts q selects
+func (q DraftQuery) selector() bson.M {
+	query := bson.M{}
+	if len(q.DraftIDs) > 0 {
+		query["draft_id"] = bson.M{"$in": q.DraftIDs}
+	}
+	if q.Collaborator != "" {
+		query["collaborators"] = q.Collaborator
+	}
+	if q.MailboxID != "" {
+		query["mailbox_id"] = q.MailboxID
+	}
+	if q.ArchivedBy != "" {
+		query["archived_by"] = q.ArchivedBy
+	} else if q.NotArchivedBy != "" {
+		query["archived_by"] = bson.M{"$ne": q.NotArchivedBy}
+	}
+	if q.Owner != "" {
+		query["owner"] = q.Owner
+	} else if q.NotOwner != "" {
+		query["owner"] = bson.M{"$ne": q.NotOwner}
+	}
+	if q.PendingApproval {
+		query["pending_approvers.0"] = bson.M{"$exists": true}
+	} else if q.NoPendingApproval {
+		query["pending_approvers.0"] = bson.M{"$exists": false}
+	}
+	if !q.ModifiedSince.IsZero() {
+		query["updated_at"] = bson.M{"$gt": q.ModifiedSince}
+	}
+	states := bson.M{}
+	if len(q.SyncStates) > 0 {
+		states["$in"] = q.SyncStates
+	}
+	if len(q.ExcludeSyncStates) > 0 {
+		states["$nin"] = q.ExcludeSyncStates
+	}
+	if len(states) > 0 {
+		query["sync.state"] = states
+	}
+	if q.MaxSyncAttempts > 0 {
+		query["sync.attempts"] = bson.M{"$lt": q.MaxSyncAttempts}
+	}
+	if !q.SendClaimedBefore.IsZero() {
+		query["sent.sending"] = true
+		query["sent.claimed_at"] = bson.M{"$lt": q.SendClaimedBefore}
+	}
+	return query
+}
+
+func (s *mongoDraftStore) List(q DraftQuery) ([]Email, error) {
+	query := q.selector()
+	find := s.c.Find(query)
+	if q.ByActivity {
+		find = s.sortByActivity(query, q)
+	}
+	if q.Limit > 0 {
+		find = find.Limit(q.Limit)
+	}
+	mails := []Email{}
+	err := find.All(&mails)
+	return mails, err
+}
+
+func (s *mongoDraftStore) MailboxIDs(q DraftQuery) ([]string, error) {
+	var ids []string
+	err := s.c.Find(q.selector()).Distinct("mailbox_id", &ids)
+	return ids, err
+}
+
+func (s *mongoDraftStore) Search(q DraftQuery, terms []string) ([]Email, error) {
+	query := q.selector()
+	query["$text"] = bson.M{"$search": strings.Join(terms, " ")}
+
+	find := s.c.Find(query).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score")
+	if q.Limit > 0 {
+		find = find.Limit(q.Limit)
+	}
+	var found []struct {
+		Email `bson:",inline"`
+		Score float64 `bson:"score"`
+	}
+	err := find.All(&found)
+	if err != nil {
+		return nil, err
+	}
+	mails := make([]Email, len(found))
+	for i := range found {
+		mails[i] = found[i].Email
+	}
+	return mails, nil
+}
+
+// sortByActivity sorts the drafts matched by query by activity, starting
+// past q.After
+func (s *mongoDraftStore) sortByActivity(query bson.M, q DraftQuery) *mgo.Query {
+	past, order := "$lt", []string{"-updated_at", "-draft_id"}
+	if q.Ascending {
+		past, order = "$gt", []string{"updated_at", "draft_id"}
+	}
+	if q.After != nil {
+		query = bson.M{"$and": []bson.M{query, {"$or": []bson.M{
+			{"updated_at": bson.M{past: q.After.UpdatedAt}},
+			{"updated_at": q.After.UpdatedAt, "draft_id": bson.M{past: q.After.DraftID}},
+		}}}}
+	}
+	return s.c.Find(query).Sort(order...)
+}
+
+// memoryDraftStore keeps drafts in this process, for tests. Drafts are kept
+// bson encoded so callers never share one.
+type memoryDraftStore struct {
+	mu     sync.Mutex
+	drafts map[string][]byte
+}
+
+func newMemoryDraftStore() *memoryDraftStore {
+	return &memoryDraftStore{drafts: make(map[string][]byte)}
+}
+
+func (s *memoryDraftStore) Get(draftID string) (*Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(draftID)
+}
+
+func (s *memoryDraftStore) get(draftID string) (*Email, error) {
+	buf, ok := s.drafts[draftID]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	var mail Email
+	err := bson.Unmarshal(buf, &mail)
+	if err != nil {
+		return nil, err
+	}
+	return &mail, nil
+}
+
+func (s *memoryDraftStore) Insert(mail *Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mail.Version = 1
+	buf, err := bson.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	s.drafts[mail.DraftID] = buf
+	return nil
+}
+
+func (s *memoryDraftStore) Save(mail *Email) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.get(mail.DraftID)
+	if err == mgo.ErrNotFound || (err == nil && current.Version != mail.Version) {
+		return errVersionConflict
+	} else if err != nil {
+		return err
+	}
+
+	mail.Version++
+	buf, err := bson.Marshal(mail)
+	if err != nil {
+		mail.Version--
+		return err
+	}
+	s.drafts[mail.DraftID] = buf
+	return nil
+}
+
+func (s *memoryDraftStore) Delete(draftID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.drafts[draftID]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(s.drafts, draftID)
+	return nil
+}
+
+func (s *memoryDraftStore) List(q DraftQuery) ([]Email, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.drafts))
+	for id := range s.drafts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	mails := []Email{}
+	for _, id := range ids {
+		mail, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if q.matches(mail) {
+			mails = append(mails, *mail)
+		}
+	}
+	if q.ByActivity {
+		sort.Sort(byActivity{mails, q.Ascending})
+	}
+	if q.Limit > 0 && len(mails) > q.Limit {
+		mails = mails[:q.Limit]
+	}
+	return mails, nil
+}
+
+func (s *memoryDraftStore) MailboxIDs(q DraftQuery) ([]string, error) {
+	mails, err := s.List(q)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, mail := range mails {
+		if !containsString(ids, mail.MailboxID) {
+			ids = append(ids, mail.MailboxID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memoryDraftStore) Search(q DraftQuery, terms []string) ([]Email, error) {
+	limit := q.Limit
+	q.Limit = 0
+	mails, err := s.List(q)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []Email{}
+	scores := map[string]int{}
+	for _, mail := range mails {
+		if score := searchScore(&mail, terms); score > 0 {
+			found = append(found, mail)
+			scores[mail.DraftID] = score
+		}
+	}
+	sort.Stable(byScore{found, scores})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// byScore sorts drafts by their search score, best first.
+type byScore struct {
+	mails  []Email
+	scores map[string]int
+}
+
+func (s byScore) Len() int      { return len(s.mails) }
+func (s byScore) Swap(i, j int) { s.mails[i], s.mails[j] = s.mails[j], s.mails[i] }
+func (s byScore) Less(i, j int) bool {
+	return s.scores[s.mails[i].DraftID] > s.scores[s.mails[j].DraftID]
+}
+
+// byActivity sorts drafts the way they are listed by activity.
+type byActivity struct {
+	mails     []Email
+	ascending bool
+}
+
+func (s byActivity) Len() int      { return len(s.mails) }
+func (s byActivity) Swap(i, j int) { s.mails[i], s.mails[j] = s.mails[j], s.mails[i] }
+func (s byActivity) Less(i, j int) bool {
+	return markOf(&s.mails[i]).before(markOf(&s.mails[j]), s.ascending)
+}
+
+// matches reports whether mail is selected by q
+func (q DraftQuery) matches(mail *Email) bool {
+	if len(q.DraftIDs) > 0 && !containsString(q.DraftIDs, mail.DraftID) {
+		return false
+	}
+	if q.Collaborator != "" && !containsString(mail.Collaborators, q.Collaborator) {
+		return false
+	}
+	if q.MailboxID != "" && mail.MailboxID != q.MailboxID {
+		return false
+	}
+	if q.ArchivedBy != "" && !containsString(mail.ArchivedBy, q.ArchivedBy) {
+		return false
+	}
+	if q.NotArchivedBy != "" && containsString(mail.ArchivedBy, q.NotArchivedBy) {
+		return false
+	}
+	if q.Owner != "" && mail.Owner != q.Owner {
+		return false
+	}
+	if q.NotOwner != "" && mail.Owner == q.NotOwner {
+		return false
+	}
+	if q.PendingApproval && len(mail.PendingApprovers) == 0 {
+		return false
+	}
+	if q.NoPendingApproval && len(mail.PendingApprovers) > 0 {
+		return false
+	}
+	if !q.ModifiedSince.IsZero() && !mail.UpdatedAt.After(q.ModifiedSince) {
+		return false
+	}
+	if q.After != nil && !q.After.before(markOf(mail), q.Ascending) {
+		return false
+	}
+	if len(q.SyncStates) > 0 && !containsString(q.SyncStates, mail.Sync.State) {
+		return false
+	}
+	if containsString(q.ExcludeSyncStates, mail.Sync.State) {
+		return false
+	}
+	if q.MaxSyncAttempts > 0 && mail.Sync.Attempts >= q.MaxSyncAttempts {
+		return false
+	}
+	if !q.SendClaimedBefore.IsZero() && (mail.Sent == nil || !mail.Sent.Sending || !mail.Sent.ClaimedAt.Before(q.SendClaimedBefore)) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	eventEdit     = "edit"
+	eventPresence = "presence"
+	eventCursor   = "cursor"
+	eventOrphaned = "orphaned"
+	eventDisabled = "sync_disabled"
+	eventMembers  = "members"
+
+	presenceJoined = "joined"
+	presenceHere   = "here"
+	presenceLeft   = "left"
+
+	// presenceInterval is how often a connected viewer re-announces itself,
+	// so clients can drop viewers whose server went away without a "left".
+	presenceInterval = 15 * time.Second
+)
+
+// draftEvent is broadcast to every collaborator streaming a draft.
+type draftEvent struct {
+	Type       string         `json:"type"`
+	DraftID    string         `json:"draft_id"`
+	User       string         `json:"user"`
+	Field      string         `json:"field,omitempty"`
+	Edit       *Edit          `json:"edit,omitempty"`
+	Recipients *RecipientEdit `json:"recipients,omitempty"`
+	Attachment *Attachment    `json:"attachment,omitempty"`
+	Schedule   *ScheduledSend `json:"schedule,omitempty"`
+	Presence   string         `json:"presence,omitempty"`
+	Cursor     *Cursor        `json:"cursor,omitempty"`
+	Member     *Member        `json:"member,omitempty"`
+}
+
+// Cursor is a collaborator's caret or selection at a given revision.
+type Cursor struct {
+	Revision int `json:"revision"`
+	Pos      int `json:"pos"`
+	Length   int `json:"length,omitempty"`
+}
+
+func draftTopic(draftID string) string {
+	return "draft:" + draftID
+}
+
+// publishDraftEvent broadcasts ev to the draft's subscribers
+func publishDraftEvent(ev draftEvent) {
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("failed to marshal %s event => {%s}", ev.Type, err)
+		return
+	}
+	err = pubsub.Publish(draftTopic(ev.DraftID), buf)
+	if err != nil {
+		log.Printf("failed to publish %s event for %s => {%s}", ev.Type, ev.DraftID, err)
+	}
+}
+
+// canStream tells whether user may still stream a draft. Collaborators can
+// be removed, and the draft deleted, while they are connected.
+func (st *Stores) canStream(draftID, user string) (bool, error) {
+	mail, err := st.Drafts.Get(draftID)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return allows(roleOf(mail, user), roleViewer), nil
+}
+
+// draftStream streams the edits, presence and cursors of a draft to a
+// collaborator as Server-Sent Events. The stream ends once the draft is
+// deleted or the collaborator loses access to it.
+func draftStream(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	draftID := p.ByName(draftIDParam)
+	user := requestUser(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Streaming is not supported")
+		return
+	}
+
+	sub, err := pubsub.Subscribe(draftTopic(draftID))
+	if err != nil {
+		internalError(w, r, "Failed to subscribe to draft", err)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	presence := draftEvent{Type: eventPresence, DraftID: draftID, User: user}
+	presence.Presence = presenceJoined
+	publishDraftEvent(presence)
+	defer func() {
+		presence.Presence = presenceLeft
+		publishDraftEvent(presence)
+	}()
+
+	heartbeat := time.NewTicker(presenceInterval)
+	defer heartbeat.Stop()
+	closed := r.Context().Done()
+
+	for {
+		select {
+		case msg, open := <-sub.Messages():
+			if !open {
+				return
+			}
+			var ev draftEvent
+			if err := json.Unmarshal(msg, &ev); err != nil {
+				log.Printf("draftStream: dropping malformed event => {%s}", err)
+				continue
+			}
+			// access is only lost by a change to the user's membership,
+			// which is checked against the draft in case events raced.
+			// The draft is gone by the time it's reported deleted.
+			if ev.Type == eventMembers && ev.Member != nil && ev.Member.Email == user {
+				allowed, err := requestStores(r).canStream(draftID, user)
+				if err != nil {
+					log.Printf("draftStream: failed to check access of %s to %s => {%s}", user, draftID, err)
+					return
+				} else if !allowed {
+					return
+				}
+			}
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, msg)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			if ev.Type == eventDeleted {
+				return
+			}
+		case <-heartbeat.C:
+			presence.Presence = presenceHere
+			publishDraftEvent(presence)
+		case <-closed:
+			return
+		}
+	}
+}
+
+// draftCursor broadcasts the caller's cursor position on a draft
+func draftCursor(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	draftID := p.ByName(draftIDParam)
+
+	var cursor Cursor
+	if !readJSON(w, r, &cursor) {
+		return
+	}
+
+	publishDraftEvent(draftEvent{
+		Type:    eventCursor,
+		DraftID: draftID,
+		User:    requestUser(r),
+		Cursor:  &cursor,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stream opens the event stream of a draft and returns the types of the
+// events it gets, closing the channel when the stream ends
+func (c *testClient) stream(draftID string) <-chan string {
+	resp, err := c.http.Get(c.ts.server.URL + apiPrefix + "/draft/id/" + draftID + "/stream")
+	if err != nil {
+		c.ts.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.ts.t.Fatalf("stream = %d", resp.StatusCode)
+	}
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "event: ") {
+				events <- strings.TrimPrefix(scanner.Text(), "event: ")
+			}
+		}
+	}()
+	return events
+}
+
+// waitEvent returns the next event of a stream, or "" once it ended
+func waitEvent(t *testing.T, events <-chan string) string {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event on the stream")
+	}
+	return ""
+}
+
+func TestStreamEndsWhenCollaboratorIsRemoved(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+
+	draftID := ts.fake.AddDraft([]byte(testDraft))
+	if status := owner.do("POST", apiPrefix+"/draft/create", newEmailRequest{DraftID: draftID}, nil); status != http.StatusCreated {
+		t.Fatalf("create = %d", status)
+	}
+	if err := ts.stores.setMemberRole(draftID, "bob@example.com", roleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := ts.clientFor("u2", "bob@example.com")
+	events := bob.stream(draftID)
+	if ev := waitEvent(t, events); ev != eventPresence {
+		t.Fatalf("first event = %q, want %s", ev, eventPresence)
+	}
+
+	if status := owner.do("POST", apiPrefix+"/draft/id/"+draftID+"/remove", memberRequest{Email: "bob@example.com"}, nil); status != http.StatusOK {
+		t.Fatalf("remove = %d", status)
+	}
+	if ev := waitEvent(t, events); ev != "" {
+		t.Fatalf("removed collaborator got a %q event", ev)
+	}
+}
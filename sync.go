@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	syncPending = "pending"
+	syncSynced  = "synced"
+	syncFailed  = "failed"
+
+	// syncOrphaned drafts were deleted from Gmail and syncSent drafts were
+	// sent, so neither is pushed again
+	syncOrphaned = "orphaned"
+	syncSent     = "sent"
+
+	// syncDisabled drafts are in a mailbox whose owner disconnected their
+	// Google account. They are synced again once the owner signs back in.
+	syncDisabled = "disabled"
+
+	maxSyncAttempts = 5
+	syncRetryDelay  = 10 * time.Second
+	syncSweepPeriod = time.Minute
+)
+
+// SyncStatus records how far the Gmail copy of a draft is behind the Edits
+// stored in Mongo.
+type SyncStatus struct {
+	State       string    `bson:"state"`
+	Attempts    int       `bson:"attempts"`
+	LastError   string    `bson:"last_error,omitempty"`
+	LastAttempt time.Time `bson:"last_attempt,omitempty"`
+	SyncedAt    time.Time `bson:"synced_at,omitempty"`
+
+	// MessageID is the Gmail message last seen holding the draft, and
+	// Revisions the revision of each field it had. Gmail gives a draft a new
+	// message on every change, so a different ID means the draft changed.
+	MessageID  string         `bson:"message_id,omitempty"`
+	Revisions  map[string]int `bson:"revisions,omitempty"`
+	OrphanedAt time.Time      `bson:"orphaned_at,omitempty"`
+
+	// Attachments are the IDs of the attachments that message had
+	Attachments []string `bson:"attachments,omitempty"`
+}
+
+// syncedRevisions records the current revision of every field of mail
+func syncedRevisions(mail *Email) map[string]int {
+	revisions := map[string]int{
+		fieldBody:    mail.Revision,
+		fieldSubject: mail.Subject.Revision,
+	}
+	for field := range recipientHeaders {
+		revisions[field] = mail.recipientField(field).Revision
+	}
+	return revisions
+}
+
+// attachmentIDs lists the IDs of the attachments of mail
+func attachmentIDs(mail *Email) []string {
+	ids := []string{}
+	for _, a := range mail.Attachments {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+// inactiveSyncStates are the states of drafts that aren't synced with Gmail.
+var inactiveSyncStates = []string{syncOrphaned, syncSent, syncDisabled}
+
+var errSyncInactive = errors.New("draft isn't synced with Gmail")
+
+// syncQueue holds the draft IDs waiting to be pushed back to Gmail.
+var syncQueue = make(chan string, 100)
+
+// queueSync marks the draft as out of date and schedules a push to Gmail.
+func (st *Stores) queueSync(draftID string) {
+	_, err := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		if containsString(inactiveSyncStates, mail.Sync.State) {
+			return errSyncInactive
+		}
+		mail.Sync.State = syncPending
+		mail.Sync.Attempts = 0
+		return nil
+	})
+	if err == errSyncInactive {
+		// orphaned or sent, there is no Gmail draft left to push to, or
+		// disabled, there is no access to it
+		return
+	} else if err != nil {
+		log.Printf("queueSync: failed to mark draft %s pending => {%s}", draftID, err)
+	}
+
+	select {
+	case syncQueue <- draftID:
+	default:
+		// the sweep will pick it up
+		log.Printf("queueSync: queue full, deferring draft %s", draftID)
+	}
+}
+
+// runSyncWorker pushes queued drafts to Gmail, and periodically sweeps the
+// emails collection for drafts whose earlier attempts failed and for sends
+// left claimed, starting with the claims a stopped server left.
+func (st *Stores) runSyncWorker() {
+	sweep := time.NewTicker(syncSweepPeriod)
+	defer sweep.Stop()
+	st.sweepSendClaims()
+
+	for {
+		select {
+		case draftID := <-syncQueue:
+			st.syncDraft(draftID)
+		case <-sweep.C:
+			st.sweepUnsynced()
+			st.sweepSendClaims()
+		}
+	}
+}
+
+// sweepUnsynced requeues every draft that is not in sync and still has
+// attempts left.
+func (st *Stores) sweepUnsynced() {
+	drafts, err := st.Drafts.List(DraftQuery{
+		SyncStates:      []string{syncPending, syncFailed},
+		MaxSyncAttempts: maxSyncAttempts,
+	})
+	if err != nil {
+		log.Printf("sweepUnsynced: failed to query unsynced drafts => {%s}", err)
+		return
+	}
+
+	for _, d := range drafts {
+		select {
+		case syncQueue <- d.DraftID:
+		default:
+			return
+		}
+	}
+}
+
+// syncDraft writes the current content of a draft into the owner's Gmail draft,
+// recording the outcome on the Email. Failed attempts are retried with a
+// growing delay until maxSyncAttempts is reached.
+func (st *Stores) syncDraft(draftID string) {
+	mail, err := st.Drafts.Get(draftID)
+	if err != nil {
+		log.Printf("syncDraft: failed to load draft %s => {%s}", draftID, err)
+		return
+	}
+	if containsString(inactiveSyncStates, mail.Sync.State) {
+		return
+	}
+
+	messageID, err := st.pushDraft(mail)
+	if err == nil {
+		pushed, attached := syncedRevisions(mail), attachmentIDs(mail)
+		_, err = updateDraft(st.Drafts, draftID, func(mail *Email) error {
+			mail.Sync.State = syncSynced
+			mail.Sync.LastError = ""
+			mail.Sync.LastAttempt = time.Now()
+			mail.Sync.SyncedAt = time.Now()
+			mail.Sync.MessageID = messageID
+			mail.Sync.Revisions = pushed
+			mail.Sync.Attachments = attached
+			return nil
+		})
+		if err != nil {
+			log.Printf("syncDraft: failed to record sync of %s => {%s}", draftID, err)
+		}
+		return
+	}
+
+	log.Printf("syncDraft: failed to push draft %s to gmail => {%s}", draftID, err)
+	attempts := mail.Sync.Attempts + 1
+	state := syncPending
+	if attempts >= maxSyncAttempts {
+		state = syncFailed
+	}
+	_, uerr := updateDraft(st.Drafts, draftID, func(mail *Email) error {
+		mail.Sync.State = state
+		mail.Sync.Attempts = attempts
+		mail.Sync.LastError = err.Error()
+		mail.Sync.LastAttempt = time.Now()
+		return nil
+	})
+	if uerr != nil {
+		log.Printf("syncDraft: failed to record sync failure of %s => {%s}", draftID, uerr)
+	}
+
+	if state == syncPending {
+		time.AfterFunc(syncRetryDelay*time.Duration(attempts), func() {
+			syncQueue <- draftID
+		})
+	}
+}
+
+// pushDraft rebuilds the draft's MIME message from its current body, headers
+// and attachments and updates the Gmail draft with the credentials of the
+// mailbox holding it. It returns the ID of the message now holding the draft.
+func (st *Stores) pushDraft(mail *Email) (string, error) {
+	msg := mergedMessage(mail)
+	files, err := st.loadAttachments(mail)
+	if err != nil {
+		return "", err
+	}
+	msg.Attachments = append(msg.Attachments, files...)
+	raw, err := buildMessage(&msg)
+	if err != nil {
+		return "", fmt.Errorf("Failed to build message => {%s}", err)
+	}
+
+	gm, err := st.gmailForUser(mail.MailboxID)
+	if err != nil {
+		return "", err
+	}
+	// the error keeps its type so callers can tell whether to retry
+	return gm.UpdateDraft(mail.DraftID, raw)
+}
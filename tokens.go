@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	tokenCollection = "tokens"
+
+	// revokeTimeout is how long Google gets to revoke a token
+	revokeTimeout = 10 * time.Second
+
+	// gmailTimeout is how long a call to Gmail may take, uploads and token
+	// refreshes included
+	gmailTimeout = time.Minute
+)
+
+// googleRevokeURL is where Google takes back the access it granted.
+var googleRevokeURL = "https://accounts.google.com/o/oauth2/revoke"
+
+// revokeClient makes the revocation requests, which the user waits on
+var revokeClient = &http.Client{Timeout: revokeTimeout}
+
+// storedToken is a user's OAuth token, kept server side so work can be done
+// on their behalf outside of their requests.
+type storedToken struct {
+	UserID string `bson:"user_id"`
+	Email  string `bson:"email"`
+	// Grant tells apart the times the user connected their account: it is
+	// picked when a token is first stored and kept until they disconnect
+	Grant     string        `bson:"grant,omitempty"`
+	Token     *oauth2.Token `bson:"token"`
+	UpdatedAt time.Time     `bson:"updated_at"`
+}
+
+// TokenStore keeps the users' tokens. Missing tokens are reported as
+// mgo.ErrNotFound by every implementation.
+type TokenStore interface {
+	Load(userID string) (*storedToken, error)
+	FindByEmail(email string) (*storedToken, error)
+
+	// Save stores st, keeping the stored email if st has none and the stored
+	// grant if there is one
+	Save(st *storedToken) error
+
+	// Refresh replaces the stored token of a user with tok, refreshed from a
+	// token of grant, only if that grant is still stored. Once the user
+	// disconnected it reports mgo.ErrNotFound instead.
+	Refresh(userID, grant string, tok *oauth2.Token) error
+
+	Delete(userID string) error
+}
+
+// saveToken stores the token for a user. Google only hands out a refresh
+// token on the first consent, so an existing refresh token is kept when tok
+// doesn't carry one.
+func (st *Stores) saveToken(userID, email string, tok *oauth2.Token) error {
+	if tok.RefreshToken == "" {
+		old, err := st.loadToken(userID)
+		if err == nil {
+			tok.RefreshToken = old.Token.RefreshToken
+		}
+	}
+	return st.Tokens.Save(&storedToken{
+		UserID:    userID,
+		Email:     email,
+		Token:     tok,
+		UpdatedAt: time.Now(),
+	})
+}
+
+// loadToken fetches the stored token for a user
+func (st *Stores) loadToken(userID string) (*storedToken, error) {
+	stored, err := st.Tokens.Load(userID)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Token == nil {
+		return nil, fmt.Errorf("no token stored")
+	}
+	return stored, nil
+}
+
+// mongoTokenStore keeps tokens in the tokens collection.
+type mongoTokenStore struct {
+	c *mgo.Collection
+}
+
+func newMongoTokenStore(db *mgo.Database) *mongoTokenStore {
+	return &mongoTokenStore{c: db.C(tokenCollection)}
+}
+
+// ensureIndexes makes user_id unique in the tokens collection
+func (s *mongoTokenStore) ensureIndexes() error {
+	return s.c.EnsureIndex(mgo.Index{
+		Key:    []string{"user_id"},
+		Unique: true,
+	})
+}
+
+func (s *mongoTokenStore) Load(userID string) (*storedToken, error) {
+	return s.find(bson.M{"user_id": userID})
+}
+
+func (s *mongoTokenStore) FindByEmail(email string) (*storedToken, error) {
+	return s.find(bson.M{"email": email})
+}
+
+func (s *mongoTokenStore) find(query bson.M) (*storedToken, error) {
+	var st storedToken
+	err := s.c.Find(query).One(&st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *mongoTokenStore) Save(st *storedToken) error {
+	set := bson.M{
+		"user_id":    st.UserID,
+		"token":      st.Token,
+		"updated_at": st.UpdatedAt,
+	}
+	if st.Email != "" {
+		set["email"] = st.Email
+	}
+	_, err := s.c.Upsert(bson.M{"user_id": st.UserID}, bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"grant": bson.NewObjectId().Hex()},
+	})
+	return err
+}
+
+func (s *mongoTokenStore) Refresh(userID, grant string, tok *oauth2.Token) error {
+	// tokens stored before grants were have none, which nil matches
+	var stored interface{} = grant
+	if grant == "" {
+		stored = nil
+	}
+	return s.c.Update(
+		bson.M{"user_id": userID, "grant": stored},
+		bson.M{"$set": bson.M{"token": tok, "updated_at": time.Now()}})
+}
+
+func (s *mongoTokenStore) Delete(userID string) error {
+	return s.c.Remove(bson.M{"user_id": userID})
+}
+
+// memoryTokenStore keeps tokens in this process, for tests.
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]storedToken
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{tokens: make(map[string]storedToken)}
+}
+
+func (s *memoryTokenStore) Load(userID string) (*storedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.tokens[userID]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return &st, nil
+}
+
+func (s *memoryTokenStore) FindByEmail(email string) (*storedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.tokens {
+		if st.Email == email {
+			return &st, nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (s *memoryTokenStore) Save(st *storedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *st
+	old, ok := s.tokens[st.UserID]
+	if saved.Email == "" {
+		saved.Email = old.Email
+	}
+	saved.Grant = old.Grant
+	if !ok {
+		saved.Grant = bson.NewObjectId().Hex()
+	}
+	s.tokens[st.UserID] = saved
+	return nil
+}
+
+func (s *memoryTokenStore) Refresh(userID, grant string, tok *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.tokens[userID]
+	if !ok || st.Grant != grant {
+		return mgo.ErrNotFound
+	}
+	st.Token = tok
+	st.UpdatedAt = time.Now()
+	s.tokens[userID] = st
+	return nil
+}
+
+func (s *memoryTokenStore) Delete(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[userID]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(s.tokens, userID)
+	return nil
+}
+
+// storedTokenSource refreshes a user's token through the OAuth config and
+// writes every new token back to the tokens collection. A refresh finishing
+// after the user disconnected doesn't write its token back, so a revoked
+// token doesn't come back to life. Signing in again while connected keeps
+// the grant, and with it the refreshes under way.
+type storedTokenSource struct {
+	tokens       TokenStore
+	userID       string
+	grant        string
+	refreshToken string
+	base         oauth2.TokenSource
+
+	mu   sync.Mutex
+	last string
+}
+
+func (s *storedTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last {
+		saved := *tok
+		if saved.RefreshToken == "" {
+			saved.RefreshToken = s.refreshToken
+		}
+		err := s.tokens.Refresh(s.userID, s.grant, &saved)
+		if err == mgo.ErrNotFound {
+			return nil, fmt.Errorf("Token of user %s was revoked", s.userID)
+		} else if err != nil {
+			log.Printf("storedTokenSource: failed to persist token for %s => {%s}", s.userID, err)
+		}
+		// Google may have rotated the refresh token
+		s.refreshToken = saved.RefreshToken
+		s.last = tok.AccessToken
+	}
+	return tok, nil
+}
+
+// tokenSourceForUser returns a TokenSource for the stored token of a user
+// that refreshes and persists it as needed.
+func (st *Stores) tokenSourceForUser(userID string) (oauth2.TokenSource, error) {
+	stored, err := st.loadToken(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find token for user %s => {%s}", userID, err)
+	}
+
+	src := &storedTokenSource{
+		tokens:       st.Tokens,
+		userID:       userID,
+		grant:        stored.Grant,
+		refreshToken: stored.Token.RefreshToken,
+		base:         oauthCfg.TokenSource(oauth2.NoContext, stored.Token),
+		last:         stored.Token.AccessToken,
+	}
+	return oauth2.ReuseTokenSource(stored.Token, src), nil
+}
+
+// revokeToken asks Google to take back the access tok grants. Revoking the
+// refresh token revokes the access tokens issued from it too. A token Google
+// no longer knows is as good as revoked.
+func revokeToken(tok *oauth2.Token) error {
+	value := tok.RefreshToken
+	if value == "" {
+		value = tok.AccessToken
+	}
+	resp, err := revokeClient.PostForm(googleRevokeURL, url.Values{"token": {value}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode == http.StatusBadRequest && body.Error == "invalid_token" {
+		return nil
+	}
+	return fmt.Errorf("Google failed to revoke the token (%s) => {%s}", resp.Status, body.Error)
+}
+
+// clientForUser creates an oauth2 client from the stored token of a user
+func (st *Stores) clientForUser(userID string) (*http.Client, error) {
+	src, err := st.tokenSourceForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	client := oauth2.NewClient(oauth2.NoContext, src)
+	client.Timeout = gmailTimeout
+	return client, nil
+}
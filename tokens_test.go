@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// expireToken makes the next use of a user's token refresh it
+func (ts *testServer) expireToken(userID string) *storedToken {
+	st, err := ts.stores.loadToken(userID)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	st.Token.Expiry = time.Now().Add(-time.Minute)
+	if err := ts.stores.Tokens.Save(st); err != nil {
+		ts.t.Fatal(err)
+	}
+	return st
+}
+
+func TestRefreshedTokenIsStored(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	ts.signIn()
+	old := ts.expireToken(ts.fake.UserID)
+
+	src, err := ts.stores.tokenSourceForUser(ts.fake.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := ts.stores.loadToken(ts.fake.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken == old.Token.AccessToken || st.Token.AccessToken != tok.AccessToken {
+		t.Fatalf("stored access token = %q, refreshed %q", st.Token.AccessToken, tok.AccessToken)
+	}
+	if st.Token.RefreshToken != old.Token.RefreshToken {
+		t.Fatalf("refresh token changed to %q", st.Token.RefreshToken)
+	}
+}
+
+func TestRefreshDoesNotUndoDisconnect(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	ts.expireToken(ts.fake.UserID)
+
+	// a refresh under way while the user disconnects
+	src, err := ts.stores.tokenSourceForUser(ts.fake.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := owner.do("POST", apiPrefix+"/account/google/disconnect", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("disconnect = %d", status)
+	}
+
+	if _, err := src.Token(); err == nil {
+		t.Fatal("refresh after disconnecting succeeded")
+	}
+	if _, err := ts.stores.Tokens.Load(ts.fake.UserID); err != mgo.ErrNotFound {
+		t.Fatalf("token after disconnecting => {%v}, want it gone", err)
+	}
+}
+
+func TestRefreshAfterRotationAndSignIn(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	owner := ts.signIn()
+	ts.fake.RotateTokens()
+	ts.expireToken(ts.fake.UserID)
+
+	src, err := ts.stores.tokenSourceForUser(ts.fake.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// signing in again keeps the refreshes under way going
+			ts.signIn()
+		}
+		tok, err := src.Token()
+		if err != nil {
+			t.Fatalf("refresh %d => {%v}", i, err)
+		}
+		st, err := ts.stores.loadToken(ts.fake.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Token.AccessToken != tok.AccessToken || st.Token.RefreshToken != tok.RefreshToken {
+			t.Fatalf("refresh %d stored %+v, refreshed %+v", i, st.Token, tok)
+		}
+	}
+
+	if status := owner.do("POST", apiPrefix+"/account/google/disconnect", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("disconnect = %d", status)
+	}
+	ts.signIn()
+	if _, err := src.Token(); err == nil {
+		t.Fatal("refresh from before disconnecting succeeded")
+	}
+}